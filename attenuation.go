@@ -0,0 +1,249 @@
+package http3rd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/go-macaroon/macaroon"
+	"path"
+	"strings"
+	"time"
+)
+
+// Macaroon is a deserialized macaroon, which can be inspected and attenuated client side
+// Attenuating only adds first party caveats, so the result can be handed to a third party
+// without asking the storage for a new token.
+type Macaroon struct {
+	m *macaroon.Macaroon
+}
+
+// DecodeMacaroon returns a Macaroon from its base64 representation
+// URL safe and standard encodings are accepted, with or without padding.
+func DecodeMacaroon(encoded string) (*Macaroon, error) {
+	encoded = strings.TrimRight(strings.TrimSpace(encoded), "=")
+	decoded, e := base64.RawURLEncoding.DecodeString(encoded)
+	if e != nil {
+		decoded, e = base64.RawStdEncoding.DecodeString(encoded)
+	}
+	if e != nil {
+		return nil, fmt.Errorf("Could not base64-decode: %s", e)
+	}
+	M := &macaroon.Macaroon{}
+	if e = M.UnmarshalBinary(decoded); e != nil {
+		return nil, e
+	}
+	return &Macaroon{m: M}, nil
+}
+
+// WrapMacaroon returns a Macaroon built from a go-macaroon one
+func WrapMacaroon(M *macaroon.Macaroon) *Macaroon {
+	return &Macaroon{m: M}
+}
+
+// Unwrap returns the underlying go-macaroon
+func (m *Macaroon) Unwrap() *macaroon.Macaroon {
+	return m.m
+}
+
+// Encode returns the serialized base64 macaroon
+func (m *Macaroon) Encode() (string, error) {
+	token, e := m.m.MarshalBinary()
+	if e != nil {
+		return "", e
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// Clone returns an independent copy, so it can be attenuated keeping the original
+func (m *Macaroon) Clone() *Macaroon {
+	return &Macaroon{m: m.m.Clone()}
+}
+
+// Id returns the macaroon identifier
+func (m *Macaroon) Id() string {
+	return m.m.Id()
+}
+
+// Location returns the macaroon location hint
+func (m *Macaroon) Location() string {
+	return m.m.Location()
+}
+
+// RawCaveats returns the caveats as they are serialized, including third party ones
+func (m *Macaroon) RawCaveats() []string {
+	raw := []string{}
+	for _, caveat := range m.m.Caveats() {
+		raw = append(raw, caveat.Id)
+	}
+	return raw
+}
+
+// Caveats returns the first party caveats
+// Caveats that do not follow the key:value format are skipped.
+func (m *Macaroon) Caveats() []Caveat {
+	caveats := []Caveat{}
+	for _, caveat := range m.m.Caveats() {
+		if caveat.Location != "" {
+			continue
+		}
+		colon := strings.Index(caveat.Id, ":")
+		if colon < 0 {
+			continue
+		}
+		caveats = append(caveats, Caveat{
+			Key:   strings.TrimSpace(caveat.Id[:colon]),
+			Value: strings.TrimSpace(caveat.Id[colon+1:]),
+		})
+	}
+	return caveats
+}
+
+// values returns the value of all the caveats with the given key
+func (m *Macaroon) values(key string) []string {
+	values := []string{}
+	for _, caveat := range m.Caveats() {
+		if caveat.Key == key {
+			values = append(values, caveat.Value)
+		}
+	}
+	return values
+}
+
+// Activities returns the activities allowed by the macaroon, which is the intersection
+// of all the activity caveats. Returns nil if there are none (no restriction).
+func (m *Macaroon) Activities() []string {
+	var allowed []string
+	for i, value := range m.values("activity") {
+		current := []string{}
+		for _, activity := range strings.Split(value, ",") {
+			if activity = strings.TrimSpace(activity); activity != "" {
+				current = append(current, activity)
+			}
+		}
+		if i == 0 {
+			allowed = current
+			continue
+		}
+		intersection := []string{}
+		for _, activity := range allowed {
+			for _, other := range current {
+				if activity == other {
+					intersection = append(intersection, activity)
+					break
+				}
+			}
+		}
+		allowed = intersection
+	}
+	return allowed
+}
+
+// Expiry returns the earliest of the before caveats
+// The second value is false if there are none (or none can be parsed)
+func (m *Macaroon) Expiry() (time.Time, bool) {
+	var expiry time.Time
+	found := false
+	for _, value := range m.values("before") {
+		before, e := time.Parse(time.RFC3339, value)
+		if e != nil {
+			continue
+		}
+		if !found || before.Before(expiry) {
+			expiry = before
+			found = true
+		}
+	}
+	return expiry, found
+}
+
+// Paths returns the paths of the path caveats. All of them apply.
+func (m *Macaroon) Paths() []string {
+	return m.values("path")
+}
+
+// AddCaveat appends a first party caveat, checking only that it is well formed
+// Note that a caveat can only restrict the macaroon, but nothing prevents
+// adding a caveat that makes it useless (i.e. an activity that is not already allowed).
+func (m *Macaroon) AddCaveat(caveat Caveat) error {
+	if e := caveat.Validate(); e != nil {
+		return e
+	}
+	return m.m.AddFirstPartyCaveat(caveat.String())
+}
+
+// RestrictPath narrows the macaroon to the given path
+// The path must be inside of the paths already allowed.
+func (m *Macaroon) RestrictPath(p string) error {
+	p = path.Clean(p)
+	for _, allowed := range m.Paths() {
+		allowed = path.Clean(allowed)
+		if allowed != "/" && p != allowed && !strings.HasPrefix(p, allowed+"/") {
+			return fmt.Errorf("The path %s is outside of the allowed %s", p, allowed)
+		}
+	}
+	return m.AddCaveat(PathCaveat(p))
+}
+
+// RestrictBefore shortens the expiration time of the macaroon
+// It fails if the macaroon already expires earlier.
+func (m *Macaroon) RestrictBefore(before time.Time) error {
+	if expiry, ok := m.Expiry(); ok && expiry.Before(before) {
+		return fmt.Errorf("The macaroon already expires at %s", expiry.Format(time.RFC3339))
+	}
+	return m.AddCaveat(BeforeCaveat(before))
+}
+
+// RestrictLifetime makes the macaroon expire after the given duration from now
+func (m *Macaroon) RestrictLifetime(lifetime time.Duration) error {
+	return m.RestrictBefore(time.Now().Add(lifetime))
+}
+
+// RestrictActivities drops all the activities but the given ones
+// All of them must be already allowed.
+func (m *Macaroon) RestrictActivities(activities ...string) error {
+	if allowed := m.Activities(); allowed != nil {
+		for _, activity := range activities {
+			found := false
+			for _, other := range allowed {
+				if activity == other {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("The activity %s is not allowed by the macaroon", activity)
+			}
+		}
+	}
+	return m.AddCaveat(ActivityCaveat(activities...))
+}
+
+// Conflicts returns a description of the caveats that contradict each other,
+// making the macaroon useless (i.e. activity caveats without any activity in common)
+func (m *Macaroon) Conflicts() []string {
+	conflicts := []string{}
+
+	if activities := m.Activities(); activities != nil && len(activities) == 0 {
+		conflicts = append(conflicts, fmt.Sprintf("No activity is allowed by all of: %s",
+			strings.Join(m.values("activity"), " / ")))
+	}
+
+	paths := m.Paths()
+	for i := 0; i < len(paths); i++ {
+		for j := i + 1; j < len(paths); j++ {
+			a, b := path.Clean(paths[i]), path.Clean(paths[j])
+			nested := a == b || a == "/" || b == "/" ||
+				strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+			if !nested {
+				conflicts = append(conflicts, fmt.Sprintf("The paths %s and %s are disjoint", paths[i], paths[j]))
+			}
+		}
+	}
+
+	// Malformed values (i.e. unparseable before) can not be honoured either
+	for _, caveat := range m.Caveats() {
+		if e := caveat.Validate(); e != nil {
+			conflicts = append(conflicts, e.Error())
+		}
+	}
+	return conflicts
+}
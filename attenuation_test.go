@@ -0,0 +1,179 @@
+package http3rd
+
+import (
+	"encoding/base64"
+	"github.com/go-macaroon/macaroon"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestMacaroon returns a macaroon with the given first party caveats
+func newTestMacaroon(t *testing.T, caveats ...string) *Macaroon {
+	M, err := macaroon.New([]byte("secret"), "test-id", "https://se.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, caveat := range caveats {
+		if err = M.AddFirstPartyCaveat(caveat); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return WrapMacaroon(M)
+}
+
+func TestMacaroonEncodeDecode(t *testing.T) {
+	original := newTestMacaroon(t, "activity:DOWNLOAD,LIST", "path:/dteam")
+	encoded, err := original.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary, _ := base64.RawURLEncoding.DecodeString(encoded)
+
+	for _, variant := range []string{
+		encoded,
+		" " + encoded + "\n",
+		base64.URLEncoding.EncodeToString(binary),
+		base64.StdEncoding.EncodeToString(binary),
+	} {
+		decoded, err := DecodeMacaroon(variant)
+		if err != nil {
+			t.Errorf("%s: %s", variant, err)
+			continue
+		}
+		if decoded.Id() != "test-id" || decoded.Location() != "https://se.example.com" {
+			t.Errorf("Unexpected id or location: %s %s", decoded.Id(), decoded.Location())
+		}
+		if !reflect.DeepEqual(decoded.RawCaveats(), original.RawCaveats()) {
+			t.Errorf("Expecting %v, got %v", original.RawCaveats(), decoded.RawCaveats())
+		}
+		if reencoded, _ := decoded.Encode(); reencoded != encoded {
+			t.Error("The encoding does not round-trip")
+		}
+	}
+
+	for _, invalid := range []string{"", "not base64!", base64.RawURLEncoding.EncodeToString([]byte("garbage"))} {
+		if _, err := DecodeMacaroon(invalid); err == nil {
+			t.Errorf("Expecting %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestMacaroonActivities(t *testing.T) {
+	tests := []struct {
+		caveats  []string
+		expected []string
+	}{
+		{nil, nil},
+		{[]string{"activity:DOWNLOAD,LIST"}, []string{"DOWNLOAD", "LIST"}},
+		{[]string{"activity: DOWNLOAD , LIST "}, []string{"DOWNLOAD", "LIST"}},
+		{[]string{"activity:DOWNLOAD, LIST", "activity:LIST ,UPLOAD"}, []string{"LIST"}},
+		{[]string{"activity:DOWNLOAD", "activity:UPLOAD"}, []string{}},
+	}
+	for _, test := range tests {
+		if activities := newTestMacaroon(t, test.caveats...).Activities(); !reflect.DeepEqual(activities, test.expected) {
+			t.Errorf("%v: expecting %#v, got %#v", test.caveats, test.expected, activities)
+		}
+	}
+}
+
+func TestMacaroonRestrictPath(t *testing.T) {
+	M := newTestMacaroon(t, "path:/dteam/")
+	for _, outside := range []string{"/", "/atlas", "/dteam2", "/dteam/../atlas"} {
+		if err := M.Clone().RestrictPath(outside); err == nil {
+			t.Errorf("Expecting %s to be refused", outside)
+		}
+	}
+	for _, inside := range []string{"/dteam", "/dteam/file", "/dteam/dir/"} {
+		if err := M.Clone().RestrictPath(inside); err != nil {
+			t.Errorf("%s: %s", inside, err)
+		}
+	}
+
+	if err := M.RestrictPath("/dteam/dir"); err != nil {
+		t.Fatal(err)
+	}
+	if paths := M.Paths(); !reflect.DeepEqual(paths, []string{"/dteam/", "/dteam/dir"}) {
+		t.Error("Unexpected paths: ", paths)
+	}
+	if err := M.RestrictPath("/dteam/other"); err == nil {
+		t.Error("Expecting the path to be checked against all the path caveats")
+	}
+
+	// Without path caveats, anything goes
+	if err := newTestMacaroon(t).RestrictPath("/atlas"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMacaroonRestrictBefore(t *testing.T) {
+	expiry := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	M := newTestMacaroon(t, BeforeCaveat(expiry).String())
+
+	if err := M.RestrictBefore(expiry.Add(time.Minute)); err == nil {
+		t.Error("Expecting the lifetime not to be extended")
+	}
+	if err := M.RestrictLifetime(30 * time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if earliest, ok := M.Expiry(); !ok || !earliest.Before(expiry) {
+		t.Error("Expecting the earliest expiry, got ", earliest, ok)
+	}
+
+	if _, ok := newTestMacaroon(t).Expiry(); ok {
+		t.Error("Expecting no expiry without before caveat")
+	}
+	if _, ok := newTestMacaroon(t, "before:tomorrow").Expiry(); ok {
+		t.Error("Expecting a malformed before caveat to be ignored")
+	}
+}
+
+func TestMacaroonRestrictActivities(t *testing.T) {
+	M := newTestMacaroon(t, "activity:DOWNLOAD, LIST")
+	if err := M.Clone().RestrictActivities(Upload); err == nil {
+		t.Error("Expecting an activity not already allowed to be refused")
+	}
+	restricted := M.Clone()
+	if err := restricted.RestrictActivities(Download); err != nil {
+		t.Fatal(err)
+	}
+	if activities := restricted.Activities(); !reflect.DeepEqual(activities, []string{Download}) {
+		t.Error("Unexpected activities: ", activities)
+	}
+	// The clone is independent
+	if activities := M.Activities(); len(activities) != 2 {
+		t.Error("The original has been modified: ", activities)
+	}
+
+	// Without activity caveats, anything goes
+	if err := newTestMacaroon(t).RestrictActivities(Upload, Delete); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMacaroonConflicts(t *testing.T) {
+	tests := []struct {
+		caveats []string
+		// expected is a part of each conflict, in order
+		expected []string
+	}{
+		{[]string{"activity:DOWNLOAD,LIST", "activity: LIST", "path:/dteam", "path:/dteam/file"}, nil},
+		{[]string{"activity:DOWNLOAD", "activity:UPLOAD"}, []string{"No activity"}},
+		{[]string{"path:/dteam", "path:/atlas"}, []string{"disjoint"}},
+		{[]string{"path:/dteam", "path:/dteam2"}, []string{"disjoint"}},
+		{[]string{"before:tomorrow", "activity:READ"}, []string{"before", "READ"}},
+	}
+	for _, test := range tests {
+		conflicts := newTestMacaroon(t, test.caveats...).Conflicts()
+		if len(conflicts) != len(test.expected) {
+			t.Errorf("%v: expecting %d conflicts, got %v", test.caveats, len(test.expected), conflicts)
+			continue
+		}
+		for i, conflict := range conflicts {
+			if !strings.Contains(conflict, test.expected[i]) {
+				t.Errorf("%v: expecting %q in %q", test.caveats, test.expected[i], conflict)
+			}
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package http3rd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// CachedToken is a token together with what it has been issued for
+	CachedToken struct {
+		// Identity tells apart the tokens issued to different credentials, or by different providers
+		Identity   string    `json:"identity,omitempty"`
+		Resource   string    `json:"resource"`
+		Activities []string  `json:"activities"`
+		Expires    time.Time `json:"expires"`
+		Token      string    `json:"token"`
+	}
+
+	// TokenStore keeps cached tokens
+	TokenStore interface {
+		// Tokens returns all the stored tokens, expired or not
+		Tokens() ([]*CachedToken, error)
+		// Store adds a token
+		Store(token *CachedToken) error
+	}
+
+	// MemoryTokenStore keeps the tokens in memory
+	MemoryTokenStore struct {
+		mutex  sync.Mutex
+		tokens []*CachedToken
+	}
+
+	// FileTokenStore keeps the tokens in a JSON file, so they can be shared by separate processes
+	// The file is created readable only by the owner, since it contains bearer tokens.
+	FileTokenStore struct {
+		Path  string
+		mutex sync.Mutex
+	}
+
+	// TokenCache reuses tokens when they cover a later request
+	// A cached token is reused when its path covers the resource, its activities are a superset of the
+	// requested ones, and enough lifetime is left.
+	TokenCache struct {
+		// Store keeps the tokens. If nil, they are kept in memory.
+		Store TokenStore
+		// MinRemaining is the lifetime a token must have left to be reused.
+		// If 0, half the requested lifetime.
+		MinRemaining time.Duration
+		// Directory requests the tokens for the parent directory of the resource,
+		// so they can be reused for the files next to it
+		Directory bool
+
+		mutex sync.Mutex
+	}
+
+	// cachingProvider wraps a TokenProvider with a TokenCache
+	cachingProvider struct {
+		cache    *TokenCache
+		provider TokenProvider
+		identity string
+	}
+)
+
+// Tokens implements TokenStore
+func (s *MemoryTokenStore) Tokens() ([]*CachedToken, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]*CachedToken{}, s.tokens...), nil
+}
+
+// Store implements TokenStore
+func (s *MemoryTokenStore) Store(token *CachedToken) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tokens = append(pruneExpired(s.tokens), token)
+	return nil
+}
+
+// read loads the tokens from the file. A missing file is an empty store.
+func (s *FileTokenStore) read() ([]*CachedToken, error) {
+	content, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var tokens []*CachedToken
+	if err = json.Unmarshal(content, &tokens); err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+// Tokens implements TokenStore
+func (s *FileTokenStore) Tokens() ([]*CachedToken, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.read()
+}
+
+// Store implements TokenStore
+// The file is replaced atomically, so concurrent processes never see it half written,
+// although one of two concurrent writes may be lost.
+func (s *FileTokenStore) Store(token *CachedToken) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tokens, err := s.read()
+	if err != nil {
+		logrus.Warn("Discarding unreadable token cache ", s.Path, ": ", err)
+		tokens = nil
+	}
+	tokens = append(pruneExpired(tokens), token)
+
+	content, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.Path), filepath.Base(s.Path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err = tmp.Chmod(0600); err == nil {
+		_, err = tmp.Write(content)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
+
+// pruneExpired removes the expired tokens
+func pruneExpired(tokens []*CachedToken) []*CachedToken {
+	now := time.Now()
+	valid := make([]*CachedToken, 0, len(tokens))
+	for _, token := range tokens {
+		if token.Expires.After(now) {
+			valid = append(valid, token)
+		}
+	}
+	return valid
+}
+
+// covers returns true if the token has been issued for the resource, or for a parent directory
+func (t *CachedToken) covers(resource *url.URL) bool {
+	issued, err := url.Parse(t.Resource)
+	if err != nil || issued.Scheme != resource.Scheme || issued.Host != resource.Host {
+		return false
+	}
+	issuedPath := path.Clean("/" + issued.Path)
+	resourcePath := path.Clean("/" + resource.Path)
+	return issuedPath == resourcePath || issuedPath == "/" || strings.HasPrefix(resourcePath, issuedPath+"/")
+}
+
+// allows returns true if the token has been issued for all the activities
+func (t *CachedToken) allows(activities []string) bool {
+	for _, needed := range activities {
+		found := false
+		for _, granted := range t.Activities {
+			if strings.EqualFold(needed, granted) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// store returns the configured store, or creates the in-memory one
+func (c *TokenCache) store() TokenStore {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.Store == nil {
+		c.Store = &MemoryTokenStore{}
+	}
+	return c.Store
+}
+
+// Lookup returns a cached token usable for the request, or nil
+// Only the tokens stored with the same identity are considered.
+func (c *TokenCache) Lookup(identity, resource string, activities []string, lifetime time.Duration) (*CachedToken, error) {
+	resourceURL, err := url.Parse(resource)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := c.store().Tokens()
+	if err != nil {
+		return nil, err
+	}
+
+	minRemaining := c.MinRemaining
+	if minRemaining <= 0 {
+		minRemaining = lifetime / 2
+	}
+	deadline := time.Now().Add(minRemaining)
+
+	for _, token := range tokens {
+		if token.Identity == identity && token.Expires.After(deadline) && token.covers(resourceURL) && token.allows(activities) {
+			return token, nil
+		}
+	}
+	return nil, nil
+}
+
+// Provider returns a TokenProvider that goes through the cache before asking the wrapped provider
+// identity is who the tokens are issued to (i.e. the subject of the X509 credentials used to
+// negotiate macaroons), if the provider configuration does not tell it. Both are part of the
+// key of the cached tokens, so a shared store never returns a token issued to someone else.
+func (c *TokenCache) Provider(provider TokenProvider, identity string) TokenProvider {
+	return &cachingProvider{
+		cache:    c,
+		provider: provider,
+		identity: providerIdentity(provider) + " " + identity,
+	}
+}
+
+// providerIdentity describes the configuration of the provider that decides which tokens it issues
+func providerIdentity(provider TokenProvider) string {
+	switch p := provider.(type) {
+	case *MacaroonProvider:
+		return "macaroon"
+	case *OAuth2Provider:
+		return fmt.Sprintf("oauth2 %s %s %s %s %s", p.Issuer, p.TokenEndpoint, p.ClientID, p.Grant, p.Audience)
+	case StaticToken:
+		hash := sha256.Sum256([]byte(p))
+		return "static " + hex.EncodeToString(hash[:8])
+	case *FileToken:
+		return "file " + p.Path
+	case *CommandToken:
+		return "command " + strings.Join(append([]string{p.Command}, p.Args...), " ")
+	}
+	return fmt.Sprintf("%T", provider)
+}
+
+// TokenExpiry returns when the token expires, if the token tells it: the exp claim of a JWT,
+// or the earliest before caveat of a macaroon
+// The second value is false if it can not be told.
+func TokenExpiry(token string) (time.Time, bool) {
+	if parts := strings.Split(token, "."); len(parts) == 3 {
+		payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+		if err != nil {
+			return time.Time{}, false
+		}
+		claims := struct {
+			Exp *json.Number `json:"exp"`
+		}{}
+		if err = json.Unmarshal(payload, &claims); err != nil || claims.Exp == nil {
+			return time.Time{}, false
+		}
+		exp, err := claims.Exp.Float64()
+		if err != nil {
+			return time.Time{}, false
+		}
+		return time.Unix(int64(exp), 0), true
+	}
+	if M, err := DecodeMacaroon(token); err == nil {
+		return M.Expiry()
+	}
+	return time.Time{}, false
+}
+
+// Token implements TokenProvider
+func (p *cachingProvider) Token(ctx context.Context, resource string, activities []string, lifetime time.Duration) (string, error) {
+	cached, err := p.cache.Lookup(p.identity, resource, activities, lifetime)
+	if err != nil {
+		logrus.Warn("Could not lookup the token cache: ", err)
+	} else if cached != nil {
+		logrus.Debug("Reusing cached token issued for ", cached.Resource)
+		return cached.Token, nil
+	}
+
+	if p.cache.Directory {
+		if resourceURL, err := url.Parse(resource); err == nil {
+			resourceURL.Path = path.Dir(path.Clean("/"+resourceURL.Path)) + "/"
+			resource = resourceURL.String()
+		}
+	}
+
+	// The issuer may grant less than requested, so the actual expiration is used when known
+	expires := time.Now().Add(lifetime)
+	var token string
+	var actual time.Time
+	if expiring, ok := p.provider.(ExpiringTokenProvider); ok {
+		token, actual, err = expiring.TokenWithExpiry(ctx, resource, activities, lifetime)
+	} else {
+		token, err = p.provider.Token(ctx, resource, activities, lifetime)
+	}
+	if err != nil {
+		return "", err
+	}
+	if actual.IsZero() {
+		actual, _ = TokenExpiry(token)
+	}
+	if !actual.IsZero() && actual.Before(expires) {
+		expires = actual
+	}
+
+	err = p.cache.store().Store(&CachedToken{
+		Identity:   p.identity,
+		Resource:   resource,
+		Activities: activities,
+		Expires:    expires,
+		Token:      token,
+	})
+	if err != nil {
+		logrus.Warn("Could not store the token in the cache: ", err)
+	}
+	return token, nil
+}
@@ -0,0 +1,109 @@
+package http3rd
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// countingProvider issues a new token for each request
+type countingProvider struct {
+	issued int
+}
+
+// Token implements TokenProvider
+func (p *countingProvider) Token(ctx context.Context, resource string, activities []string, lifetime time.Duration) (string, error) {
+	p.issued++
+	return fmt.Sprint("token-", p.issued), nil
+}
+
+// fakeJWT returns an unsigned JWT with the given expiration
+func fakeJWT(exp time.Time) string {
+	encode := base64.RawURLEncoding.EncodeToString
+	return encode([]byte(`{"alg":"none"}`)) + "." +
+		encode([]byte(fmt.Sprintf(`{"sub":"user","exp":%d}`, exp.Unix()))) + "."
+}
+
+func TestTokenExpiry(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+	if actual, ok := TokenExpiry(fakeJWT(exp)); !ok || !actual.Equal(exp) {
+		t.Error("Expecting ", exp, ", got ", actual, ok)
+	}
+	if _, ok := TokenExpiry("opaque"); ok {
+		t.Error("An opaque token has no known expiration")
+	}
+}
+
+func TestTokenCacheExpiry(t *testing.T) {
+	issuer := newTestIssuer(t, "litmus", "s3cr3t")
+	issuer.expiresIn = 60
+	cache := &TokenCache{}
+	provider := cache.Provider(&OAuth2Provider{
+		TokenEndpoint: issuer.URL + "/token",
+		ClientID:      "litmus",
+		ClientSecret:  "s3cr3t",
+	}, "")
+
+	// The issuer grants a minute, so a token for an hour is not reused
+	for i := 0; i < 2; i++ {
+		if _, err := provider.Token(context.Background(), "https://se.example.com/dteam/file", []string{Download}, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if issuer.requests() != 2 {
+		t.Error("Expecting two token requests, got ", issuer.requests())
+	}
+
+	// Half a minute is left, so it is reused for 30 seconds
+	if _, err := provider.Token(context.Background(), "https://se.example.com/dteam/file", []string{Download}, 30*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if issuer.requests() != 2 {
+		t.Error("Expecting the token to be reused")
+	}
+
+	tokens, _ := cache.Store.Tokens()
+	for _, token := range tokens {
+		if token.Expires.After(time.Now().Add(time.Minute)) {
+			t.Error("The token is cached beyond its expiration: ", token.Expires)
+		}
+	}
+}
+
+func TestTokenCacheIdentity(t *testing.T) {
+	store := &FileTokenStore{Path: filepath.Join(t.TempDir(), "tokens.json")}
+	alice := &countingProvider{}
+	bob := &countingProvider{}
+	aliceCache := (&TokenCache{Store: store}).Provider(alice, "/CN=alice")
+	bobCache := (&TokenCache{Store: store}).Provider(bob, "/CN=bob")
+
+	resource := "https://se.example.com/dteam/file"
+	first, err := aliceCache.Token(context.Background(), resource, []string{Download}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := bobCache.Token(context.Background(), resource, []string{Download}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bob.issued != 1 {
+		t.Error("The token of another identity has been reused: ", first, second)
+	}
+
+	again, err := aliceCache.Token(context.Background(), resource, []string{Download}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != first || alice.issued != 1 {
+		t.Error("Expecting the cached token ", first, ", got ", again)
+	}
+
+	// Same identity, but a different provider configuration
+	other := (&TokenCache{Store: store}).Provider(&CommandToken{Command: "/bin/false"}, "/CN=alice")
+	if _, err = other.Token(context.Background(), resource, []string{Download}, time.Hour); err == nil {
+		t.Error("The token of another provider has been reused")
+	}
+}
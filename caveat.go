@@ -0,0 +1,115 @@
+package http3rd
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Caveat is a first party caveat, serialized as key:value
+type Caveat struct {
+	Key, Value string
+}
+
+var caveatKeyRegex = regexp.MustCompile("^[a-zA-Z0-9_.-]+$")
+
+// knownActivities are the activities the storages understand
+var knownActivities = map[string]bool{
+	Download: true,
+	Upload:   true,
+	List:     true,
+	Delete:   true,
+	Manage:   true,
+}
+
+// ActivityCaveat restricts the token to the given activities
+func ActivityCaveat(activities ...string) Caveat {
+	return Caveat{Key: "activity", Value: strings.Join(activities, ",")}
+}
+
+// BeforeCaveat makes the token expire at the given time
+func BeforeCaveat(t time.Time) Caveat {
+	return Caveat{Key: "before", Value: t.UTC().Format(time.RFC3339)}
+}
+
+// PathCaveat restricts the token to the given path, and whatever is below
+func PathCaveat(p string) Caveat {
+	return Caveat{Key: "path", Value: p}
+}
+
+// IPCaveat restricts the token to clients connecting from the given addresses or networks (CIDR)
+func IPCaveat(addresses ...string) Caveat {
+	return Caveat{Key: "ip", Value: strings.Join(addresses, ",")}
+}
+
+// CustomCaveat returns an arbitrary key:value caveat
+func CustomCaveat(key, value string) Caveat {
+	return Caveat{Key: key, Value: value}
+}
+
+// ParseCaveat splits a serialized key:value caveat
+func ParseCaveat(serialized string) (Caveat, error) {
+	colon := strings.Index(serialized, ":")
+	if colon < 0 {
+		return Caveat{}, fmt.Errorf("Caveat without key: %s", serialized)
+	}
+	caveat := Caveat{
+		Key:   strings.TrimSpace(serialized[:colon]),
+		Value: strings.TrimSpace(serialized[colon+1:]),
+	}
+	return caveat, caveat.Validate()
+}
+
+// String returns the serialized caveat
+func (c Caveat) String() string {
+	return c.Key + ":" + c.Value
+}
+
+// Validate checks the caveat is well formed
+// The value of the well known caveats (activity, before, path, ip) is checked as well.
+func (c Caveat) Validate() error {
+	if !caveatKeyRegex.MatchString(c.Key) {
+		return fmt.Errorf("Invalid caveat key: '%s'", c.Key)
+	}
+	if c.Value == "" {
+		return fmt.Errorf("Empty value for caveat %s", c.Key)
+	}
+	if strings.ContainsAny(c.Value, "\r\n") {
+		return fmt.Errorf("Caveat %s contains a new line", c.Key)
+	}
+
+	switch c.Key {
+	case "activity":
+		for _, activity := range strings.Split(c.Value, ",") {
+			if !knownActivities[strings.TrimSpace(activity)] {
+				return fmt.Errorf("Unknown activity: '%s'", activity)
+			}
+		}
+	case "before":
+		if _, err := time.Parse(time.RFC3339, c.Value); err != nil {
+			return fmt.Errorf("Invalid before caveat: %s", err)
+		}
+	case "path":
+		if !path.IsAbs(c.Value) {
+			return fmt.Errorf("The path caveat must be absolute: %s", c.Value)
+		}
+		for _, component := range strings.Split(c.Value, "/") {
+			if component == ".." {
+				return fmt.Errorf("The path caveat can not go up: %s", c.Value)
+			}
+		}
+	case "ip":
+		for _, address := range strings.Split(c.Value, ",") {
+			if net.ParseIP(address) != nil {
+				continue
+			}
+			if _, _, err := net.ParseCIDR(address); err != nil {
+				return fmt.Errorf("Invalid address or network in ip caveat: '%s'", address)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package http3rd
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCaveatValidate(t *testing.T) {
+	valid := []Caveat{
+		ActivityCaveat(Download),
+		ActivityCaveat(Download, Upload, List, Delete, Manage),
+		{Key: "activity", Value: "DOWNLOAD, LIST"},
+		BeforeCaveat(time.Now()),
+		{Key: "before", Value: "2030-01-01T00:00:00+02:00"},
+		PathCaveat("/"),
+		PathCaveat("/dteam/file..name"),
+		IPCaveat("127.0.0.1", "::1", "10.0.0.0/8", "2001:db8::/32"),
+		CustomCaveat("role", "admin"),
+		CustomCaveat("x.y-z_0", "anything: even colons"),
+	}
+	for _, caveat := range valid {
+		if err := caveat.Validate(); err != nil {
+			t.Errorf("%s: %s", caveat, err)
+		}
+	}
+
+	invalid := []Caveat{
+		ActivityCaveat(),
+		ActivityCaveat("READ"),
+		ActivityCaveat(Download, "download"),
+		{Key: "activity", Value: "DOWNLOAD,"},
+		{Key: "before", Value: "tomorrow"},
+		{Key: "before", Value: "2030-01-01"},
+		PathCaveat("dteam"),
+		PathCaveat("/dteam/../atlas"),
+		IPCaveat("localhost"),
+		IPCaveat("10.0.0.0/33"),
+		CustomCaveat("", "value"),
+		CustomCaveat("the key", "value"),
+		CustomCaveat("key:", "value"),
+		CustomCaveat("key", ""),
+		CustomCaveat("key", "two\nlines"),
+	}
+	for _, caveat := range invalid {
+		if err := caveat.Validate(); err == nil {
+			t.Errorf("Expecting %q to be rejected", caveat)
+		}
+	}
+}
+
+func TestParseCaveat(t *testing.T) {
+	caveat, err := ParseCaveat(" path : /dteam ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caveat.Key != "path" || caveat.Value != "/dteam" {
+		t.Errorf("Unexpected caveat: %+v", caveat)
+	}
+	// Only the first colon separates the key
+	if caveat, err = ParseCaveat("before:2030-01-01T00:00:00Z"); err != nil || caveat.Value != "2030-01-01T00:00:00Z" {
+		t.Error("Unexpected caveat: ", caveat, err)
+	}
+	for _, invalid := range []string{"", "path", ":/dteam", "activity:READ"} {
+		if _, err := ParseCaveat(invalid); err == nil {
+			t.Errorf("Expecting %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestMacaroonRequestActivities(t *testing.T) {
+	tests := []struct {
+		activities []string
+		expected   string
+	}{
+		{[]string{Download, List}, "activity:DOWNLOAD,LIST"},
+		// No activity caveat, instead of an empty one
+		{nil, ""},
+		{[]string{}, ""},
+	}
+	for _, test := range tests {
+		req, err := buildHTTPRequest(&MacaroonRequest{
+			Resource:   "https://se.example.com/file",
+			Activities: test.activities,
+			Caveats:    []Caveat{PathCaveat("/file")},
+		}, ExpiryAuto)
+		if err != nil {
+			t.Errorf("%v: %s", test.activities, err)
+			continue
+		}
+		payload := &jsonMacaroonRequest{}
+		if err = json.NewDecoder(req.Body).Decode(payload); err != nil {
+			t.Fatal(err)
+		}
+
+		var activity string
+		for _, caveat := range payload.Caveats {
+			if strings.HasPrefix(caveat, "activity:") {
+				activity = caveat
+			}
+		}
+		if activity != test.expected {
+			t.Errorf("%v: expecting %q, got %v", test.activities, test.expected, payload.Caveats)
+		}
+		if payload.Caveats[len(payload.Caveats)-1] != "path:/file" {
+			t.Errorf("%v: the other caveats must be kept, got %v", test.activities, payload.Caveats)
+		}
+	}
+}
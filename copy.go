@@ -1,94 +1,444 @@
 package http3rd
 
 import (
-	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strings"
 	"time"
 )
 
+// CopyMode selects which endpoint drives the third party copy
+type CopyMode int
+
+const (
+	// PushMode sends the COPY to the source, which uploads into the destination
+	PushMode CopyMode = iota
+	// PullMode sends the COPY to the destination, which downloads from the source
+	PullMode
+)
+
 type (
 	// Params configures the third party copy request
 	Params struct {
 		UserCert, UserKey string
 		CAPath            string
 		Insecure          bool
+		// Revocation selects how the revocation of the server certificates is checked,
+		// with the CRLs of the CA path
+		Revocation RevocationMode
+		// OCSPStapling checks the server certificate with the OCSP response stapled by the server,
+		// if any, instead of the CRL. Only used if Revocation is set.
+		OCSPStapling bool
+		// TokenProvider issues the tokens for the endpoint
+		// If nil, a macaroon is negotiated using the X509 credentials.
+		TokenProvider TokenProvider
+		// MacaroonExpiry selects how the lifetime of the negotiated macaroons is requested
+		MacaroonExpiry ExpiryMode
+		// NoDiscovery disables probing the endpoints for their capabilities before the copy
+		NoDiscovery bool
+		// Retry, if set, retries the token requests and the COPY submission on transient failures.
+		// It is shared by both endpoints.
+		Retry *RetryPolicy
+		// Redirect, if set, decides which redirects are followed, and if the tokens are sent
+		// to other hosts. Defaults to stripping them when the host changes.
+		Redirect *RedirectPolicy
+		// Credential selects if the passive endpoint is accessed with a token, or with a proxy
+		// delegated to the active endpoint
+		Credential CredentialMode
+		// DelegationEndpoint is the GridSite delegation service of the endpoint.
+		// If empty, the one advertised by the endpoint with X-Delegate-To is used.
+		DelegationEndpoint string
+		// UseToken authenticates the requests sent to the active endpoint with a bearer token,
+		// for storages that need a token on both ends.
+		// The passive endpoint gets a token unless Credential is GridsiteCredential.
+		// It can be set at the top level, or in the Source or Destination override of
+		// the active endpoint.
+		UseToken bool
+		// NoOverwrite makes the copy fail if the destination already exists
+		NoOverwrite bool
+		Mode        CopyMode
+		// Progress, if set, is called for each performance marker received
+		Progress ProgressFunc
+		// TokenCache, if set, reuses the tokens of previous copies. It is shared by both endpoints.
+		TokenCache *TokenCache
+		// Source and Destination, if set, are used instead of the top level parameters to
+		// authenticate with each endpoint (i.e. when they trust different CAs).
+		// Only the credential fields (certificate, key, CA path, insecure, revocation,
+		// token provider, macaroon expiry, delegation endpoint, use token) are used.
+		// NoDiscovery, Retry and Redirect are taken from the top level.
+		Source, Destination *Params
+	}
+
+	// copyRequest holds what is needed to build the COPY request
+	copyRequest struct {
+		Mode                CopyMode
+		Source, Destination string
+		// TransferToken is passed to the passive endpoint via TransferHeaderAuthorization
+		TransferToken string
+		// AuthToken, if not empty, authenticates the COPY with the active endpoint
+		AuthToken string
+		// Delegate asks the active endpoint to use the proxy delegated to it, instead of a token
+		Delegate bool
+		// NoOverwrite sends Overwrite: F
+		NoOverwrite bool
+	}
+
+	// copyEndpoint is one of the sides of the copy
+	copyEndpoint struct {
+		url      string
+		params   *Params
+		client   *http.Client
+		cache    *TokenCache
+		discover bool
+		retry    *RetryPolicy
+		redirect *RedirectPolicy
 	}
 )
 
+// String returns the name of the copy mode
+func (m CopyMode) String() string {
+	switch m {
+	case PushMode:
+		return "push"
+	case PullMode:
+		return "pull"
+	}
+	return fmt.Sprintf("CopyMode(%d)", int(m))
+}
+
+// ParseCopyMode returns the CopyMode matching the given name
+func ParseCopyMode(name string) (CopyMode, error) {
+	switch strings.ToLower(name) {
+	case "push":
+		return PushMode, nil
+	case "pull":
+		return PullMode, nil
+	}
+	return PushMode, fmt.Errorf("Unknown copy mode: %s", name)
+}
+
 // buildCopyRequest returns an initialized HTTP COPY request
-func buildCopyRequest(source, destination, macaroon string) (*http.Request, error) {
+// In push mode the request goes to the source, and the token must be valid for the destination.
+// In pull mode the request goes to the destination, and the token must be valid for the source.
+func buildCopyRequest(copyReq *copyRequest) (*http.Request, error) {
 	var err error
 
 	req := &http.Request{
 		Method: "COPY",
 		Header: http.Header{},
 	}
-	req.URL, err = url.Parse(source)
+
+	switch copyReq.Mode {
+	case PushMode:
+		req.URL, err = url.Parse(copyReq.Source)
+		req.Header.Add("Destination", copyReq.Destination)
+	case PullMode:
+		req.URL, err = url.Parse(copyReq.Destination)
+		req.Header.Add("Source", copyReq.Source)
+	default:
+		err = fmt.Errorf("Unsupported copy mode: %s", copyReq.Mode)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	req.Header.Add("Destination", destination)
-	req.Header.Add("X-No-Delegate", "true")
-	req.Header.Add("Credential", "none")
-	req.Header.Add("TransferHeaderAuthorization", fmt.Sprint("BEARER ", macaroon))
+	if copyReq.Delegate {
+		req.Header.Add("Credential", "gridsite")
+	} else {
+		req.Header.Add("X-No-Delegate", "true")
+		req.Header.Add("Credential", "none")
+		req.Header.Add("TransferHeaderAuthorization", fmt.Sprint("BEARER ", copyReq.TransferToken))
+	}
+	if copyReq.NoOverwrite {
+		req.Header.Add("Overwrite", "F")
+	}
+	if copyReq.AuthToken != "" {
+		req.Header.Add("Authorization", fmt.Sprint("BEARER ", copyReq.AuthToken))
+	}
 	return req, nil
 }
 
-// requestRawCopy triggers the COPY method
-func requestRawCopy(client *http.Client, source string, destination, macaroon string) error {
-	req, err := buildCopyRequest(source, destination, macaroon)
+// requestRawCopy triggers the COPY method, and follows the performance markers until the end
+// The copy is considered failed if the final line of the body is not a success, even if the
+// status code was a 2xx. onMarker, if not nil, is called for each performance marker.
+func requestRawCopy(ctx context.Context, client *http.Client, redirect *RedirectPolicy, copyReq *copyRequest, onMarker func(*PerfMarker)) (*CopyResult, error) {
+	req, err := buildCopyRequest(copyReq)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	rawReq, err := httputil.DumpRequest(req, false)
+	rawReq, err := httputil.DumpRequest(redactedRequest(req), false)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	logrus.Debug(string(rawReq))
 
-	resp, err := DoWithRedirect(client, req)
+	resp, err := redirect.Do(ctx, client, req)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer resp.Body.Close()
 
 	if resp.StatusCode/100 != 2 {
-		rawResp, _ := httputil.DumpResponse(resp, true)
-		logrus.Debug(string(rawResp))
-		return fmt.Errorf("Unexpected status code: %d", resp.StatusCode)
+		rawResp, _ := httputil.DumpResponse(resp, false)
+		body, _ := ioutil.ReadAll(resp.Body)
+		logrus.Debug(string(rawResp), string(body))
+		rejected := &CopyRejectedError{
+			HTTPError: newHTTPError(resp.Request.URL.String(), resp, body),
+		}
+		for _, value := range resp.Header.Values("X-Delegate-To") {
+			rejected.DelegateTo = append(rejected.DelegateTo, strings.Fields(value)...)
+		}
+		return nil, rejected
 	}
 
-	reader := bufio.NewReader(resp.Body)
-	for line, err := reader.ReadString('\n'); err == nil; line, err = reader.ReadString('\n') {
-		logrus.Debug(line)
+	// Cancelling the context closes the connection, so Drain returns
+	var lastMarker *PerfMarker
+	parser := NewPerfMarkerParser(resp.Body)
+	result, err := parser.Drain(func(marker *PerfMarker) {
+		lastMarker = marker
+		if onMarker != nil {
+			onMarker(marker)
+		}
+	})
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	} else if err == io.ErrUnexpectedEOF {
+		return nil, &TransferFailedError{
+			URL:        resp.Request.URL.String(),
+			Message:    "COPY response ended without a final success or failure line",
+			LastMarker: lastMarker,
+			Incomplete: true,
+		}
+	} else if err != nil {
+		return nil, &TransferFailedError{
+			URL:        resp.Request.URL.String(),
+			Message:    err.Error(),
+			LastMarker: lastMarker,
+			Incomplete: true,
+			Err:        err,
+		}
 	}
-
-	return nil
+	if !result.Success {
+		return result, &TransferFailedError{
+			URL:        resp.Request.URL.String(),
+			Message:    result.Message,
+			LastMarker: lastMarker,
+		}
+	}
+	return result, nil
 }
 
 // DoHTTP3rdCopy triggers a third party copy
+// params.Mode decides if the copy is pushed from the source, or pulled by the destination.
 func DoHTTP3rdCopy(params *Params, lifetime time.Duration, source, destination string) error {
-	client, err := BuildHttpClient(params)
+	return DoHTTP3rdCopyContext(context.Background(), params, lifetime, source, destination)
+}
+
+// DoHTTP3rdCopyContext triggers a third party copy
+// Cancelling the context aborts the token negotiation or the COPY request, whichever is running.
+// Note that, depending on the implementation, the remote endpoint may keep
+// the transfer running after the connection is closed.
+func DoHTTP3rdCopyContext(ctx context.Context, params *Params, lifetime time.Duration, source, destination string) error {
+	src, err := newCopyEndpoint(params, params.Source, source)
 	if err != nil {
 		return err
 	}
+	dst, err := newCopyEndpoint(params, params.Destination, destination)
+	if err != nil {
+		return err
+	}
+
+	// The active endpoint receives the COPY, the passive one is accessed by the active one
+	var active, passive *copyEndpoint
+	var activeActivities, passiveActivities []string
+	switch params.Mode {
+	case PushMode:
+		active, passive = src, dst
+		activeActivities = []string{Download, List}
+		passiveActivities = []string{Upload, List}
+	case PullMode:
+		active, passive = dst, src
+		activeActivities = []string{Upload, List}
+		passiveActivities = []string{Download, List}
+	default:
+		return fmt.Errorf("Unsupported copy mode: %s", params.Mode)
+	}
+
+	if caps := active.capabilities(ctx); caps != nil && !caps.TPC {
+		return fmt.Errorf("%s does not support third party copies (COPY is not allowed)", active.url)
+	}
+
+	copyReq := &copyRequest{
+		Mode:        params.Mode,
+		Source:      source,
+		Destination: destination,
+		NoOverwrite: params.NoOverwrite,
+	}
 
-	destinationToken, err := GetMacaroon(client, &MacaroonRequest{
-		Resource:   destination,
-		Lifetime:   lifetime,
-		Activities: []string{Upload,List},
+	switch params.Credential {
+	case TokenCredential:
+		copyReq.TransferToken, err = passive.token(ctx, lifetime, passiveActivities)
+		if err != nil {
+			return err
+		}
+	case GridsiteCredential:
+		copyReq.Delegate = true
+		if service := active.params.DelegationEndpoint; service != "" {
+			if err = active.delegate(ctx, service, lifetime); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("Unsupported credential mode: %s", params.Credential)
+	}
+	if params.UseToken || active.params.UseToken {
+		copyReq.AuthToken, err = active.token(ctx, lifetime, activeActivities)
+		if err != nil {
+			return err
+		}
+	}
+
+	submit := func() (*CopyResult, error) {
+		tracker := newProgressTracker()
+		return requestRawCopy(ctx, active.client, active.redirect, copyReq, func(marker *PerfMarker) {
+			logrus.Debugf("Performance marker: stripe %d/%d, %d bytes",
+				marker.StripeIndex, marker.TotalStripeCount, marker.StripeBytesTransferred)
+			progress := tracker.update(marker)
+			if params.Progress != nil {
+				params.Progress(progress)
+			}
+		})
+	}
+
+	// A COPY that failed after being accepted is only re-issued if the policy explicitly allows it
+	var result *CopyResult
+	delegated := active.params.DelegationEndpoint != ""
+	err = params.Retry.Do(ctx, func() (err error) {
+		result, err = submit()
+		// Without a configured delegation service, the endpoint tells where to delegate when
+		// it rejects the COPY
+		var rejected *CopyRejectedError
+		if copyReq.Delegate && !delegated && errors.As(err, &rejected) && len(rejected.DelegateTo) > 0 {
+			if err = active.delegate(ctx, rejected.DelegateTo[0], lifetime); err != nil {
+				return
+			}
+			delegated = true
+			result, err = submit()
+		}
+		return
 	})
 	if err != nil {
 		return err
 	}
+	logrus.Info("Transfer succeeded: ", result.Message)
+	return nil
+}
+
+// newCopyEndpoint initializes one side of the copy, with its own client
+// override, if not nil, replaces the top level credentials
+func newCopyEndpoint(params, override *Params, resource string) (*copyEndpoint, error) {
+	endpoint := &copyEndpoint{
+		url:      resource,
+		params:   params,
+		cache:    params.TokenCache,
+		discover: !params.NoDiscovery,
+		retry:    params.Retry,
+		redirect: params.Redirect,
+	}
+	if override != nil {
+		endpoint.params = override
+	}
+
+	var err error
+	endpoint.client, err = BuildHttpClient(endpoint.params)
+	if err != nil {
+		return nil, err
+	}
+	endpoint.client.CheckRedirect = endpoint.redirect.CheckRedirect
+	return endpoint, nil
+}
+
+// capabilities returns the capabilities of the endpoint, or nil if the discovery
+// is disabled or failed, in which case everything is assumed to be supported
+func (e *copyEndpoint) capabilities(ctx context.Context) *Capabilities {
+	if !e.discover {
+		return nil
+	}
+	caps, err := DiscoverCapabilities(ctx, e.client, e.redirect, e.url)
+	if err != nil {
+		logrus.Debug("Could not discover the capabilities of ", e.url, ": ", err)
+		return nil
+	}
+	return caps
+}
+
+// delegate delegates a proxy of the endpoint credentials to the delegation service
+func (e *copyEndpoint) delegate(ctx context.Context, service string, lifetime time.Duration) error {
+	creds, err := LoadCredentials(e.params.UserCert, e.params.UserKey)
+	if err != nil {
+		return err
+	}
+	delegator := &Delegator{
+		Client:      e.client,
+		Endpoint:    service,
+		Credentials: creds,
+		Lifetime:    lifetime,
+	}
+	_, err = delegator.Delegate(ctx)
+	return err
+}
 
-	logrus.Info("Got macaroon ", destinationToken.Macaroon)
+// identity returns who the endpoint credentials belong to: the end entity subject and the
+// VOMS attributes, which are kept by the renewed proxies, or the certificate path if they
+// can not be loaded
+func (e *copyEndpoint) identity() string {
+	if e.params.UserCert == "" {
+		return ""
+	}
+	creds, err := LoadCredentials(e.params.UserCert, e.params.UserKey)
+	if err != nil {
+		return e.params.UserCert
+	}
+	identity := creds.Identity
+	for _, attribute := range creds.VOMS {
+		identity += " " + attribute.FQAN
+	}
+	return identity
+}
+
+// token returns a token for the endpoint from the configured provider, or negotiates
+// a macaroon with its own credentials if there is none
+func (e *copyEndpoint) token(ctx context.Context, lifetime time.Duration, activities []string) (string, error) {
+	provider := e.params.TokenProvider
+	if provider == nil {
+		// POST missing from Allow is only a hint, so the macaroon is requested anyway.
+		// If the endpoint does not issue them, the request fails with ErrNoMacaroonSupport.
+		if caps := e.capabilities(ctx); caps != nil && !caps.Macaroons {
+			logrus.Debug(e.url, " does not advertise POST, requesting a macaroon anyway")
+		}
+		provider = &MacaroonProvider{
+			Client: e.client,
+			Expiry: e.params.MacaroonExpiry,
+			Retry:  e.retry,
+		}
+	}
+	if e.cache != nil {
+		provider = e.cache.Provider(provider, e.identity())
+	}
+
+	token, err := provider.Token(ctx, e.url, activities, lifetime)
+	if err != nil {
+		return "", err
+	}
 
-	// TODO: Parse response
-	return requestRawCopy(client, source, destination, destinationToken.Macaroon)
+	logrus.Debug("Got token for ", e.url, ": ", redactToken(token))
+	return token, nil
 }
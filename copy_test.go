@@ -0,0 +1,78 @@
+package http3rd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// staticProvider always issues the same token
+type staticProvider string
+
+// Token implements TokenProvider
+func (p staticProvider) Token(ctx context.Context, resource string, activities []string, lifetime time.Duration) (string, error) {
+	return string(p), nil
+}
+
+func TestCopyUseToken(t *testing.T) {
+	var header http.Header
+	var mutex sync.Mutex
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		header = r.Header.Clone()
+		mutex.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("success: Created\n"))
+	}))
+	defer source.Close()
+
+	override := func(token string, useToken bool) *Params {
+		return &Params{CAPath: t.TempDir(), TokenProvider: staticProvider(token), UseToken: useToken}
+	}
+	tests := []struct {
+		name   string
+		params *Params
+		// expected in the Authorization header of the COPY, empty if none
+		authorization string
+		// issuer of the token for the destination
+		transfer string
+	}{
+		{"disabled", &Params{TokenProvider: staticProvider("top")}, "", "top"},
+		{"top level", &Params{TokenProvider: staticProvider("top"), UseToken: true}, "BEARER top", "top"},
+		{"top level with overrides", &Params{
+			UseToken:    true,
+			Source:      override("source", false),
+			Destination: override("destination", false),
+		}, "BEARER source", "destination"},
+		{"override", &Params{
+			Source:      override("source", true),
+			Destination: override("destination", false),
+		}, "BEARER source", "destination"},
+		// Only the active endpoint counts
+		{"passive override", &Params{
+			Source:      override("source", false),
+			Destination: override("destination", true),
+		}, "", "destination"},
+	}
+
+	for _, test := range tests {
+		test.params.CAPath = t.TempDir()
+		test.params.NoDiscovery = true
+		test.params.Mode = PushMode
+		if err := DoHTTP3rdCopy(test.params, time.Hour, source.URL+"/file", "https://dst.example.com/file"); err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		mutex.Lock()
+		if authorization := header.Get("Authorization"); authorization != test.authorization {
+			t.Errorf("%s: expecting %q, got %q", test.name, test.authorization, authorization)
+		}
+		if transfer := header.Get("TransferHeaderAuthorization"); transfer != "BEARER "+test.transfer {
+			t.Errorf("%s: expecting a transfer token from %s, got %q", test.name, test.transfer, transfer)
+		}
+		mutex.Unlock()
+	}
+}
@@ -0,0 +1,111 @@
+package http3rd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"gitlab.cern.ch/flutter/go-proxy"
+	"time"
+)
+
+type (
+	// Credentials are the X509 credentials presented to the endpoints
+	Credentials struct {
+		// Certificate is ready to be used by crypto/tls, with the full chain
+		Certificate tls.Certificate
+		// Subject of the certificate
+		Subject string
+		// Identity is the subject of the end entity certificate, if Certificate is a proxy
+		Identity string
+		// Proxy is true for proxy certificates (RFC 3820 or legacy)
+		Proxy bool
+		// NotAfter is when the first certificate of the chain expires
+		NotAfter time.Time
+		// VOMS are the attributes embedded in the proxy
+		VOMS []VOMSAttribute
+	}
+
+	// VOMSAttribute is a VO membership, group or role asserted by a VOMS server
+	VOMSAttribute struct {
+		VO string
+		// FQAN is the fully qualified attribute name (i.e. /dteam/Role=NULL/Capability=NULL)
+		FQAN                string
+		NotBefore, NotAfter time.Time
+	}
+)
+
+// LoadCredentials loads the certificate and its private key
+// certPath and keyPath can be the same file, as with grid proxies, which also carry their chain.
+func LoadCredentials(certPath, keyPath string) (*Credentials, error) {
+	x509Proxy := &proxy.X509Proxy{}
+	var e error
+	if keyPath == "" || keyPath == certPath {
+		e = x509Proxy.DecodeFromFile(certPath)
+	} else {
+		e = x509Proxy.DecodeFromFiles(certPath, keyPath)
+	}
+	if e != nil {
+		return nil, fmt.Errorf("Failed to load the credentials from %s: %w", certPath, e)
+	}
+	if x509Proxy.Certificate == nil || x509Proxy.PrivateKey == nil {
+		return nil, fmt.Errorf("No certificate and private key found in %s", certPath)
+	}
+
+	creds := &Credentials{
+		Subject:  proxy.NameRepr(&x509Proxy.Certificate.Subject),
+		Identity: proxy.NameRepr(&x509Proxy.Identity),
+		NotAfter: x509Proxy.Certificate.NotAfter,
+	}
+	if creds.Identity == "" {
+		creds.Identity = creds.Subject
+	}
+	creds.Proxy = creds.Subject != creds.Identity
+
+	creds.Certificate.PrivateKey = x509Proxy.PrivateKey
+	creds.Certificate.Leaf = x509Proxy.Certificate
+	creds.Certificate.Certificate = [][]byte{x509Proxy.Certificate.Raw}
+	for _, cert := range x509Proxy.Chain {
+		if bytes.Equal(cert.Raw, x509Proxy.Certificate.Raw) {
+			continue
+		}
+		creds.Certificate.Certificate = append(creds.Certificate.Certificate, cert.Raw)
+		// A proxy is not valid beyond any of the certificates that signed it
+		if cert.NotAfter.Before(creds.NotAfter) {
+			creds.NotAfter = cert.NotAfter
+		}
+	}
+
+	for _, attr := range x509Proxy.VomsAttributes {
+		creds.VOMS = append(creds.VOMS, VOMSAttribute{
+			VO:        attr.Vo,
+			FQAN:      attr.Fqan,
+			NotBefore: attr.NotBefore,
+			NotAfter:  attr.NotAfter,
+		})
+	}
+	return creds, nil
+}
+
+// Check returns an error if the credentials have expired
+// Expired VOMS attributes only cause a warning, since the endpoint may not need them.
+func (c *Credentials) Check() error {
+	now := time.Now()
+	if c.Certificate.Leaf != nil && now.Before(c.Certificate.Leaf.NotBefore) {
+		return fmt.Errorf("The certificate of %s is not valid until %s", c.Identity, c.Certificate.Leaf.NotBefore)
+	}
+	if !now.Before(c.NotAfter) {
+		kind := "certificate"
+		if c.Proxy {
+			kind = "proxy"
+		}
+		return fmt.Errorf("The %s of %s expired on %s (%s ago)",
+			kind, c.Identity, c.NotAfter.Format(time.RFC3339), now.Sub(c.NotAfter).Truncate(time.Second))
+	}
+	for _, attr := range c.VOMS {
+		if !now.Before(attr.NotAfter) {
+			logrus.Warnf("The VOMS attribute %s expired on %s", attr.FQAN, attr.NotAfter.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+package http3rd
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CredentialMode selects how the active endpoint is authorized with the passive one
+type CredentialMode int
+
+const (
+	// TokenCredential passes a bearer token with TransferHeaderAuthorization
+	TokenCredential CredentialMode = iota
+	// GridsiteCredential delegates an X509 proxy to the active endpoint with the GridSite
+	// delegation service, for storages that do not support tokens
+	GridsiteCredential
+)
+
+const (
+	delegationNamespace = "http://www.gridsite.org/namespaces/delegation-2"
+	soapNamespace       = "http://schemas.xmlsoap.org/soap/envelope/"
+)
+
+var (
+	// oidProxyCertInfo is the RFC 3820 ProxyCertInfo extension
+	oidProxyCertInfo = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 14}
+	// oidInheritAll is the policy language of a proxy with all the rights of its issuer
+	oidInheritAll = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 21, 1}
+)
+
+type (
+	// Delegator delegates a proxy of the user credentials to a GridSite delegation service
+	Delegator struct {
+		// Client used to talk with the delegation service, authenticated with Credentials
+		Client *http.Client
+		// Endpoint of the delegation service
+		Endpoint    string
+		Credentials *Credentials
+		// Lifetime of the delegated proxy. It never goes beyond the expiration of the credentials.
+		Lifetime time.Duration
+	}
+
+	// proxyPolicy and proxyCertInfo model the RFC 3820 extension
+	proxyPolicy struct {
+		PolicyLanguage asn1.ObjectIdentifier
+	}
+	proxyCertInfo struct {
+		ProxyPolicy proxyPolicy
+	}
+
+	// soapFault is the error returned by the service
+	soapFault struct {
+		Code   string `xml:"faultcode"`
+		String string `xml:"faultstring"`
+	}
+
+	// soapEnvelope models the replies of the delegation service
+	soapEnvelope struct {
+		XMLName xml.Name `xml:"Envelope"`
+		Body    struct {
+			Fault          *soapFault `xml:"Fault"`
+			NewProxyReqRet *struct {
+				ProxyRequest string `xml:"proxyRequest"`
+				DelegationID string `xml:"delegationID"`
+			} `xml:"getNewProxyReqResponse>getNewProxyReqReturn"`
+		} `xml:"Body"`
+	}
+)
+
+// String returns the name of the credential mode
+func (m CredentialMode) String() string {
+	switch m {
+	case TokenCredential:
+		return "token"
+	case GridsiteCredential:
+		return "gridsite"
+	}
+	return fmt.Sprintf("CredentialMode(%d)", int(m))
+}
+
+// ParseCredentialMode returns the CredentialMode matching the given name
+func ParseCredentialMode(name string) (CredentialMode, error) {
+	switch strings.ToLower(name) {
+	case "token":
+		return TokenCredential, nil
+	case "gridsite":
+		return GridsiteCredential, nil
+	}
+	return TokenCredential, fmt.Errorf("Unknown credential mode: %s", name)
+}
+
+// xmlEscape returns the value escaped to be used as XML text
+func xmlEscape(value string) string {
+	buffer := &bytes.Buffer{}
+	xml.EscapeText(buffer, []byte(value))
+	return buffer.String()
+}
+
+// call sends the SOAP operation, and parses the reply
+func (d *Delegator) call(ctx context.Context, operation, arguments string) (*soapEnvelope, error) {
+	body := `<?xml version="1.0" encoding="UTF-8"?>` +
+		`<SOAP-ENV:Envelope xmlns:SOAP-ENV="` + soapNamespace + `" xmlns:deleg="` + delegationNamespace + `">` +
+		`<SOAP-ENV:Body><deleg:` + operation + `>` + arguments + `</deleg:` + operation + `></SOAP-ENV:Body>` +
+		`</SOAP-ENV:Envelope>`
+
+	req, e := http.NewRequest("POST", d.Endpoint, strings.NewReader(body))
+	if e != nil {
+		return nil, e
+	}
+	req.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	req.Header.Set("SOAPAction", `""`)
+	logrus.Debug("Calling ", operation, " on ", d.Endpoint)
+
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, e := client.Do(req.WithContext(ctx))
+	if e != nil {
+		return nil, e
+	}
+	defer resp.Body.Close()
+
+	respBody, e := ioutil.ReadAll(resp.Body)
+	if e != nil {
+		return nil, e
+	}
+	logrus.Debug("Response: ", string(respBody))
+
+	envelope := &soapEnvelope{}
+	parseErr := xml.Unmarshal(respBody, envelope)
+	if parseErr == nil && envelope.Body.Fault != nil {
+		return nil, &DelegationError{
+			HTTPError: newHTTPError(d.Endpoint, resp, respBody),
+			Fault:     envelope.Body.Fault.String,
+		}
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, &DelegationError{HTTPError: newHTTPError(d.Endpoint, resp, respBody)}
+	}
+	if parseErr != nil {
+		return nil, fmt.Errorf("Malformed reply from the delegation service: %w", parseErr)
+	}
+	return envelope, nil
+}
+
+// getNewProxyReq asks the service for a certificate request, and the delegation ID it belongs to
+func (d *Delegator) getNewProxyReq(ctx context.Context) (*x509.CertificateRequest, string, error) {
+	envelope, e := d.call(ctx, "getNewProxyReq", "")
+	if e != nil {
+		return nil, "", e
+	}
+	ret := envelope.Body.NewProxyReqRet
+	if ret == nil || ret.ProxyRequest == "" {
+		return nil, "", errors.New("The delegation service did not return a proxy request")
+	}
+
+	block, _ := pem.Decode([]byte(ret.ProxyRequest))
+	if block == nil {
+		return nil, "", errors.New("The proxy request is not PEM encoded")
+	}
+	csr, e := x509.ParseCertificateRequest(block.Bytes)
+	if e != nil {
+		return nil, "", e
+	}
+	if e = csr.CheckSignature(); e != nil {
+		return nil, "", fmt.Errorf("Invalid signature on the proxy request: %w", e)
+	}
+	return csr, ret.DelegationID, nil
+}
+
+// putProxy sends the signed proxy, followed by the chain
+func (d *Delegator) putProxy(ctx context.Context, delegationID string, proxy []byte) error {
+	arguments := `<delegationID>` + xmlEscape(delegationID) + `</delegationID>` +
+		`<proxy>` + xmlEscape(string(proxy)) + `</proxy>`
+	_, e := d.call(ctx, "putProxy", arguments)
+	return e
+}
+
+// SignProxy issues a RFC 3820 proxy for the certificate request, signed with the credentials
+// The result is PEM encoded, followed by the chain of the credentials.
+func (d *Delegator) SignProxy(csr *x509.CertificateRequest) ([]byte, error) {
+	issuer := d.Credentials.Certificate.Leaf
+	if issuer == nil {
+		return nil, errors.New("The credentials do not have a certificate")
+	}
+
+	serial, e := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 63))
+	if e != nil {
+		return nil, e
+	}
+
+	// The subject of a proxy is the one of the issuer, plus a CN with the serial number
+	var subject pkix.RDNSequence
+	if _, e = asn1.Unmarshal(issuer.RawSubject, &subject); e != nil {
+		return nil, e
+	}
+	subject = append(subject, pkix.RelativeDistinguishedNameSET{
+		{Type: asn1.ObjectIdentifier{2, 5, 4, 3}, Value: serial.String()},
+	})
+	rawSubject, e := asn1.Marshal(subject)
+	if e != nil {
+		return nil, e
+	}
+
+	certInfo, e := asn1.Marshal(proxyCertInfo{ProxyPolicy: proxyPolicy{PolicyLanguage: oidInheritAll}})
+	if e != nil {
+		return nil, e
+	}
+
+	notBefore := time.Now().Add(-5 * time.Minute)
+	notAfter := time.Now().Add(d.Lifetime)
+	if d.Lifetime <= 0 || notAfter.After(d.Credentials.NotAfter) {
+		notAfter = d.Credentials.NotAfter
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		RawSubject:   rawSubject,
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtraExtensions: []pkix.Extension{
+			{Id: oidProxyCertInfo, Critical: true, Value: certInfo},
+		},
+	}
+	der, e := x509.CreateCertificate(rand.Reader, template, issuer, csr.PublicKey, d.Credentials.Certificate.PrivateKey)
+	if e != nil {
+		return nil, e
+	}
+
+	buffer := &bytes.Buffer{}
+	pem.Encode(buffer, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	for _, raw := range d.Credentials.Certificate.Certificate {
+		pem.Encode(buffer, &pem.Block{Type: "CERTIFICATE", Bytes: raw})
+	}
+	return buffer.Bytes(), nil
+}
+
+// Delegate delegates a proxy to the service, and returns the delegation ID
+func (d *Delegator) Delegate(ctx context.Context) (string, error) {
+	if d.Credentials == nil {
+		return "", errors.New("Delegation requires X509 credentials")
+	}
+	csr, delegationID, e := d.getNewProxyReq(ctx)
+	if e != nil {
+		return "", e
+	}
+	proxy, e := d.SignProxy(csr)
+	if e != nil {
+		return "", e
+	}
+	if e = d.putProxy(ctx, delegationID, proxy); e != nil {
+		return "", e
+	}
+	logrus.Info("Delegated proxy to ", d.Endpoint, " with id ", delegationID)
+	return delegationID, nil
+}
@@ -0,0 +1,328 @@
+package http3rd
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDelegationService is a stand-in GridSite delegation service
+type testDelegationService struct {
+	*httptest.Server
+	// fault, if set, is returned for every operation
+	fault string
+
+	mutex sync.Mutex
+	// csr is the certificate request of the last getNewProxyReq
+	csr *x509.CertificateRequest
+	// proxies are the proxies received, by delegation ID
+	proxies map[string][]byte
+}
+
+// testDelegationCall models the operations received by testDelegationService
+type testDelegationCall struct {
+	Body struct {
+		GetNewProxyReq *struct{} `xml:"getNewProxyReq"`
+		PutProxy       *struct {
+			DelegationID string `xml:"delegationID"`
+			Proxy        string `xml:"proxy"`
+		} `xml:"putProxy"`
+	} `xml:"Body"`
+}
+
+// newTestCredentials generates a user certificate, and writes it with its key into the
+// returned files, as LoadCredentials expects them
+func newTestCredentials(t *testing.T) (*Credentials, string, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"http3rd"}, CommonName: "Test User"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(12 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "usercert.pem"), filepath.Join(dir, "userkey.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err = ioutil.WriteFile(certPath, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	creds := &Credentials{
+		Subject:  cert.Subject.String(),
+		Identity: cert.Subject.String(),
+		NotAfter: cert.NotAfter,
+	}
+	creds.Certificate.Certificate = [][]byte{der}
+	creds.Certificate.PrivateKey = key
+	creds.Certificate.Leaf = cert
+	return creds, certPath, keyPath
+}
+
+// newTestDelegationService starts an empty delegation service
+func newTestDelegationService(t *testing.T) *testDelegationService {
+	service := &testDelegationService{proxies: make(map[string][]byte)}
+	service.Server = httptest.NewServer(http.HandlerFunc(service.serve))
+	t.Cleanup(service.Close)
+	return service
+}
+
+// writeSOAP replies with the given SOAP body
+func writeSOAP(w http.ResponseWriter, status int, body string) {
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(`<?xml version="1.0" encoding="UTF-8"?>` +
+		`<SOAP-ENV:Envelope xmlns:SOAP-ENV="` + soapNamespace + `" xmlns:deleg="` + delegationNamespace + `">` +
+		`<SOAP-ENV:Body>` + body + `</SOAP-ENV:Body></SOAP-ENV:Envelope>`))
+}
+
+// serve implements getNewProxyReq and putProxy
+func (s *testDelegationService) serve(w http.ResponseWriter, r *http.Request) {
+	if s.fault != "" {
+		writeSOAP(w, http.StatusInternalServerError, `<SOAP-ENV:Fault><faultcode>SOAP-ENV:Server</faultcode>`+
+			`<faultstring>`+xmlEscape(s.fault)+`</faultstring></SOAP-ENV:Fault>`)
+		return
+	}
+	call := &testDelegationCall{}
+	if err := xml.NewDecoder(r.Body).Decode(call); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch {
+	case call.Body.GetNewProxyReq != nil:
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+			Subject: pkix.Name{CommonName: "proxy"},
+		}, key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.csr, _ = x509.ParseCertificateRequest(der)
+		csr := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+		writeSOAP(w, http.StatusOK, `<deleg:getNewProxyReqResponse><getNewProxyReqReturn>`+
+			`<proxyRequest>`+xmlEscape(string(csr))+`</proxyRequest>`+
+			`<delegationID>test-delegation</delegationID>`+
+			`</getNewProxyReqReturn></deleg:getNewProxyReqResponse>`)
+	case call.Body.PutProxy != nil:
+		s.proxies[call.Body.PutProxy.DelegationID] = []byte(call.Body.PutProxy.Proxy)
+		writeSOAP(w, http.StatusOK, `<deleg:putProxyResponse/>`)
+	default:
+		http.Error(w, "Unsupported operation", http.StatusBadRequest)
+	}
+}
+
+// proxy returns the proxy delegated with the given ID, if any
+func (s *testDelegationService) proxy(delegationID string) []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.proxies[delegationID]
+}
+
+func TestDelegate(t *testing.T) {
+	creds, _, _ := newTestCredentials(t)
+	service := newTestDelegationService(t)
+	delegator := &Delegator{
+		Client:      service.Client(),
+		Endpoint:    service.URL,
+		Credentials: creds,
+		Lifetime:    time.Hour,
+	}
+
+	delegationID, err := delegator.Delegate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delegationID != "test-delegation" {
+		t.Error("Unexpected delegation ID: ", delegationID)
+	}
+
+	// The proxy is followed by the chain of the credentials
+	var chain []*x509.Certificate
+	for block, rest := pem.Decode(service.proxy(delegationID)); block != nil; block, rest = pem.Decode(rest) {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) != 2 || !chain[1].Equal(creds.Certificate.Leaf) {
+		t.Fatal("Expecting the proxy followed by the user certificate, got ", len(chain), " certificates")
+	}
+	proxy, issuer := chain[0], chain[1]
+
+	// Signed by the user, for the key of the request
+	if err = issuer.CheckSignature(proxy.SignatureAlgorithm, proxy.RawTBSCertificate, proxy.Signature); err != nil {
+		t.Error("The proxy is not signed by the user: ", err)
+	}
+	if !proxy.PublicKey.(*ecdsa.PublicKey).Equal(service.csr.PublicKey) {
+		t.Error("The proxy is not issued for the key of the request")
+	}
+	if !bytes.Equal(proxy.RawIssuer, issuer.RawSubject) {
+		t.Error("Unexpected issuer: ", proxy.Issuer)
+	}
+
+	// The subject is the one of the issuer, plus a CN with the serial number
+	var subject, issuerSubject pkix.RDNSequence
+	if _, err = asn1.Unmarshal(proxy.RawSubject, &subject); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = asn1.Unmarshal(issuer.RawSubject, &issuerSubject); err != nil {
+		t.Fatal(err)
+	}
+	if len(subject) != len(issuerSubject)+1 {
+		t.Fatal("Unexpected subject: ", subject)
+	}
+	last := subject[len(subject)-1]
+	if !last[0].Type.Equal(asn1.ObjectIdentifier{2, 5, 4, 3}) || last[0].Value != proxy.SerialNumber.String() {
+		t.Error("Expecting a CN with the serial number, got ", last)
+	}
+
+	// RFC 3820 ProxyCertInfo, critical, inheriting all the rights
+	found := false
+	for _, extension := range proxy.Extensions {
+		if !extension.Id.Equal(oidProxyCertInfo) {
+			continue
+		}
+		found = true
+		if !extension.Critical {
+			t.Error("The ProxyCertInfo extension must be critical")
+		}
+		info := proxyCertInfo{}
+		if _, err = asn1.Unmarshal(extension.Value, &info); err != nil {
+			t.Fatal(err)
+		}
+		if !info.ProxyPolicy.PolicyLanguage.Equal(oidInheritAll) {
+			t.Error("Unexpected policy language: ", info.ProxyPolicy.PolicyLanguage)
+		}
+	}
+	if !found {
+		t.Error("The proxy does not have the ProxyCertInfo extension")
+	}
+
+	if proxy.NotAfter.After(time.Now().Add(time.Hour)) {
+		t.Error("The proxy outlives the requested lifetime: ", proxy.NotAfter)
+	}
+}
+
+func TestDelegateLifetime(t *testing.T) {
+	creds, _, _ := newTestCredentials(t)
+	service := newTestDelegationService(t)
+	delegator := &Delegator{Client: service.Client(), Endpoint: service.URL, Credentials: creds, Lifetime: 48 * time.Hour}
+
+	delegationID, err := delegator.Delegate(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(service.proxy(delegationID))
+	proxy, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if proxy.NotAfter.After(creds.NotAfter) {
+		t.Error("The proxy outlives the credentials: ", proxy.NotAfter)
+	}
+}
+
+func TestDelegateFault(t *testing.T) {
+	creds, _, _ := newTestCredentials(t)
+	service := newTestDelegationService(t)
+	service.fault = "Delegation refused"
+	delegator := &Delegator{Client: service.Client(), Endpoint: service.URL, Credentials: creds}
+
+	_, err := delegator.Delegate(context.Background())
+	var delegationErr *DelegationError
+	if !errors.As(err, &delegationErr) {
+		t.Fatal("Expecting a DelegationError, got ", err)
+	}
+	if delegationErr.Fault != "Delegation refused" {
+		t.Error("Unexpected fault: ", delegationErr.Fault)
+	}
+}
+
+func TestCopyDelegateTo(t *testing.T) {
+	_, certPath, keyPath := newTestCredentials(t)
+	service := newTestDelegationService(t)
+
+	// The source only accepts the COPY once a proxy has been delegated,
+	// and tells where to delegate otherwise
+	var copies []http.Header
+	var mutex sync.Mutex
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		copies = append(copies, r.Header.Clone())
+		mutex.Unlock()
+		if service.proxy("test-delegation") == nil {
+			w.Header().Set("X-Delegate-To", service.URL)
+			http.Error(w, "No delegated proxy", http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("success: Created\n"))
+	}))
+	defer source.Close()
+
+	params := &Params{
+		UserCert:    certPath,
+		UserKey:     keyPath,
+		CAPath:      t.TempDir(),
+		Credential:  GridsiteCredential,
+		NoDiscovery: true,
+		Mode:        PushMode,
+	}
+	if err := DoHTTP3rdCopy(params, time.Hour, source.URL+"/file", "https://dst.example.com/file"); err != nil {
+		t.Fatal(err)
+	}
+
+	if service.proxy("test-delegation") == nil {
+		t.Error("Expecting a proxy to be delegated to the advertised service")
+	}
+	if len(copies) != 2 {
+		t.Fatal("Expecting the COPY to be resubmitted once, got ", len(copies))
+	}
+	for _, header := range copies {
+		if header.Get("Credential") != "gridsite" || header.Get("TransferHeaderAuthorization") != "" {
+			t.Error("Expecting a gridsite COPY without token, got ", header)
+		}
+	}
+}
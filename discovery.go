@@ -0,0 +1,202 @@
+package http3rd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// ErrNoMacaroonSupport is returned when the endpoint does not issue macaroons
+var ErrNoMacaroonSupport = errors.New("this endpoint does not issue macaroons")
+
+type (
+	// Capabilities describes what an endpoint supports, as advertised on an OPTIONS or HEAD request
+	Capabilities struct {
+		// URL that has been probed
+		URL string
+		// Redirect is the URL that finally answered, if the probe was redirected
+		Redirect string
+		Server   string
+		// DAV compliance classes
+		DAV []string
+		// Allowed methods
+		Allow []string
+		// Macaroons is false if POST is not allowed. This is only a hint, since the
+		// macaroon requests may be handled before the Allow header is built.
+		Macaroons bool
+		// TPC is false only if the endpoint positively does not allow COPY
+		TPC bool
+	}
+
+	// capabilityCache keeps the discovered capabilities per host and client certificate
+	// It assumes that all the resources of a host support the same methods, which holds
+	// for the storages, but not for any web server. ForgetCapabilities clears it.
+	capabilityCache struct {
+		mutex   sync.Mutex
+		entries map[capabilityKey]*Capabilities
+	}
+
+	// capabilityKey identifies the capabilities of a host, as seen with a given identity,
+	// since a storage may advertise different methods depending on who asks
+	capabilityKey struct {
+		host, identity string
+	}
+)
+
+var discovered = &capabilityCache{entries: make(map[capabilityKey]*Capabilities)}
+
+// hostKey returns the key used to cache the capabilities of the resource
+func hostKey(resource string) (string, error) {
+	u, err := url.Parse(resource)
+	if err != nil {
+		return "", err
+	}
+	return u.Scheme + "://" + u.Host, nil
+}
+
+// clientIdentity returns the fingerprint of the certificate the client authenticates with,
+// or an empty string if it does not use any.
+// ok is false if it can not be told (i.e. the transport is not an http.Transport).
+func clientIdentity(client *http.Client) (identity string, ok bool) {
+	if client.Transport == nil {
+		return "", true
+	}
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok {
+		return "", false
+	}
+	config := transport.TLSClientConfig
+	if config == nil {
+		return "", true
+	}
+	if config.GetClientCertificate != nil {
+		return "", false
+	}
+	if len(config.Certificates) == 0 || len(config.Certificates[0].Certificate) == 0 {
+		return "", true
+	}
+	sum := sha256.Sum256(config.Certificates[0].Certificate[0])
+	return hex.EncodeToString(sum[:]), true
+}
+
+// splitHeader returns all the comma separated values of the header
+func splitHeader(header http.Header, name string) []string {
+	values := []string{}
+	for _, line := range header[http.CanonicalHeaderKey(name)] {
+		for _, value := range strings.Split(line, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}
+
+// contains returns true if the value is in the list, ignoring case
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// probe sends a request with the given method, following the redirects allowed by the policy
+func probe(ctx context.Context, client *http.Client, redirect *RedirectPolicy, method, resource string) (*http.Response, error) {
+	req, err := http.NewRequest(method, resource, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := redirect.Do(ctx, client, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+// DiscoverCapabilities probes the endpoint with OPTIONS (or HEAD if not allowed)
+// redirect decides which redirects are followed, as for the other requests sent to the
+// endpoint. If nil, the defaults are used.
+// The capabilities are cached per host and client certificate, so only the first call for
+// a given host and identity sends any request. The probed resource is assumed to be
+// representative of the host. Clients whose certificate can not be told are not cached.
+func DiscoverCapabilities(ctx context.Context, client *http.Client, redirect *RedirectPolicy, resource string) (*Capabilities, error) {
+	host, err := hostKey(resource)
+	if err != nil {
+		return nil, err
+	}
+	identity, cacheable := clientIdentity(client)
+	key := capabilityKey{host: host, identity: identity}
+
+	if cacheable {
+		discovered.mutex.Lock()
+		cached := discovered.entries[key]
+		discovered.mutex.Unlock()
+		if cached != nil {
+			return cached, nil
+		}
+	}
+
+	resp, err := probe(ctx, client, redirect, "OPTIONS", resource)
+	if err == nil && (resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented) {
+		logrus.Debug("OPTIONS not supported by ", resource, ", trying HEAD")
+		resp, err = probe(ctx, client, redirect, "HEAD", resource)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	caps := &Capabilities{
+		URL:    resource,
+		Server: resp.Header.Get("Server"),
+		DAV:    splitHeader(resp.Header, "DAV"),
+		Allow:  splitHeader(resp.Header, "Allow"),
+	}
+	if final := resp.Request.URL.String(); final != resource {
+		caps.Redirect = final
+	}
+
+	acceptPost := splitHeader(resp.Header, "Accept-Post")
+	switch {
+	case contains(acceptPost, "application/macaroon-request"):
+		caps.Macaroons = true
+	case len(caps.Allow) > 0:
+		caps.Macaroons = contains(caps.Allow, "POST")
+	default:
+		// Nothing advertised, can not tell
+		caps.Macaroons = true
+	}
+	caps.TPC = len(caps.Allow) == 0 || contains(caps.Allow, "COPY")
+
+	// An error (i.e. the resource does not exist yet) does not allow to conclude anything
+	if resp.StatusCode/100 != 2 {
+		caps.Macaroons = true
+		caps.TPC = true
+	}
+
+	logrus.Debugf("Capabilities of %s: %+v", host, caps)
+
+	// Only successful probes are cached, so a failed one is retried next time
+	if cacheable && resp.StatusCode/100 == 2 {
+		discovered.mutex.Lock()
+		discovered.entries[key] = caps
+		discovered.mutex.Unlock()
+	}
+	return caps, nil
+}
+
+// ForgetCapabilities removes all the cached capabilities
+// i.e. when a host serves resources with different capabilities, or its configuration changed
+func ForgetCapabilities() {
+	discovered.mutex.Lock()
+	defer discovered.mutex.Unlock()
+	discovered.entries = make(map[capabilityKey]*Capabilities)
+}
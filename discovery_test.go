@@ -0,0 +1,139 @@
+package http3rd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiscoverCapabilitiesRedirectPolicy(t *testing.T) {
+	ForgetCapabilities()
+	defer ForgetCapabilities()
+
+	disk := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", "OPTIONS, GET, PUT")
+	}))
+	defer disk.Close()
+	// Same address, but another host name, so the redirect leaves the host
+	diskURL := strings.Replace(disk.URL, "127.0.0.1", "localhost", 1)
+	head := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, diskURL+r.URL.Path, http.StatusTemporaryRedirect)
+	}))
+	defer head.Close()
+
+	_, err := DiscoverCapabilities(context.Background(), head.Client(), &RedirectPolicy{Credentials: SameHostOnly}, head.URL+"/file")
+	var refused *RedirectRefusedError
+	if !errors.As(err, &refused) {
+		t.Fatal("Expecting the redirect to be refused, got ", err)
+	}
+
+	caps, err := DiscoverCapabilities(context.Background(), head.Client(), nil, head.URL+"/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caps.Redirect != diskURL+"/file" {
+		t.Error("Expecting the probe to be redirected, got ", caps.Redirect)
+	}
+	if caps.TPC || caps.Macaroons {
+		t.Error("Expecting neither COPY nor POST, got ", caps)
+	}
+
+	// Cached per host, until forgotten
+	if cached, _ := DiscoverCapabilities(context.Background(), head.Client(), nil, head.URL+"/other"); cached != caps {
+		t.Error("Expecting the capabilities of the host to be cached")
+	}
+	ForgetCapabilities()
+	if fresh, _ := DiscoverCapabilities(context.Background(), head.Client(), nil, head.URL+"/other"); fresh == caps {
+		t.Error("Expecting the capabilities to be probed again")
+	}
+}
+
+func TestDiscoverCapabilitiesIdentity(t *testing.T) {
+	ForgetCapabilities()
+	defer ForgetCapabilities()
+
+	// POST is only advertised to the clients with a certificate
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) > 0 {
+			w.Header().Set("Allow", "OPTIONS, GET, POST, COPY")
+		} else {
+			w.Header().Set("Allow", "OPTIONS, GET, COPY")
+		}
+	}))
+	server.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	server.StartTLS()
+	defer server.Close()
+
+	creds, _, _ := newTestCredentials(t)
+	anonymous := server.Client()
+	transport := anonymous.Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = []tls.Certificate{creds.Certificate}
+	authenticated := &http.Client{Transport: transport}
+
+	for i := 0; i < 2; i++ {
+		caps, err := DiscoverCapabilities(context.Background(), anonymous, nil, server.URL+"/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if caps.Macaroons {
+			t.Error("Expecting no POST without certificate, got ", caps.Allow)
+		}
+		caps, err = DiscoverCapabilities(context.Background(), authenticated, nil, server.URL+"/file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !caps.Macaroons {
+			t.Error("Expecting POST with a certificate, got ", caps.Allow)
+		}
+	}
+	if len(discovered.entries) != 2 {
+		t.Error("Expecting an entry per identity, got ", len(discovered.entries))
+	}
+}
+
+func TestTokenWithoutPost(t *testing.T) {
+	ForgetCapabilities()
+	defer ForgetCapabilities()
+
+	// POST is not advertised, but macaroons are issued anyway
+	macaroons := &macaroonRequests{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "OPTIONS":
+			w.Header().Set("Allow", "OPTIONS, GET, PUT, COPY")
+		case "POST":
+			macaroons.ServeHTTP(w, r)
+		}
+	}))
+	defer server.Close()
+
+	endpoint, err := newCopyEndpoint(&Params{CAPath: t.TempDir()}, nil, server.URL+"/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token, err := endpoint.token(context.Background(), time.Hour, []string{Download}); err != nil || token == "" {
+		t.Error("Expecting a macaroon to be requested anyway, got ", err)
+	}
+
+	// And really not issued
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", "OPTIONS, GET, PUT, COPY")
+		if r.Method != "OPTIONS" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer rejecting.Close()
+
+	endpoint, err = newCopyEndpoint(&Params{CAPath: t.TempDir()}, nil, rejecting.URL+"/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = endpoint.token(context.Background(), time.Hour, []string{Download}); !errors.Is(err, ErrNoMacaroonSupport) {
+		t.Error("Expecting ErrNoMacaroonSupport, got ", err)
+	}
+}
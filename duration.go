@@ -0,0 +1,60 @@
+package http3rd
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// iso8601DurationRegex matches the subset of ISO8601 durations that have a fixed length
+// (weeks, days, hours, minutes and seconds). Years and months are ambiguous, so they are rejected.
+var iso8601DurationRegex = regexp.MustCompile(`^P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:[.,]\d+)?)S)?)?$`)
+
+// FormatISO8601Duration returns the ISO8601 representation of the duration (i.e. PT5M)
+// Only hours, minutes and seconds are used, as dCache expects.
+func FormatISO8601Duration(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+
+	var builder strings.Builder
+	builder.WriteString("PT")
+	if hours := d / time.Hour; hours > 0 {
+		fmt.Fprintf(&builder, "%dH", hours)
+		d -= hours * time.Hour
+	}
+	if minutes := d / time.Minute; minutes > 0 {
+		fmt.Fprintf(&builder, "%dM", minutes)
+		d -= minutes * time.Minute
+	}
+	if d > 0 || builder.Len() == 2 {
+		builder.WriteString(strconv.FormatFloat(d.Seconds(), 'f', -1, 64))
+		builder.WriteString("S")
+	}
+	return builder.String()
+}
+
+// ParseISO8601Duration parses an ISO8601 duration (i.e. PT5M, P1DT12H)
+func ParseISO8601Duration(value string) (time.Duration, error) {
+	upper := strings.ToUpper(value)
+	match := iso8601DurationRegex.FindStringSubmatch(upper)
+	if match == nil || upper == "P" || strings.HasSuffix(upper, "T") {
+		return 0, fmt.Errorf("Invalid or unsupported ISO8601 duration: %s", value)
+	}
+
+	units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+	var total time.Duration
+	for i, unit := range units {
+		if match[i+1] == "" {
+			continue
+		}
+		number, err := strconv.ParseFloat(strings.Replace(match[i+1], ",", ".", 1), 64)
+		if err != nil {
+			return 0, err
+		}
+		total += time.Duration(number * float64(unit))
+	}
+	return total, nil
+}
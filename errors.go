@@ -0,0 +1,195 @@
+package http3rd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxMessageLength limits how much of a text body is used as the server message
+const maxMessageLength = 256
+
+type (
+	// HTTPError holds the details of an unexpected HTTP response
+	HTTPError struct {
+		URL        string
+		StatusCode int
+		// Message sent by the server, extracted from the body
+		Message string
+		// Body is the raw response body
+		Body []byte
+		// Parsed is the body, if it was a JSON object
+		Parsed map[string]interface{}
+		// RetryAfter is how long the server asked to wait before retrying, if it did
+		RetryAfter time.Duration
+	}
+
+	// TokenRequestError is returned when the server refuses to issue a token
+	TokenRequestError struct {
+		HTTPError
+		// Err is the underlying cause, if known (i.e. ErrNoMacaroonSupport)
+		Err error
+	}
+
+	// CopyRejectedError is returned when the COPY request is refused by the active endpoint
+	CopyRejectedError struct {
+		HTTPError
+		// DelegateTo are the delegation services advertised with X-Delegate-To, if any
+		DelegateTo []string
+	}
+
+	// DelegationError is returned when the delegation service fails
+	DelegationError struct {
+		HTTPError
+		// Fault is the SOAP fault message, if any
+		Fault string
+	}
+
+	// TransferFailedError is returned when the COPY has been accepted, but the transfer
+	// failed afterwards (as reported in the response body)
+	TransferFailedError struct {
+		URL     string
+		Message string
+		// LastMarker is the last performance marker received before the failure, if any
+		LastMarker *PerfMarker
+		// Incomplete is true if the response ended without a final success or failure line
+		Incomplete bool
+		// Err is the underlying cause, if the response could not be read until the end
+		Err error
+	}
+
+	// RedirectLoopError is returned when a redirection loops back, or too many are followed
+	RedirectLoopError struct {
+		URL string
+		// Visited are the URLs followed, in order
+		Visited []string
+		// Loop is true if an URL has been visited twice, false if the limit has been reached
+		Loop bool
+	}
+
+	// CertificateRevokedError is returned when the certificate of the server has been revoked
+	CertificateRevokedError struct {
+		Subject string
+		Serial  string
+		// RevokedAt is when the certificate was revoked
+		RevokedAt time.Time
+		// Source is where the revocation was found (CRL or OCSP)
+		Source string
+	}
+
+	// RedirectRefusedError is returned when the redirect policy does not allow to follow a redirect
+	RedirectRefusedError struct {
+		URL string
+		// Location is where the server redirected to
+		Location string
+	}
+)
+
+// newHTTPError builds an HTTPError, extracting the server message from the body
+func newHTTPError(url string, resp *http.Response, body []byte) HTTPError {
+	statusCode := resp.StatusCode
+	httpErr := HTTPError{
+		URL:        url,
+		StatusCode: statusCode,
+		Body:       body,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+
+	parsed := make(map[string]interface{})
+	if json.Unmarshal(body, &parsed) == nil {
+		httpErr.Parsed = parsed
+		for _, key := range []string{"message", "error_description", "error", "msg"} {
+			if message, ok := parsed[key].(string); ok && message != "" {
+				httpErr.Message = message
+				break
+			}
+		}
+	} else {
+		for _, line := range strings.Split(string(body), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				httpErr.Message = line
+				break
+			}
+		}
+		if len(httpErr.Message) > maxMessageLength {
+			httpErr.Message = httpErr.Message[:maxMessageLength] + "..."
+		}
+	}
+
+	if httpErr.Message == "" {
+		httpErr.Message = http.StatusText(statusCode)
+	}
+	return httpErr
+}
+
+// Unauthorized returns true if the failure is due to the credentials or the token (401 or 403)
+func (e *HTTPError) Unauthorized() bool {
+	return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+}
+
+// NotFound returns true if the resource does not exist
+func (e *HTTPError) NotFound() bool {
+	return e.StatusCode == http.StatusNotFound
+}
+
+// Error implements error
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("%s replied with status code %d: %s", e.URL, e.StatusCode, e.Message)
+}
+
+// Error implements error
+func (e *TokenRequestError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("Token request failed: %s: %s (status code %d)", e.URL, e.Err, e.StatusCode)
+	}
+	return "Token request failed: " + e.HTTPError.Error()
+}
+
+// Unwrap returns the underlying cause
+func (e *TokenRequestError) Unwrap() error {
+	return e.Err
+}
+
+// Error implements error
+func (e *CopyRejectedError) Error() string {
+	return "COPY rejected: " + e.HTTPError.Error()
+}
+
+// Error implements error
+func (e *DelegationError) Error() string {
+	if e.Fault != "" {
+		return fmt.Sprintf("Delegation failed: %s: %s", e.URL, e.Fault)
+	}
+	return "Delegation failed: " + e.HTTPError.Error()
+}
+
+// Error implements error
+func (e *TransferFailedError) Error() string {
+	return fmt.Sprintf("Transfer failed: %s: %s", e.URL, e.Message)
+}
+
+// Unwrap returns the underlying cause
+func (e *TransferFailedError) Unwrap() error {
+	return e.Err
+}
+
+// Error implements error
+func (e *RedirectLoopError) Error() string {
+	if e.Loop {
+		return fmt.Sprintf("Redirect loop starting at %s: %s", e.URL, e.Visited[len(e.Visited)-1])
+	}
+	return fmt.Sprintf("Stopped after %d redirects starting at %s", len(e.Visited), e.URL)
+}
+
+// Error implements error
+func (e *RedirectRefusedError) Error() string {
+	return fmt.Sprintf("Refusing to follow the redirect from %s to another host: %s", e.URL, e.Location)
+}
+
+// Error implements error
+func (e *CertificateRevokedError) Error() string {
+	return fmt.Sprintf("The certificate %s (serial %s) was revoked on %s, according to the %s",
+		e.Subject, e.Serial, e.RevokedAt.Format(time.RFC3339), e.Source)
+}
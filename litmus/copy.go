@@ -1,14 +1,30 @@
 package main
 
 import (
+	"context"
 	"github.com/ayllon/http3rd"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 )
 
 var (
-	copyLifetime = 5 * time.Minute
+	copyLifetime         = 5 * time.Minute
+	copyMode             = "push"
+	copyNoProgress       bool
+	copyProgressInterval = 30 * time.Second
+	copySource           = endpointFlags{prefix: "src", name: "source", oauth2: &copyOAuth2}
+	copyDestination      = endpointFlags{prefix: "dst", name: "destination", oauth2: &copyOAuth2}
+	copyOAuth2           = oauth2Flags{}
+	copyTokenCache       bool
+	copyTokenCacheFile   string
+	copyTokenCacheDir    bool
+	copyMacaroonExpiry   = "auto"
+	copyNoDiscovery      bool
+	copyCredential       = "token"
 )
 
 var copyCmd = &cobra.Command{
@@ -17,15 +33,70 @@ var copyCmd = &cobra.Command{
 		if len(args) != 2 {
 			logrus.Fatal("Expecting two arguments")
 		}
-		e := http3rd.DoHTTP3rdCopy(&params, copyLifetime, args[0], args[1])
+		var e error
+		params.Mode, e = http3rd.ParseCopyMode(copyMode)
 		if e != nil {
 			logrus.Fatal(e)
 		}
+		params.MacaroonExpiry, e = http3rd.ParseExpiryMode(copyMacaroonExpiry)
+		if e != nil {
+			logrus.Fatal(e)
+		}
+		params.Credential, e = http3rd.ParseCredentialMode(copyCredential)
+		if e != nil {
+			logrus.Fatal(e)
+		}
+		params.NoDiscovery = copyNoDiscovery
+		params.Source = copySource.apply(cmd.Flags(), &params)
+		params.Destination = copyDestination.apply(cmd.Flags(), &params)
+
+		if copyTokenCache || copyTokenCacheFile != "" {
+			params.TokenCache = &http3rd.TokenCache{
+				Directory: copyTokenCacheDir,
+			}
+			if copyTokenCacheFile != "" {
+				params.TokenCache.Store = &http3rd.FileTokenStore{Path: copyTokenCacheFile}
+			}
+		}
+
+		var display *progressDisplay
+		if !copyNoProgress {
+			display = newProgressDisplay(copyProgressInterval)
+			params.Progress = display.Update
+		}
+
+		// Abort the copy on SIGINT or SIGTERM
+		ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer cancel()
+
+		e = http3rd.DoHTTP3rdCopyContext(ctx, &params, copyLifetime, args[0], args[1])
+		if display != nil {
+			display.Stop()
+		}
+		if e != nil && ctx.Err() != nil {
+			logrus.Fatal("Copy cancelled")
+		} else if e != nil {
+			logrus.Fatal(e)
+		}
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(copyCmd)
 	flags := copyCmd.Flags()
-	flags.DurationVar(&copyLifetime, "lifetime", 5*time.Minute, "Duration of the bearer token")
+	flags.DurationVar(&copyLifetime, "lifetime", 5*time.Minute, "Duration of the bearer token, or of the delegated proxy")
+	flags.StringVar(&copyMode, "mode", "push", "Copy mode: push (COPY sent to the source) or pull (COPY sent to the destination)")
+	flags.BoolVar(&copyNoProgress, "no-progress", false, "Do not display the transfer progress")
+	flags.DurationVar(&copyProgressInterval, "progress-interval", 30*time.Second, "Interval between progress log lines when the output is not a terminal")
+	flags.StringVar(&copyMacaroonExpiry, "macaroon-expiry", "auto", "How to request the lifetime of the macaroons: auto, before (caveat) or validity (server side)")
+	flags.StringVar(&copyCredential, "credential", "token", "How the active endpoint accesses the passive one: token, or gridsite (delegated proxy)")
+	flags.StringVar(&params.DelegationEndpoint, "delegation-endpoint", "", "GridSite delegation service of the active endpoint (advertised by the endpoint if not set)")
+	flags.BoolVar(&copyNoDiscovery, "no-discovery", false, "Do not probe the endpoints capabilities before the copy")
+	flags.BoolVar(&params.NoOverwrite, "no-overwrite", false, "Fail if the destination already exists")
+	copySource.register(flags)
+	copyDestination.register(flags)
+	copyOAuth2.register(flags)
+	flags.BoolVar(&copyTokenCache, "token-cache", false, "Reuse tokens while they are valid")
+	flags.StringVar(&copyTokenCacheFile, "token-cache-file", "", "Keep the reusable tokens in this file, so they are shared between runs (implies --token-cache)")
+	flags.BoolVar(&copyTokenCacheDir, "token-cache-dir", false, "Request the tokens for the parent directory, so they can be reused for other files in it")
 }
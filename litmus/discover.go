@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/ayllon/http3rd"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"strings"
+)
+
+var discoverCmd = &cobra.Command{
+	Use:   "discover <url>",
+	Short: "Probe the capabilities of an endpoint",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			cmd.Usage()
+			return
+		}
+
+		x509client, e := http3rd.BuildHttpClient(&params)
+		if e != nil {
+			logrus.Fatal(e)
+		}
+
+		caps, e := http3rd.DiscoverCapabilities(context.Background(), x509client, params.Redirect, args[0])
+		if e != nil {
+			logrus.Fatal(e)
+		}
+
+		fmt.Printf("URL:       %s\n", caps.URL)
+		if caps.Redirect != "" {
+			fmt.Printf("Redirect:  %s\n", caps.Redirect)
+		}
+		fmt.Printf("Server:    %s\n", caps.Server)
+		fmt.Printf("DAV:       %s\n", strings.Join(caps.DAV, ", "))
+		fmt.Printf("Allow:     %s\n", strings.Join(caps.Allow, ", "))
+		fmt.Printf("Macaroons: %t\n", caps.Macaroons)
+		fmt.Printf("TPC:       %t\n", caps.TPC)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(discoverCmd)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"github.com/ayllon/http3rd"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"io/ioutil"
+	"strings"
+)
+
+// endpointFlags holds the command line overrides for one of the endpoints
+type endpointFlags struct {
+	prefix, name      string
+	cert, key, capath string
+	token, tokenFile  string
+	tokenCmd          string
+	insecure          bool
+	useToken          bool
+	jwt               bool
+	jwtBasePath       string
+	macaroonExpiry    string
+	delegation        string
+	// oauth2 configures the issuer of the JWTs
+	oauth2 *oauth2Flags
+}
+
+// oauth2Flags holds the configuration of the OAuth2 issuer
+type oauth2Flags struct {
+	issuer, tokenEndpoint string
+	clientID              string
+	clientSecretFile      string
+	grant                 string
+	subjectTokenFile      string
+	audience              string
+}
+
+// register adds the endpoint specific flags to the flag set
+func (f *endpointFlags) register(flags *pflag.FlagSet) {
+	flags.StringVar(&f.cert, f.prefix+"-cert", "", "User certificate for the "+f.name)
+	flags.StringVar(&f.key, f.prefix+"-key", "", "User private key for the "+f.name)
+	flags.StringVar(&f.capath, f.prefix+"-capath", "", "CA Path for the "+f.name)
+	flags.BoolVar(&f.insecure, f.prefix+"-insecure", false, "Do not verify the certificate of the "+f.name)
+	flags.StringVar(&f.token, f.prefix+"-token", "", "Pre-issued token for the "+f.name)
+	flags.StringVar(&f.tokenFile, f.prefix+"-token-file", "", "File containing a pre-issued token for the "+f.name)
+	flags.StringVar(&f.tokenCmd, f.prefix+"-token-cmd", "", "Command that prints a token for the "+f.name)
+	flags.BoolVar(&f.useToken, f.prefix+"-use-token", false, "Authenticate with a token with the "+f.name+" even when it receives the COPY")
+	flags.StringVar(&f.macaroonExpiry, f.prefix+"-macaroon-expiry", "", "How to request the lifetime of the macaroons of the "+f.name+": auto, before or validity")
+	flags.StringVar(&f.delegation, f.prefix+"-delegation-endpoint", "", "GridSite delegation service of the "+f.name)
+	flags.BoolVar(&f.jwt, f.prefix+"-jwt", false, "Get JWTs for the "+f.name+" from the OAuth2 issuer")
+	flags.StringVar(&f.jwtBasePath, f.prefix+"-jwt-base-path", "", "Path of the "+f.name+" the storage scopes are relative to")
+}
+
+// register adds the issuer flags to the flag set
+func (o *oauth2Flags) register(flags *pflag.FlagSet) {
+	flags.StringVar(&o.issuer, "oauth-issuer", "", "OAuth2 issuer for JWT tokens")
+	flags.StringVar(&o.tokenEndpoint, "oauth-token-endpoint", "", "OAuth2 token endpoint (discovered from the issuer if not set)")
+	flags.StringVar(&o.clientID, "oauth-client-id", "", "OAuth2 client ID")
+	flags.StringVar(&o.clientSecretFile, "oauth-client-secret-file", "", "File containing the OAuth2 client secret")
+	flags.StringVar(&o.grant, "oauth-grant", "client_credentials", "OAuth2 grant: client_credentials or token_exchange")
+	flags.StringVar(&o.subjectTokenFile, "oauth-subject-token-file", "", "File containing the token to exchange")
+	flags.StringVar(&o.audience, "oauth-audience", "", "Audience of the tokens (defaults to the storage endpoint)")
+}
+
+// provider returns an OAuth2 provider configured from the flags
+func (o *oauth2Flags) provider(basePath string) (*http3rd.OAuth2Provider, error) {
+	grant, e := http3rd.ParseOAuth2Grant(o.grant)
+	if e != nil {
+		return nil, e
+	}
+
+	provider := &http3rd.OAuth2Provider{
+		Issuer:        o.issuer,
+		TokenEndpoint: o.tokenEndpoint,
+		ClientID:      o.clientID,
+		Grant:         grant,
+		Audience:      o.audience,
+		BasePath:      basePath,
+	}
+	if o.clientSecretFile != "" {
+		secret, e := ioutil.ReadFile(o.clientSecretFile)
+		if e != nil {
+			return nil, e
+		}
+		provider.ClientSecret = strings.TrimSpace(string(secret))
+	}
+	if o.subjectTokenFile != "" {
+		provider.SubjectToken = &http3rd.FileToken{Path: o.subjectTokenFile}
+	}
+	return provider, nil
+}
+
+// apply returns the parameters for the endpoint, which are the global ones plus the overrides
+// Returns nil if there are no overrides
+func (f *endpointFlags) apply(flags *pflag.FlagSet, global *http3rd.Params) *http3rd.Params {
+	changed := false
+	flags.Visit(func(flag *pflag.Flag) {
+		if strings.HasPrefix(flag.Name, f.prefix+"-") {
+			changed = true
+		}
+	})
+	if !changed {
+		return nil
+	}
+
+	endpoint := &http3rd.Params{
+		UserCert:           global.UserCert,
+		UserKey:            global.UserKey,
+		CAPath:             global.CAPath,
+		Insecure:           global.Insecure || f.insecure,
+		Revocation:         global.Revocation,
+		OCSPStapling:       global.OCSPStapling,
+		UseToken:           f.useToken,
+		MacaroonExpiry:     global.MacaroonExpiry,
+		DelegationEndpoint: global.DelegationEndpoint,
+	}
+
+	var e error
+	if f.macaroonExpiry != "" {
+		if endpoint.MacaroonExpiry, e = http3rd.ParseExpiryMode(f.macaroonExpiry); e != nil {
+			logrus.Fatal(e)
+		}
+	}
+	endpoint.TokenProvider, e = f.tokenProvider()
+	if e != nil {
+		logrus.Fatal(e)
+	}
+	if f.cert != "" {
+		endpoint.UserCert = f.cert
+		endpoint.UserKey = f.key
+		if endpoint.UserKey == "" {
+			endpoint.UserKey = f.cert
+		}
+	}
+	if f.capath != "" {
+		endpoint.CAPath = f.capath
+	}
+	if f.delegation != "" {
+		endpoint.DelegationEndpoint = f.delegation
+	}
+	return endpoint
+}
+
+// tokenProvider returns the token provider matching the set option
+// Returns nil if none is set, so macaroons are used
+func (f *endpointFlags) tokenProvider() (http3rd.TokenProvider, error) {
+	set := 0
+	var provider http3rd.TokenProvider
+	if f.token != "" {
+		provider = http3rd.StaticToken(f.token)
+		set++
+	}
+	if f.tokenFile != "" {
+		provider = &http3rd.FileToken{Path: f.tokenFile}
+		set++
+	}
+	if f.tokenCmd != "" {
+		// No shell is involved, the command line is just split on spaces
+		cmdline := strings.Fields(f.tokenCmd)
+		if len(cmdline) == 0 {
+			return nil, errors.New("The token command is empty")
+		}
+		provider = &http3rd.CommandToken{Command: cmdline[0], Args: cmdline[1:]}
+		set++
+	}
+	if f.jwt {
+		oauth2Provider, e := f.oauth2.provider(f.jwtBasePath)
+		if e != nil {
+			return nil, e
+		}
+		provider = oauth2Provider
+		set++
+	}
+	if set > 1 {
+		return nil, errors.New("Only one of token, token file, token command or JWT can be used")
+	}
+	return provider, nil
+}
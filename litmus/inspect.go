@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ayllon/http3rd"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	inspectFile string
+	inspectJSON bool
+)
+
+// macaroonInspection is what the inspect command prints
+type macaroonInspection struct {
+	Location   string   `json:"location"`
+	Identifier string   `json:"identifier"`
+	Caveats    []string `json:"caveats"`
+	// Activities is null if unrestricted
+	Activities []string   `json:"activities"`
+	Paths      []string   `json:"paths,omitempty"`
+	Expiry     *time.Time `json:"expiry,omitempty"`
+	// Remaining is in seconds, negative if expired
+	Remaining *float64 `json:"remaining,omitempty"`
+	Expired   bool     `json:"expired"`
+	Conflicts []string `json:"conflicts"`
+}
+
+// readMacaroon gets the serialized macaroon from the argument, the file, or the standard input
+func readMacaroon(args []string) (string, error) {
+	var reader io.Reader
+	switch {
+	case inspectFile != "" && len(args) > 0:
+		return "", errors.New("Pass either a macaroon or a file, not both")
+	case inspectFile != "":
+		f, e := os.Open(inspectFile)
+		if e != nil {
+			return "", e
+		}
+		defer f.Close()
+		reader = f
+	case len(args) == 0 || args[0] == "-":
+		reader = os.Stdin
+	default:
+		return args[0], nil
+	}
+
+	content, e := ioutil.ReadAll(reader)
+	if e != nil {
+		return "", e
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// inspectMacaroon decodes and summarizes the macaroon
+func inspectMacaroon(serialized string) (*macaroonInspection, error) {
+	M, e := http3rd.DecodeMacaroon(serialized)
+	if e != nil {
+		return nil, e
+	}
+
+	inspection := &macaroonInspection{
+		Location:   M.Location(),
+		Identifier: M.Id(),
+		Caveats:    M.RawCaveats(),
+		Activities: M.Activities(),
+		Paths:      M.Paths(),
+		Conflicts:  M.Conflicts(),
+	}
+	if expiry, ok := M.Expiry(); ok {
+		remaining := time.Until(expiry).Seconds()
+		inspection.Expiry = &expiry
+		inspection.Remaining = &remaining
+		inspection.Expired = remaining <= 0
+	}
+	return inspection, nil
+}
+
+// printInspection writes the human readable representation
+func printInspection(out io.Writer, inspection *macaroonInspection) {
+	fmt.Fprintf(out, "Location:   %s\n", inspection.Location)
+	fmt.Fprintf(out, "Identifier: %s\n", inspection.Identifier)
+	fmt.Fprintf(out, "Caveats:\n")
+	for _, caveat := range inspection.Caveats {
+		fmt.Fprintf(out, "\t%s\n", caveat)
+	}
+
+	if inspection.Activities == nil {
+		fmt.Fprintf(out, "Activities: unrestricted\n")
+	} else if len(inspection.Activities) == 0 {
+		fmt.Fprintf(out, "Activities: none\n")
+	} else {
+		fmt.Fprintf(out, "Activities: %s\n", strings.Join(inspection.Activities, ", "))
+	}
+	if len(inspection.Paths) > 0 {
+		fmt.Fprintf(out, "Paths:      %s\n", strings.Join(inspection.Paths, ", "))
+	}
+
+	if inspection.Expiry == nil {
+		fmt.Fprintf(out, "Expiry:     never\n")
+	} else {
+		remaining := time.Duration(*inspection.Remaining * float64(time.Second)).Truncate(time.Second)
+		if inspection.Expired {
+			fmt.Fprintf(out, "Expiry:     %s (expired %s ago)\n", inspection.Expiry.Format(time.RFC3339), -remaining)
+		} else {
+			fmt.Fprintf(out, "Expiry:     %s (%s left)\n", inspection.Expiry.Format(time.RFC3339), remaining)
+		}
+	}
+
+	if len(inspection.Conflicts) == 0 {
+		fmt.Fprintf(out, "Conflicts:  none\n")
+	} else {
+		fmt.Fprintf(out, "Conflicts:\n")
+		for _, conflict := range inspection.Conflicts {
+			fmt.Fprintf(out, "\t%s\n", conflict)
+		}
+	}
+}
+
+var macaroonInspectCmd = &cobra.Command{
+	Use:   "inspect [<macaroon> | -]",
+	Short: "Decode and print a macaroon",
+	// Credentials are not needed to decode a macaroon
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if debug {
+			logrus.SetLevel(logrus.DebugLevel)
+		}
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		serialized, e := readMacaroon(args)
+		if e != nil {
+			logrus.Fatal(e)
+		}
+		inspection, e := inspectMacaroon(serialized)
+		if e != nil {
+			logrus.Fatal(e)
+		}
+
+		if inspectJSON {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if e = encoder.Encode(inspection); e != nil {
+				logrus.Fatal(e)
+			}
+		} else {
+			printInspection(os.Stdout, inspection)
+		}
+	},
+}
+
+func init() {
+	macaroonCmd.AddCommand(macaroonInspectCmd)
+	flags := macaroonInspectCmd.Flags()
+	flags.StringVar(&inspectFile, "file", "", "Read the macaroon from this file")
+	flags.BoolVar(&inspectJSON, "json", false, "Print in JSON format")
+}
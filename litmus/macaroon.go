@@ -9,8 +9,37 @@ import (
 
 var (
 	macaroonLifetime = time.Minute
+	macaroonBefore   string
+	macaroonPath     string
+	macaroonIPs      []string
+	macaroonCaveats  []string
+	macaroonExpiry   = "auto"
 )
 
+// buildCaveats returns the additional caveats requested with the command line flags
+func buildCaveats() ([]http3rd.Caveat, error) {
+	caveats := []http3rd.Caveat{}
+	if macaroonPath != "" {
+		caveats = append(caveats, http3rd.PathCaveat(macaroonPath))
+	}
+	if len(macaroonIPs) > 0 {
+		caveats = append(caveats, http3rd.IPCaveat(macaroonIPs...))
+	}
+	for _, serialized := range macaroonCaveats {
+		caveat, e := http3rd.ParseCaveat(serialized)
+		if e != nil {
+			return nil, e
+		}
+		caveats = append(caveats, caveat)
+	}
+	for _, caveat := range caveats {
+		if e := caveat.Validate(); e != nil {
+			return nil, e
+		}
+	}
+	return caveats, nil
+}
+
 var macaroonCmd = &cobra.Command{
 	Use: "macaroon <url> <activity1> [<activity2> [<activity3>]]",
 	Run: func(cmd *cobra.Command, args []string) {
@@ -29,6 +58,18 @@ var macaroonCmd = &cobra.Command{
 			Resource:   args[0],
 			Activities: args[1:],
 			Lifetime:   macaroonLifetime,
+			Retry:      params.Retry,
+		}
+		if req.Caveats, e = buildCaveats(); e != nil {
+			logrus.Fatal(e)
+		}
+		if req.Expiry, e = http3rd.ParseExpiryMode(macaroonExpiry); e != nil {
+			logrus.Fatal(e)
+		}
+		if macaroonBefore != "" {
+			if req.Before, e = time.Parse(time.RFC3339, macaroonBefore); e != nil {
+				logrus.Fatal(e)
+			}
 		}
 		m, e := http3rd.GetMacaroon(x509client, req)
 		if e != nil {
@@ -44,4 +85,9 @@ func init() {
 	rootCmd.AddCommand(macaroonCmd)
 	flags := macaroonCmd.Flags()
 	flags.DurationVar(&macaroonLifetime, "lifetime", time.Minute, "Macaroon lifetime")
+	flags.StringVar(&macaroonBefore, "before", "", "Absolute expiration time (RFC3339), overrides the lifetime")
+	flags.StringVar(&macaroonExpiry, "expiry", "auto", "How to request the lifetime: auto, before (caveat) or validity (server side)")
+	flags.StringVar(&macaroonPath, "path", "", "Restrict the macaroon to this path")
+	flags.StringSliceVar(&macaroonIPs, "ip", nil, "Restrict the macaroon to these client addresses or networks (CIDR)")
+	flags.StringArrayVar(&macaroonCaveats, "caveat", nil, "Additional key:value caveat (can be repeated)")
 }
@@ -5,11 +5,22 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"gitlab.cern.ch/flutter/go-proxy"
+	"os"
+	"time"
 )
 
 var (
 	debug  bool
 	params http3rd.Params
+
+	retryAttempts    int
+	retryBackoff     time.Duration
+	retryMaxBackoff  time.Duration
+	retryPartialCopy bool
+	maxRedirects     int
+	redirectCreds    = "strip"
+	redirectTrusted  []string
+	revocation       = "none"
 )
 
 // Return the user certificate and private key to use
@@ -28,12 +39,52 @@ func setupUserCredentials(params *http3rd.Params) {
 	}
 }
 
+// setupRetryPolicy builds the retry policy from the command line flags
+func setupRetryPolicy(params *http3rd.Params) {
+	if retryAttempts <= 1 {
+		return
+	}
+	params.Retry = http3rd.DefaultRetryPolicy()
+	params.Retry.MaxAttempts = retryAttempts
+	params.Retry.InitialBackoff = retryBackoff
+	params.Retry.MaxBackoff = retryMaxBackoff
+	params.Retry.RetryPartialCopy = retryPartialCopy
+}
+
+// setupRevocation sets the revocation checks from the command line flags
+func setupRevocation(params *http3rd.Params) {
+	var e error
+	if params.Revocation, e = http3rd.ParseRevocationMode(revocation); e != nil {
+		logrus.Fatal(e)
+	}
+}
+
+// setupRedirectPolicy builds the redirect policy from the command line flags
+func setupRedirectPolicy(params *http3rd.Params) {
+	credentials, e := http3rd.ParseRedirectCredentials(redirectCreds)
+	if e != nil {
+		logrus.Fatal(e)
+	}
+	params.Redirect = &http3rd.RedirectPolicy{
+		MaxRedirects:   maxRedirects,
+		Credentials:    credentials,
+		TrustedDomains: redirectTrusted,
+	}
+}
+
 var rootCmd = &cobra.Command{
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
 		if debug {
 			logrus.SetLevel(logrus.DebugLevel)
 		}
-		setupUserCredentials(&params)
+		if mock {
+			startMock(&params)
+		} else {
+			setupUserCredentials(&params)
+		}
+		setupRevocation(&params)
+		setupRetryPolicy(&params)
+		setupRedirectPolicy(&params)
 	},
 	Run: func(cmd *cobra.Command, args []string) {
 		cmd.Usage()
@@ -42,6 +93,15 @@ var rootCmd = &cobra.Command{
 
 var testCmd = &cobra.Command{
 	Use: "test",
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {
+		stopMock()
+		if e := writeReports(); e != nil {
+			logrus.Fatal(e)
+		}
+		if testsFailed {
+			os.Exit(1)
+		}
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		cmd.Usage()
 	},
@@ -54,7 +114,20 @@ func init() {
 	flags.StringVar(&params.UserCert, "cert", "", "User certificate")
 	flags.StringVar(&params.UserKey, "key", "", "User private key")
 	flags.BoolVar(&params.Insecure, "insecure", false, "Do not verify the remote certificate")
+	flags.StringVar(&revocation, "revocation", "none", "Check the revocation of the server certificates with the CRLs of the CA path: none, soft (fail only if revoked) or hard (fail also if unknown)")
+	flags.BoolVar(&params.OCSPStapling, "ocsp-stapling", false, "Check the server certificate with the stapled OCSP response, if sent")
+	flags.IntVar(&maxRedirects, "max-redirects", http3rd.DefaultMaxRedirects, "Maximum number of redirects followed")
+	flags.StringVar(&redirectCreds, "redirect-credentials", "strip", "On redirects to another host: strip the tokens, refuse (same-host) or keep them")
+	flags.StringSliceVar(&redirectTrusted, "redirect-trust", nil, "Domains trusted with the tokens on redirects (i.e. the disk nodes)")
+	flags.IntVar(&retryAttempts, "retries", 1, "Attempts for token requests and COPY submissions on transient failures")
+	flags.DurationVar(&retryBackoff, "retry-backoff", time.Second, "Wait before the first retry, doubled afterwards")
+	flags.DurationVar(&retryMaxBackoff, "retry-max-backoff", time.Minute, "Maximum wait between retries")
+	flags.BoolVar(&retryPartialCopy, "retry-partial-copy", false, "Re-issue a COPY that failed after being accepted")
 
+	testFlags := testCmd.PersistentFlags()
+	testFlags.BoolVar(&mock, "mock", false, "Run the tests against an in-process mock storage")
+	testFlags.StringVar(&junitReport, "junit", "", "Write the results as JUnit XML into this file")
+	testFlags.StringVar(&jsonReport, "json", "", "Write the results as JSON into this file")
 	rootCmd.AddCommand(testCmd)
 }
 
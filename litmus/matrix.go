@@ -0,0 +1,722 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ayllon/http3rd"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Capabilities a site can be expected to have
+const (
+	capabilityMacaroons = "macaroons"
+	capabilityTokens    = "tokens"
+	capabilityTPC       = "tpc"
+)
+
+// Matrix cells that are not the status of a test
+const (
+	// statusTimeout is a test that did not finish before the site timed out
+	statusTimeout = "timeout"
+	// statusNotApplicable is a test of a suite the site is not expected to support
+	statusNotApplicable = "n/a"
+	// statusNotRun is a test that has not been run for the site (i.e. filtered out)
+	statusNotRun = "-"
+)
+
+// Reports of the matrix that do not come from a suite
+const (
+	// capabilitiesSuite has the capability checks
+	capabilitiesSuite = "Capabilities"
+	// timeoutSuite is added when a site times out
+	timeoutSuite = "Timeout"
+)
+
+var (
+	matrixHTML     string
+	matrixMarkdown string
+)
+
+type (
+	// matrixConfig is the configuration file of the matrix
+	matrixConfig struct {
+		// Timeout of each site (i.e. 30m)
+		Timeout string `json:"timeout"`
+		// Concurrency is how many sites are tested at the same time
+		Concurrency int `json:"concurrency"`
+		// Filter selects the tests to run, as --filter
+		Filter string `json:"filter"`
+		// LargeSize is the size, in bytes, of the file used by the copy TestLargeFile
+		LargeSize int64         `json:"large-size"`
+		Sites     []*matrixSite `json:"sites"`
+
+		timeout time.Duration
+	}
+
+	// matrixSite is one of the endpoints of the matrix
+	// The credentials default to the ones given on the command line.
+	matrixSite struct {
+		Name string `json:"name"`
+		// URL is the base URL for the tests
+		URL string `json:"url"`
+		// Peer is the base URL the copy tests copy into. Defaults to URL.
+		Peer     string `json:"peer"`
+		Cert     string `json:"cert"`
+		Key      string `json:"key"`
+		CAPath   string `json:"capath"`
+		Insecure bool   `json:"insecure"`
+		// Capabilities the site is expected to have (macaroons, tokens, tpc). Only the suites
+		// that need them are run.
+		Capabilities []string `json:"capabilities"`
+		// Timeout overrides the one of the configuration
+		Timeout string `json:"timeout"`
+		// Token, TokenFile, TokenCmd and JWT select where the tokens of the TokenTestSuite
+		// come from, as the options of "test token". Macaroons are requested if none is set.
+		Token       string              `json:"token"`
+		TokenFile   string              `json:"token-file"`
+		TokenCmd    string              `json:"token-cmd"`
+		JWT         bool                `json:"jwt"`
+		JWTBasePath string              `json:"jwt-base-path"`
+		OAuth2      *matrixOAuth2Issuer `json:"oauth"`
+
+		timeout  time.Duration
+		provider http3rd.TokenProvider
+	}
+
+	// matrixOAuth2Issuer is the OAuth2 issuer of the JWTs of a site, as the --oauth-* options
+	matrixOAuth2Issuer struct {
+		Issuer           string `json:"issuer"`
+		TokenEndpoint    string `json:"token-endpoint"`
+		ClientID         string `json:"client-id"`
+		ClientSecretFile string `json:"client-secret-file"`
+		// Grant defaults to client_credentials
+		Grant            string `json:"grant"`
+		SubjectTokenFile string `json:"subject-token-file"`
+		Audience         string `json:"audience"`
+	}
+
+	// matrixSuite is a suite that can be run for a site
+	matrixSuite struct {
+		name     string
+		requires []string
+		build    func(ctx context.Context, params *http3rd.Params, site *matrixSite, config *matrixConfig) (interface{}, error)
+	}
+
+	// siteResult holds the reports of a site, as they are produced
+	siteResult struct {
+		site     *matrixSite
+		mutex    sync.Mutex
+		reports  []*suiteReport
+		timedOut bool
+		duration time.Duration
+		// notApplicable are the suites not run, because the site is not expected to support them
+		notApplicable map[string]bool
+	}
+
+	// matrixColumn identifies a test in the matrix
+	matrixColumn struct {
+		Suite, Test string
+	}
+
+	// matrixCell is the result of a test for a site
+	matrixCell struct {
+		Status, Message string
+	}
+
+	// matrix is the result of all the tests for all the sites
+	matrix struct {
+		Sites   []string
+		Columns []matrixColumn
+		// Cells are indexed by column, then site
+		Cells [][]matrixCell
+	}
+
+	// prefixWriter writes each line with a prefix, so the output of the sites can be told apart
+	prefixWriter struct {
+		mutex   *sync.Mutex
+		w       io.Writer
+		prefix  string
+		partial []byte
+	}
+)
+
+// matrixSuites are the suites run for each site
+var matrixSuites = []matrixSuite{
+	{
+		name:     "MacaroonTestSuite",
+		requires: []string{capabilityMacaroons},
+		build: func(ctx context.Context, params *http3rd.Params, site *matrixSite, config *matrixConfig) (interface{}, error) {
+			return newMacaroonTestSuite(ctx, params, site.URL)
+		},
+	},
+	{
+		name:     "TokenTestSuite",
+		requires: []string{capabilityTokens},
+		build: func(ctx context.Context, params *http3rd.Params, site *matrixSite, config *matrixConfig) (interface{}, error) {
+			return newTokenTestSuite(ctx, params, site.URL, site.provider, tokenTestExpiry, "")
+		},
+	},
+	{
+		name:     "CopyTestSuite",
+		requires: []string{capabilityMacaroons, capabilityTPC},
+		build: func(ctx context.Context, params *http3rd.Params, site *matrixSite, config *matrixConfig) (interface{}, error) {
+			peer := site.Peer
+			if peer == "" {
+				peer = site.URL
+			}
+			return newCopyTestSuite(ctx, params, site.URL, peer, config.LargeSize)
+		},
+	},
+}
+
+// Write implements io.Writer
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.partial = append(p.partial, b...)
+	for {
+		newLine := bytes.IndexByte(p.partial, '\n')
+		if newLine < 0 {
+			break
+		}
+		fmt.Fprintf(p.w, "%s%s\n", p.prefix, p.partial[:newLine])
+		p.partial = p.partial[newLine+1:]
+	}
+	return len(b), nil
+}
+
+// loadMatrixConfig reads and validates the configuration file
+func loadMatrixConfig(path string) (*matrixConfig, error) {
+	data, e := ioutil.ReadFile(path)
+	if e != nil {
+		return nil, e
+	}
+	config := &matrixConfig{
+		Timeout:     "30m",
+		Concurrency: 4,
+		LargeSize:   copyLargeSize,
+	}
+	if e = json.Unmarshal(data, config); e != nil {
+		return nil, fmt.Errorf("Malformed configuration %s: %s", path, e)
+	}
+	if len(config.Sites) == 0 {
+		return nil, fmt.Errorf("No site in %s", path)
+	}
+	if config.Concurrency < 1 {
+		config.Concurrency = 1
+	}
+	if config.timeout, e = time.ParseDuration(config.Timeout); e != nil {
+		return nil, e
+	}
+
+	names := make(map[string]bool)
+	for _, site := range config.Sites {
+		if site.URL == "" {
+			return nil, fmt.Errorf("Site %q without URL", site.Name)
+		}
+		if site.Name == "" {
+			u, e := url.Parse(site.URL)
+			if e != nil {
+				return nil, e
+			}
+			site.Name = u.Host
+		}
+		if names[site.Name] {
+			return nil, fmt.Errorf("Duplicated site %s", site.Name)
+		}
+		names[site.Name] = true
+
+		site.timeout = config.timeout
+		if site.Timeout != "" {
+			if site.timeout, e = time.ParseDuration(site.Timeout); e != nil {
+				return nil, fmt.Errorf("Invalid timeout for %s: %s", site.Name, e)
+			}
+		}
+		for _, capability := range site.Capabilities {
+			if capability != capabilityMacaroons && capability != capabilityTokens && capability != capabilityTPC {
+				return nil, fmt.Errorf("Unknown capability %s for %s", capability, site.Name)
+			}
+		}
+		if site.provider, e = site.tokenProvider(); e != nil {
+			return nil, fmt.Errorf("Invalid token configuration for %s: %s", site.Name, e)
+		}
+	}
+	return config, nil
+}
+
+// tokenProvider returns the token provider configured for the site
+// Returns nil if none is set, so macaroons are used
+func (site *matrixSite) tokenProvider() (http3rd.TokenProvider, error) {
+	flags := &endpointFlags{
+		token:       site.Token,
+		tokenFile:   site.TokenFile,
+		tokenCmd:    site.TokenCmd,
+		jwt:         site.JWT,
+		jwtBasePath: site.JWTBasePath,
+		oauth2:      &oauth2Flags{grant: "client_credentials"},
+	}
+	if site.OAuth2 != nil {
+		flags.oauth2 = &oauth2Flags{
+			issuer:           site.OAuth2.Issuer,
+			tokenEndpoint:    site.OAuth2.TokenEndpoint,
+			clientID:         site.OAuth2.ClientID,
+			clientSecretFile: site.OAuth2.ClientSecretFile,
+			grant:            site.OAuth2.Grant,
+			subjectTokenFile: site.OAuth2.SubjectTokenFile,
+			audience:         site.OAuth2.Audience,
+		}
+		if flags.oauth2.grant == "" {
+			flags.oauth2.grant = "client_credentials"
+		}
+	}
+	if site.OAuth2 != nil && !site.JWT {
+		return nil, errors.New("The oauth issuer is only used with jwt")
+	}
+	return flags.tokenProvider()
+}
+
+// expects returns true if the site is expected to have all the capabilities
+func (site *matrixSite) expects(capabilities ...string) bool {
+	for _, capability := range capabilities {
+		found := false
+		for _, expected := range site.Capabilities {
+			found = found || expected == capability
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// params returns the parameters from the command line, with the credentials of the site
+func (site *matrixSite) params() *http3rd.Params {
+	p := params
+	p.Source, p.Destination = nil, nil
+	if site.Cert != "" {
+		p.UserCert, p.UserKey = site.Cert, site.Key
+		if p.UserKey == "" {
+			p.UserKey = site.Cert
+		}
+	}
+	if site.CAPath != "" {
+		p.CAPath = site.CAPath
+	}
+	p.Insecure = p.Insecure || site.Insecure
+	return &p
+}
+
+// add keeps the report, unless the site has already timed out
+func (r *siteResult) add(report *suiteReport) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !r.timedOut {
+		report.Site = r.site.Name
+		r.reports = append(r.reports, report)
+	}
+}
+
+// timeout records that the site timed out, and ignores any report added afterwards
+func (r *siteResult) timeout(start time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.reports = append(r.reports, &suiteReport{
+		Name:      timeoutSuite,
+		Site:      r.site.Name,
+		Timestamp: start,
+		Duration:  time.Since(start).Seconds(),
+		Tests: []*testReport{{
+			Name: "Timeout", Status: statusError,
+			Message: fmt.Sprint("Timed out after ", r.site.timeout),
+		}},
+	})
+	r.timedOut = true
+}
+
+// checkCapabilities discovers the capabilities of the site, and compares them with the expected ones
+func checkCapabilities(ctx context.Context, params *http3rd.Params, site *matrixSite) *suiteReport {
+	report := &suiteReport{Name: capabilitiesSuite, Timestamp: time.Now()}
+	discovery := &testReport{Name: "Discovery", Status: statusPassed}
+	report.Tests = append(report.Tests, discovery)
+
+	var caps *http3rd.Capabilities
+	client, e := http3rd.BuildHttpClient(params)
+	if e == nil {
+		caps, e = http3rd.DiscoverCapabilities(ctx, client, params.Redirect, site.URL)
+	}
+	if e != nil {
+		discovery.Status = statusError
+		discovery.Message = e.Error()
+	} else {
+		discovery.Output = fmt.Sprintf("Server: %s\nDAV: %s\nAllow: %s",
+			caps.Server, strings.Join(caps.DAV, ", "), strings.Join(caps.Allow, ", "))
+	}
+
+	for _, capability := range site.Capabilities {
+		test := &testReport{Name: capability, Status: statusPassed}
+		switch {
+		case caps == nil:
+			test.Status = statusMissed
+			test.Message = "The capabilities could not be discovered"
+		case capability == capabilityMacaroons && !caps.Macaroons:
+			test.Status = statusFailed
+			test.Message = "Macaroon requests are not advertised"
+		case capability == capabilityTokens && site.provider == nil && !caps.Macaroons:
+			// Tokens from other issuers can not be discovered
+			test.Status = statusFailed
+			test.Message = "Macaroon requests are not advertised, and no token issuer is configured"
+		case capability == capabilityTPC && !caps.TPC:
+			test.Status = statusFailed
+			test.Message = "COPY is not allowed"
+		}
+		report.Tests = append(report.Tests, test)
+	}
+	report.Duration = time.Since(report.Timestamp).Seconds()
+	return report
+}
+
+// runSite runs the suites the site is expected to support
+// Once ctx is done, the requests of the running suite fail, and no other suite is started.
+func runSite(ctx context.Context, result *siteResult, config *matrixConfig, console io.Writer) {
+	site := result.site
+	params := site.params()
+	result.add(checkCapabilities(ctx, params, site))
+
+	for _, suite := range matrixSuites {
+		if !site.expects(suite.requires...) {
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		logrus.Info(site.Name, ": running ", suite.name)
+		instance, e := suite.build(ctx, params, site, config)
+		if e != nil {
+			result.add(&suiteReport{
+				Name:      suite.name,
+				Timestamp: time.Now(),
+				Tests:     []*testReport{{Name: "SetUpSuite", Status: statusError, Message: e.Error()}},
+			})
+			continue
+		}
+		report, _ := runSuite(suite.name, instance, config.Filter, console)
+		result.add(report)
+	}
+}
+
+// runMatrix runs the sites concurrently, each with its own timeout
+// When a site times out, its requests are aborted and its results are ignored from then on.
+// The site keeps its slot until its tests have actually stopped.
+func runMatrix(config *matrixConfig) []*siteResult {
+	results := make([]*siteResult, len(config.Sites))
+	slots := make(chan struct{}, config.Concurrency)
+	consoleMutex := &sync.Mutex{}
+	wait := sync.WaitGroup{}
+
+	for i, site := range config.Sites {
+		result := &siteResult{site: site, notApplicable: make(map[string]bool)}
+		for _, suite := range matrixSuites {
+			result.notApplicable[suite.name] = !site.expects(suite.requires...)
+		}
+		results[i] = result
+
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			console := &prefixWriter{mutex: consoleMutex, w: os.Stdout, prefix: "[" + result.site.Name + "] "}
+			ctx, cancel := context.WithTimeout(context.Background(), result.site.timeout)
+			defer cancel()
+			done := make(chan struct{})
+			start := time.Now()
+			go func() {
+				runSite(ctx, result, config, console)
+				close(done)
+			}()
+
+			select {
+			case <-done:
+				result.duration = time.Since(start)
+			case <-ctx.Done():
+				logrus.Error(result.site.Name, ": timed out after ", result.site.timeout)
+				result.timeout(start)
+				result.duration = time.Since(start)
+				<-done
+			}
+		}()
+	}
+	wait.Wait()
+	return results
+}
+
+// buildMatrix arranges the results as a table of tests by site
+func buildMatrix(results []*siteResult) *matrix {
+	m := &matrix{}
+	index := make(map[matrixColumn]int)
+	addColumn := func(column matrixColumn) {
+		if _, ok := index[column]; !ok {
+			index[column] = len(m.Columns)
+			m.Columns = append(m.Columns, column)
+		}
+	}
+
+	// The columns follow the order of the suites, and of the tests within them
+	for _, suite := range append([]string{capabilitiesSuite}, suiteNames()...) {
+		for _, result := range results {
+			for _, report := range result.reports {
+				if report.Name != suite {
+					continue
+				}
+				for _, test := range report.Tests {
+					addColumn(matrixColumn{Suite: report.Name, Test: test.Name})
+				}
+			}
+		}
+	}
+
+	for _, result := range results {
+		m.Sites = append(m.Sites, result.site.Name)
+	}
+	m.Cells = make([][]matrixCell, len(m.Columns))
+	for i, column := range m.Columns {
+		m.Cells[i] = make([]matrixCell, len(results))
+		for j, result := range results {
+			m.Cells[i][j] = result.cell(column)
+		}
+	}
+	return m
+}
+
+// suiteNames returns the names of the matrix suites, in order
+func suiteNames() []string {
+	names := []string{}
+	for _, suite := range matrixSuites {
+		names = append(names, suite.name)
+	}
+	return names
+}
+
+// cell returns the result of the test for the site
+func (r *siteResult) cell(column matrixColumn) matrixCell {
+	for _, report := range r.reports {
+		if report.Name != column.Suite {
+			continue
+		}
+		for _, test := range report.Tests {
+			if test.Name == column.Test {
+				return matrixCell{Status: test.Status, Message: test.Message}
+			}
+		}
+	}
+	switch {
+	case r.notApplicable[column.Suite]:
+		return matrixCell{Status: statusNotApplicable}
+	case r.timedOut:
+		return matrixCell{Status: statusTimeout}
+	}
+	return matrixCell{Status: statusNotRun}
+}
+
+// summary counts the results of the site
+func (r *siteResult) summary() (passed, failed, skipped int) {
+	for _, report := range r.reports {
+		for _, test := range report.Tests {
+			switch test.Status {
+			case statusPassed:
+				passed++
+			case statusSkipped:
+				skipped++
+			default:
+				failed++
+			}
+		}
+	}
+	return
+}
+
+// writeSummary prints a line per site, followed by the failures
+func writeSummary(w io.Writer, results []*siteResult) {
+	table := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(table, "SITE\tPASSED\tFAILED\tSKIPPED\tDURATION\tRESULT")
+	for _, result := range results {
+		passed, failed, skipped := result.summary()
+		status := "ok"
+		if result.timedOut {
+			status = statusTimeout
+		} else if failed > 0 {
+			status = "failed"
+		}
+		fmt.Fprintf(table, "%s\t%d\t%d\t%d\t%s\t%s\n", result.site.Name, passed, failed, skipped,
+			result.duration.Truncate(time.Second), status)
+	}
+	table.Flush()
+
+	for _, result := range results {
+		for _, report := range result.reports {
+			for _, test := range report.Tests {
+				if test.Status != statusPassed && test.Status != statusSkipped {
+					fmt.Fprintf(w, "%s: %s.%s %s: %s\n", result.site.Name, report.Name, test.Name, test.Status, test.Message)
+				}
+			}
+		}
+	}
+}
+
+// markdownEscape escapes the characters with a meaning inside a Markdown table
+func markdownEscape(value string) string {
+	value = strings.ReplaceAll(value, "|", "\\|")
+	return strings.Join(strings.Fields(value), " ")
+}
+
+// writeMarkdown writes the matrix as a Markdown table, with a row per test
+func writeMarkdown(w io.Writer, m *matrix) error {
+	buffer := &bytes.Buffer{}
+	buffer.WriteString("| Test |")
+	for _, site := range m.Sites {
+		fmt.Fprintf(buffer, " %s |", markdownEscape(site))
+	}
+	buffer.WriteString("\n|---|")
+	buffer.WriteString(strings.Repeat("---|", len(m.Sites)))
+	buffer.WriteString("\n")
+	for i, column := range m.Columns {
+		fmt.Fprintf(buffer, "| %s.%s |", markdownEscape(column.Suite), markdownEscape(column.Test))
+		for _, cell := range m.Cells[i] {
+			fmt.Fprintf(buffer, " %s |", markdownEscape(cell.Status))
+		}
+		buffer.WriteString("\n")
+	}
+	_, e := w.Write(buffer.Bytes())
+	return e
+}
+
+// matrixTemplate renders the matrix as HTML, with a row per test
+var matrixTemplate = template.Must(template.New("matrix").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>litmus compatibility matrix</title>
+<style>
+table { border-collapse: collapse; font-family: sans-serif; font-size: small; }
+th, td { border: 1px solid #ccc; padding: 4px 8px; }
+td.passed { background: #c8e6c9; }
+td.failed, td.error, td.timeout { background: #ffcdd2; }
+td.skipped, td.missed { background: #fff9c4; }
+td.na { background: #eeeeee; color: #777; }
+</style>
+</head>
+<body>
+<h1>litmus compatibility matrix</h1>
+<p>Generated on {{.Generated}}</p>
+<table>
+<tr><th>Test</th>{{range .Matrix.Sites}}<th>{{.}}</th>{{end}}</tr>
+{{range $i, $column := .Matrix.Columns}}<tr><th>{{$column.Suite}}.{{$column.Test}}</th>{{range index $.Matrix.Cells $i}}<td class="{{$.Class .Status}}" title="{{.Message}}">{{.Status}}</td>{{end}}</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// htmlPage is what matrixTemplate renders
+type htmlPage struct {
+	Matrix    *matrix
+	Generated string
+}
+
+// Class returns the CSS class of the status
+func (htmlPage) Class(status string) string {
+	switch status {
+	case statusNotApplicable, statusNotRun:
+		return "na"
+	}
+	return status
+}
+
+// writeHTML writes the matrix as an HTML page
+func writeHTML(w io.Writer, m *matrix) error {
+	return matrixTemplate.Execute(w, htmlPage{Matrix: m, Generated: time.Now().UTC().Format(time.RFC1123)})
+}
+
+// writeMatrix writes the matrix into the file with the given format
+func writeMatrix(path string, m *matrix, format func(io.Writer, *matrix) error) error {
+	buffer := &bytes.Buffer{}
+	if e := format(buffer, m); e != nil {
+		return e
+	}
+	return ioutil.WriteFile(path, buffer.Bytes(), 0644)
+}
+
+// Run the suites against the sites of a configuration file
+var matrixTestCmd = &cobra.Command{
+	Use:   "matrix <config>",
+	Short: "Run the suites against a list of sites, and build a compatibility matrix",
+	Long: `Run the suites against the sites listed in a JSON configuration file, i.e.
+
+{
+  "timeout": "30m",
+  "concurrency": 4,
+  "sites": [
+    {"name": "SITE-A", "url": "https://a.example.com/dteam/", "capabilities": ["macaroons", "tokens", "tpc"]},
+    {"name": "SITE-B", "url": "https://b.example.com/dteam/", "peer": "https://a.example.com/dteam/",
+     "cert": "/tmp/x509up_b", "capath": "/etc/grid-security/certificates", "capabilities": ["macaroons", "tpc"]}
+  ]
+}
+
+Only the suites that need the capabilities expected from a site are run: the
+MacaroonTestSuite needs "macaroons", and the CopyTestSuite "macaroons" and "tpc".
+The TokenTestSuite, which needs "tokens", uses macaroons unless the site sets
+"token", "token-file", "token-cmd", or "jwt" with an "oauth" issuer
+(issuer, token-endpoint, client-id, client-secret-file, grant,
+subject-token-file, audience), as the options of "test token".`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			logrus.Fatal("Expecting the configuration file")
+		}
+		config, e := loadMatrixConfig(args[0])
+		if e != nil {
+			logrus.Fatal(e)
+		}
+
+		results := runMatrix(config)
+		for _, result := range results {
+			for _, report := range result.reports {
+				recordReport(report, report.passed())
+			}
+		}
+
+		fmt.Println()
+		writeSummary(os.Stdout, results)
+
+		m := buildMatrix(results)
+		if matrixMarkdown != "" {
+			if e = writeMatrix(matrixMarkdown, m, writeMarkdown); e != nil {
+				logrus.Fatal(e)
+			}
+		}
+		if matrixHTML != "" {
+			if e = writeMatrix(matrixHTML, m, writeHTML); e != nil {
+				logrus.Fatal(e)
+			}
+		}
+	},
+}
+
+func init() {
+	testCmd.AddCommand(matrixTestCmd)
+	flags := matrixTestCmd.Flags()
+	flags.StringVar(&matrixHTML, "html", "", "Write the matrix as HTML into this file")
+	flags.StringVar(&matrixMarkdown, "markdown", "", "Write the matrix as a Markdown table into this file")
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"github.com/ayllon/http3rd"
+	"github.com/ayllon/http3rd/mockse"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	mock       bool
+	mockServer *mockse.Server
+	// mockPeer shares the authority of mockServer, and is the destination of the copy tests
+	mockPeer *mockse.Server
+)
+
+// startMock starts the in-process storages, and uses their credentials and CA path
+// A test file is created under /dteam/, which is the base URL of the tests.
+func startMock(params *http3rd.Params) {
+	var e error
+	if mockServer, e = mockse.New(); e != nil {
+		logrus.Fatal(e)
+	}
+	if mockPeer, e = mockse.NewServer(mockServer.Authority); e != nil {
+		logrus.Fatal(e)
+	}
+	if e = mockServer.WriteFile("/dteam/testfile", bytes.Repeat([]byte("http3rd"), 1024)); e != nil {
+		logrus.Fatal(e)
+	}
+
+	mockParams := mockServer.Params()
+	params.UserCert = mockParams.UserCert
+	params.UserKey = mockParams.UserKey
+	params.CAPath = mockParams.CAPath
+	logrus.Info("Running against the mock storage at ", mockServer.URL)
+}
+
+// mockBaseURL returns the base URL of the tests on the mock storage, or url if it is not running
+func mockBaseURL(url string) string {
+	if mockServer == nil {
+		return url
+	}
+	return mockServer.URL + "/dteam/"
+}
+
+// mockPeerURL returns the base URL of the tests on the second mock storage, or url if it is not running
+func mockPeerURL(url string) string {
+	if mockPeer == nil {
+		return url
+	}
+	return mockPeer.URL + "/dteam/"
+}
+
+// stopMock stops the in-process storages, if running
+func stopMock() {
+	if mockPeer != nil {
+		mockPeer.Close()
+		mockPeer = nil
+	}
+	if mockServer != nil {
+		mockServer.Close()
+		mockServer = nil
+	}
+}
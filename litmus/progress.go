@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ayllon/http3rd"
+	"github.com/sirupsen/logrus"
+	"os"
+	"sync"
+	"time"
+)
+
+// progressDisplay renders the progress of a copy
+// On a terminal, a single line is refreshed every second. Otherwise, a log line is
+// written at most once per interval.
+type progressDisplay struct {
+	mutex    sync.Mutex
+	terminal bool
+	interval time.Duration
+	start    time.Time
+	last     *http3rd.Progress
+	lastLog  time.Time
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// isTerminal returns true if the file is a character device
+func isTerminal(f *os.File) bool {
+	stat, e := f.Stat()
+	if e != nil {
+		return false
+	}
+	return stat.Mode()&os.ModeCharDevice != 0
+}
+
+// humanBytes formats a number of bytes using binary prefixes
+func humanBytes(bytes float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+	i := 0
+	for bytes >= 1024 && i < len(units)-1 {
+		bytes /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", bytes, units[i])
+}
+
+// newProgressDisplay starts a display. Stop must be called once the copy is done.
+func newProgressDisplay(interval time.Duration) *progressDisplay {
+	d := &progressDisplay{
+		terminal: isTerminal(os.Stdout),
+		interval: interval,
+		start:    time.Now(),
+		done:     make(chan struct{}),
+	}
+	if d.terminal {
+		d.wg.Add(1)
+		go d.refresh()
+	}
+	return d
+}
+
+// refresh redraws the line periodically, so the elapsed time moves even
+// when the remote end is slow sending markers
+func (d *progressDisplay) refresh() {
+	defer d.wg.Done()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+			d.mutex.Lock()
+			d.draw()
+			d.mutex.Unlock()
+		}
+	}
+}
+
+// line returns the textual representation of the current state
+func (d *progressDisplay) line() string {
+	elapsed := time.Since(d.start).Truncate(time.Second)
+	if d.last == nil {
+		return fmt.Sprintf("Waiting for the first performance marker (%s)", elapsed)
+	}
+	return fmt.Sprintf("%s transferred, %s/s (%s)",
+		humanBytes(float64(d.last.BytesTransferred)), humanBytes(d.last.Rate), elapsed)
+}
+
+// draw overwrites the current terminal line
+func (d *progressDisplay) draw() {
+	fmt.Fprintf(os.Stdout, "\r\033[K%s", d.line())
+}
+
+// Update is the http3rd.ProgressFunc
+func (d *progressDisplay) Update(progress *http3rd.Progress) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.last = progress
+	if d.terminal {
+		d.draw()
+	} else if time.Since(d.lastLog) >= d.interval {
+		logrus.Info(d.line())
+		d.lastLog = time.Now()
+	}
+}
+
+// Stop finishes the display
+func (d *progressDisplay) Stop() {
+	close(d.done)
+	d.wg.Wait()
+	if d.terminal {
+		d.mutex.Lock()
+		d.draw()
+		fmt.Fprintln(os.Stdout)
+		d.mutex.Unlock()
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"gopkg.in/check.v1"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Status of a test in the reports
+const (
+	statusPassed  = "passed"
+	statusFailed  = "failed"
+	statusSkipped = "skipped"
+	// statusError is a test that panicked
+	statusError = "error"
+	// statusMissed is a test that did not run because a fixture failed
+	statusMissed = "missed"
+)
+
+var (
+	junitReport string
+	jsonReport  string
+
+	// reports are the results of the suites run by this invocation
+	reports      []*suiteReport
+	reportsMutex sync.Mutex
+	// testsFailed is set if any test did not pass, so litmus exits with an error
+	testsFailed bool
+)
+
+type (
+	// testReport is the outcome of a test, or of a fixture that did not pass
+	testReport struct {
+		Name     string  `json:"name"`
+		Status   string  `json:"status"`
+		Duration float64 `json:"duration"`
+		// Message is the reason of the failure or skip
+		Message string `json:"message,omitempty"`
+		// Output is everything logged by the test
+		Output string `json:"output,omitempty"`
+	}
+
+	// suiteReport groups the tests of a suite
+	suiteReport struct {
+		Name string `json:"name"`
+		// Site is set when the suite is run by the matrix
+		Site      string        `json:"site,omitempty"`
+		Timestamp time.Time     `json:"timestamp"`
+		Duration  float64       `json:"duration"`
+		Tests     []*testReport `json:"tests"`
+	}
+
+	// runningCall is a test or fixture that has started but not finished
+	runningCall struct {
+		name   string
+		start  time.Time
+		output bytes.Buffer
+	}
+
+	// reportWriter parses the streamed gocheck output into a suiteReport, and
+	// prints it on the console as the verbose mode does
+	reportWriter struct {
+		console io.Writer
+		suite   *suiteReport
+		partial []byte
+		running []*runningCall
+	}
+
+	// junitTestSuites, junitTestSuite and junitTestCase model the JUnit XML report
+	junitTestSuites struct {
+		XMLName xml.Name         `xml:"testsuites"`
+		Suites  []junitTestSuite `xml:"testsuite"`
+	}
+	junitTestSuite struct {
+		Name      string          `xml:"name,attr"`
+		Tests     int             `xml:"tests,attr"`
+		Failures  int             `xml:"failures,attr"`
+		Errors    int             `xml:"errors,attr"`
+		Skipped   int             `xml:"skipped,attr"`
+		Time      string          `xml:"time,attr"`
+		Timestamp string          `xml:"timestamp,attr"`
+		Cases     []junitTestCase `xml:"testcase"`
+	}
+	junitTestCase struct {
+		Name      string        `xml:"name,attr"`
+		ClassName string        `xml:"classname,attr"`
+		Time      string        `xml:"time,attr"`
+		Failure   *junitMessage `xml:"failure,omitempty"`
+		Error     *junitMessage `xml:"error,omitempty"`
+		Skipped   *junitMessage `xml:"skipped,omitempty"`
+		SystemOut string        `xml:"system-out,omitempty"`
+	}
+	junitMessage struct {
+		Message string `xml:"message,attr,omitempty"`
+		Text    string `xml:",chardata"`
+	}
+)
+
+// callRegex matches the lines gocheck writes when a call starts and ends
+// i.e. "PASS: test_copy.go:42: CopyTestSuite.TestPush	0.5s"
+var callRegex = regexp.MustCompile(`^(START|PASS|FAIL EXPECTED|FAIL|SKIP|PANIC|MISS): (\S+:\d+): (\S+)(.*)$`)
+
+// reportSeparator is written by gocheck around failures
+const reportSeparator = "----------------------------------------------------------------------"
+
+// newReportWriter returns a writer that builds the report of the suite
+func newReportWriter(name string, console io.Writer) *reportWriter {
+	return &reportWriter{
+		console: console,
+		suite:   &suiteReport{Name: name, Timestamp: time.Now()},
+	}
+}
+
+// Write implements io.Writer
+func (w *reportWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		newLine := bytes.IndexByte(w.partial, '\n')
+		if newLine < 0 {
+			break
+		}
+		w.line(string(w.partial[:newLine]))
+		w.partial = w.partial[newLine+1:]
+	}
+	return len(p), nil
+}
+
+// line processes one line of the gocheck output
+func (w *reportWriter) line(line string) {
+	match := callRegex.FindStringSubmatch(line)
+	if match == nil {
+		for _, call := range w.running {
+			call.output.WriteString(line)
+			call.output.WriteByte('\n')
+		}
+		return
+	}
+
+	label, location, name, suffix := match[1], match[2], match[3], match[4]
+	if label == "START" {
+		w.running = append(w.running, &runningCall{name: name, start: time.Now()})
+		return
+	}
+
+	// Calls are nested (fixtures run within the test), so the one ending is the innermost one
+	var call *runningCall
+	for i := len(w.running) - 1; i >= 0; i-- {
+		if w.running[i].name == name {
+			call = w.running[i]
+			w.running = w.running[:i]
+			break
+		}
+	}
+	if call == nil {
+		call = &runningCall{name: name, start: time.Now()}
+	}
+	w.done(label, location, name, suffix, call)
+}
+
+// done records the end of a call, and prints it
+func (w *reportWriter) done(label, location, name, suffix string, call *runningCall) {
+	method := name[strings.LastIndex(name, ".")+1:]
+	isTest := strings.HasPrefix(method, "Test")
+	output := strings.TrimSpace(call.output.String())
+
+	test := &testReport{
+		Name:     method,
+		Duration: time.Since(call.start).Seconds(),
+		Output:   output,
+	}
+	switch label {
+	case "PASS", "FAIL EXPECTED":
+		test.Status = statusPassed
+	case "SKIP":
+		test.Status = statusSkipped
+		test.Message = strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(suffix), "("), ")")
+	case "MISS":
+		test.Status = statusMissed
+		test.Message = "Not run because a fixture failed"
+	case "FAIL":
+		test.Status = statusFailed
+		test.Message = failureMessage(output)
+	case "PANIC":
+		test.Status = statusError
+		test.Message = failureMessage(output)
+	}
+
+	// Fixtures are only reported when they break the suite
+	if isTest || test.Status == statusFailed || test.Status == statusError {
+		w.suite.Tests = append(w.suite.Tests, test)
+	}
+
+	switch test.Status {
+	case statusFailed, statusError:
+		fmt.Fprintf(w.console, "\n%s\n%s: %s: %s\n\n", reportSeparator, label, location, name)
+		if output != "" {
+			fmt.Fprintln(w.console, output)
+		}
+		fmt.Fprintln(w.console, reportSeparator)
+	default:
+		if isTest {
+			fmt.Fprintf(w.console, "%s: %s: %s%s\n", label, location, name, suffix)
+		}
+	}
+}
+
+// failureMessage extracts the error from the output of a failed test
+// gocheck prefixes the errors, and the values of failed checks, with "... ".
+// If there is none, the last line logged is used.
+func failureMessage(output string) string {
+	var details []string
+	last := ""
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "... ") {
+			details = append(details, strings.TrimPrefix(strings.TrimPrefix(line, "... "), "Error: "))
+		} else if line != "" {
+			last = line
+		}
+	}
+	if len(details) > 0 {
+		return strings.Join(details, "; ")
+	}
+	return last
+}
+
+// runSuite runs the suite, and returns its report and result
+// console receives the results as the verbose mode prints them.
+func runSuite(name string, suite interface{}, filter string, console io.Writer) (*suiteReport, *check.Result) {
+	w := newReportWriter(name, console)
+	result := check.Run(suite, &check.RunConf{
+		Output: w,
+		Stream: true,
+		Filter: filter,
+	})
+	w.suite.Duration = time.Since(w.suite.Timestamp).Seconds()
+	return w.suite, result
+}
+
+// recordReport keeps the report, to be written at the end
+// If passed is false, litmus exits with an error.
+func recordReport(report *suiteReport, passed bool) {
+	reportsMutex.Lock()
+	defer reportsMutex.Unlock()
+	reports = append(reports, report)
+	testsFailed = testsFailed || !passed
+}
+
+// runCommandSuite runs the suite of a test command, printing the results on the console
+func runCommandSuite(name string, suite interface{}) {
+	report, result := runSuite(name, suite, filter, os.Stdout)
+	logResult(result)
+	recordReport(report, result.Passed())
+}
+
+// count returns how many tests have the given status
+func (s *suiteReport) count(status string) int {
+	n := 0
+	for _, test := range s.Tests {
+		if test.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// passed returns true if no test failed, or did not run because of a failure
+func (s *suiteReport) passed() bool {
+	return s.count(statusFailed)+s.count(statusError)+s.count(statusMissed) == 0
+}
+
+// writeJUnit writes the reports as JUnit XML
+func writeJUnit(w io.Writer, suites []*suiteReport) error {
+	junit := &junitTestSuites{}
+	for _, suite := range suites {
+		name := suite.Name
+		if suite.Site != "" {
+			name = suite.Site + "." + suite.Name
+		}
+		junitSuite := junitTestSuite{
+			Name:      name,
+			Tests:     len(suite.Tests),
+			Failures:  suite.count(statusFailed),
+			Errors:    suite.count(statusError),
+			Skipped:   suite.count(statusSkipped) + suite.count(statusMissed),
+			Time:      fmt.Sprintf("%.3f", suite.Duration),
+			Timestamp: suite.Timestamp.UTC().Format("2006-01-02T15:04:05"),
+		}
+		for _, test := range suite.Tests {
+			testCase := junitTestCase{
+				Name:      test.Name,
+				ClassName: name,
+				Time:      fmt.Sprintf("%.3f", test.Duration),
+			}
+			// The output of a failure goes with it, instead of system-out
+			message := &junitMessage{Message: test.Message}
+			switch test.Status {
+			case statusFailed:
+				message.Text = test.Output
+				testCase.Failure = message
+			case statusError:
+				message.Text = test.Output
+				testCase.Error = message
+			case statusSkipped, statusMissed:
+				testCase.Skipped = message
+				testCase.SystemOut = test.Output
+			default:
+				testCase.SystemOut = test.Output
+			}
+			junitSuite.Cases = append(junitSuite.Cases, testCase)
+		}
+		junit.Suites = append(junit.Suites, junitSuite)
+	}
+
+	if _, e := io.WriteString(w, xml.Header); e != nil {
+		return e
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if e := encoder.Encode(junit); e != nil {
+		return e
+	}
+	_, e := io.WriteString(w, "\n")
+	return e
+}
+
+// writeJSON writes the reports as JSON
+func writeJSON(w io.Writer, suites []*suiteReport) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(map[string]interface{}{"suites": suites})
+}
+
+// writeReport writes the reports into the file with the given format
+func writeReport(path string, suites []*suiteReport, format func(io.Writer, []*suiteReport) error) error {
+	buffer := &bytes.Buffer{}
+	if e := format(buffer, suites); e != nil {
+		return e
+	}
+	return ioutil.WriteFile(path, buffer.Bytes(), 0644)
+}
+
+// writeReports writes the reports requested on the command line
+func writeReports() error {
+	reportsMutex.Lock()
+	defer reportsMutex.Unlock()
+	if junitReport != "" {
+		if e := writeReport(junitReport, reports, writeJUnit); e != nil {
+			return e
+		}
+	}
+	if jsonReport != "" {
+		if e := writeReport(jsonReport, reports, writeJSON); e != nil {
+			return e
+		}
+	}
+	return nil
+}
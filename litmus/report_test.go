@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// parseStream feeds the captured gocheck output to a reportWriter, a few bytes at a time
+// as gocheck does not write whole lines, and returns the report and the console output
+func parseStream(t *testing.T, name, path string) (*suiteReport, string) {
+	stream, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	console := &bytes.Buffer{}
+	w := newReportWriter(name, console)
+	for len(stream) > 0 {
+		n := 7
+		if n > len(stream) {
+			n = len(stream)
+		}
+		w.Write(stream[:n])
+		stream = stream[n:]
+	}
+	return w.suite, console.String()
+}
+
+// expectedTest is what is checked of a testReport
+type expectedTest struct {
+	name, status, message string
+	// output is a part of the output
+	output string
+}
+
+// checkTests compares the tests of the report with the expected ones
+func checkTests(t *testing.T, report *suiteReport, expected []expectedTest) {
+	if len(report.Tests) != len(expected) {
+		t.Fatalf("Expecting %d tests, got %d", len(expected), len(report.Tests))
+	}
+	for i, test := range report.Tests {
+		if test.Name != expected[i].name || test.Status != expected[i].status {
+			t.Errorf("Expecting %s %s, got %s %s", expected[i].name, expected[i].status, test.Name, test.Status)
+		}
+		if !strings.HasPrefix(test.Message, expected[i].message) {
+			t.Errorf("%s: expecting the message %q, got %q", test.Name, expected[i].message, test.Message)
+		}
+		if !strings.Contains(test.Output, expected[i].output) {
+			t.Errorf("%s: expecting %q in the output, got %q", test.Name, expected[i].output, test.Output)
+		}
+	}
+}
+
+func TestReportWriter(t *testing.T) {
+	report, console := parseStream(t, "SampleTestSuite", "testdata/stream.txt")
+	checkTests(t, report, []expectedTest{
+		{"TestExpected", statusPassed, "", ""},
+		{"TestFail", statusFailed, "obtained int = 404; expected int = 201", "uploading"},
+		{"TestFatal", statusFailed, "Could not upload: 403", `c.Fatal("Could not upload: 403")`},
+		{"TestPanic", statusError, "Panic: assignment to entry in nil map", "in SampleTestSuite.TestPanic"},
+		{"TestPass", statusPassed, "", "all good"},
+		{"TestSkip", statusSkipped, "No redirect", ""},
+	})
+	if report.passed() {
+		t.Error("Expecting the suite to have failed")
+	}
+
+	// The console gets the verbose output, with the details of the failures only
+	for _, line := range []string{
+		"PASS: test_sample.go:11: SampleTestSuite.TestPass\t0.000s\n",
+		"SKIP: test_sample.go:17: SampleTestSuite.TestSkip (No redirect)\n",
+		reportSeparator + "\nFAIL: test_sample.go:12: SampleTestSuite.TestFail\n\nuploading\n",
+		reportSeparator + "\nPANIC: test_sample.go:18: SampleTestSuite.TestPanic\n",
+	} {
+		if !strings.Contains(console, line) {
+			t.Errorf("Expecting %q on the console, got:\n%s", line, console)
+		}
+	}
+	if strings.Contains(console, "START") || strings.Contains(console, "all good") {
+		t.Errorf("Unexpected console output:\n%s", console)
+	}
+}
+
+func TestReportWriterFixture(t *testing.T) {
+	report, _ := parseStream(t, "BrokenTestSuite", "testdata/stream-fixture.txt")
+	checkTests(t, report, []expectedTest{
+		{"SetUpSuite", statusFailed, "Could not upload the test file: 401", ""},
+		{"TestA", statusMissed, "Not run because a fixture failed", ""},
+		{"TestB", statusMissed, "Not run because a fixture failed", ""},
+	})
+	if report.passed() {
+		t.Error("Expecting the suite to have failed")
+	}
+}
+
+func TestWriteJUnit(t *testing.T) {
+	sample, _ := parseStream(t, "SampleTestSuite", "testdata/stream.txt")
+	broken, _ := parseStream(t, "BrokenTestSuite", "testdata/stream-fixture.txt")
+	broken.Site = "SITE-A"
+
+	buffer := &bytes.Buffer{}
+	if err := writeJUnit(buffer, []*suiteReport{sample, broken}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buffer.String(), xml.Header) {
+		t.Error("Expecting the XML header")
+	}
+	junit := &junitTestSuites{}
+	if err := xml.Unmarshal(buffer.Bytes(), junit); err != nil {
+		t.Fatal(err)
+	}
+	if len(junit.Suites) != 2 {
+		t.Fatal("Expecting two suites, got ", len(junit.Suites))
+	}
+
+	suite := junit.Suites[0]
+	if suite.Name != "SampleTestSuite" || suite.Tests != 6 || suite.Failures != 2 || suite.Errors != 1 || suite.Skipped != 1 {
+		t.Errorf("Unexpected suite: %+v", suite)
+	}
+	fail := suite.Cases[1]
+	if fail.Name != "TestFail" || fail.ClassName != "SampleTestSuite" || fail.Failure == nil ||
+		fail.Failure.Message != "obtained int = 404; expected int = 201" || !strings.Contains(fail.Failure.Text, "uploading") {
+		t.Errorf("Unexpected failure: %+v", fail)
+	}
+	if panicked := suite.Cases[3]; panicked.Error == nil || panicked.Failure != nil {
+		t.Errorf("Expecting the panic as an error: %+v", panicked)
+	}
+	if pass := suite.Cases[4]; pass.Failure != nil || pass.Error != nil || pass.Skipped != nil || pass.SystemOut != "all good" {
+		t.Errorf("Unexpected pass: %+v", pass)
+	}
+	if skip := suite.Cases[5]; skip.Skipped == nil || skip.Skipped.Message != "No redirect" {
+		t.Errorf("Unexpected skip: %+v", skip)
+	}
+
+	// The site goes in the name of the suite, and the missed tests are skipped
+	suite = junit.Suites[1]
+	if suite.Name != "SITE-A.BrokenTestSuite" || suite.Tests != 3 || suite.Failures != 1 || suite.Skipped != 2 {
+		t.Errorf("Unexpected suite: %+v", suite)
+	}
+	if missed := suite.Cases[1]; missed.ClassName != "SITE-A.BrokenTestSuite" || missed.Skipped == nil {
+		t.Errorf("Unexpected missed test: %+v", missed)
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	sample, _ := parseStream(t, "SampleTestSuite", "testdata/stream.txt")
+	broken, _ := parseStream(t, "BrokenTestSuite", "testdata/stream-fixture.txt")
+	broken.Site = "SITE-A"
+
+	buffer := &bytes.Buffer{}
+	if err := writeJSON(buffer, []*suiteReport{sample, broken}); err != nil {
+		t.Fatal(err)
+	}
+	decoded := struct {
+		Suites []*suiteReport `json:"suites"`
+	}{}
+	if err := json.Unmarshal(buffer.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Suites) != 2 {
+		t.Fatal("Expecting two suites, got ", len(decoded.Suites))
+	}
+	if decoded.Suites[0].Site != "" || decoded.Suites[1].Site != "SITE-A" {
+		t.Error("Unexpected sites: ", decoded.Suites[0].Site, decoded.Suites[1].Site)
+	}
+	checkTests(t, decoded.Suites[0], []expectedTest{
+		{"TestExpected", statusPassed, "", ""},
+		{"TestFail", statusFailed, "obtained int = 404; expected int = 201", "uploading"},
+		{"TestFatal", statusFailed, "Could not upload: 403", ""},
+		{"TestPanic", statusError, "Panic: assignment to entry in nil map", ""},
+		{"TestPass", statusPassed, "", "all good"},
+		{"TestSkip", statusSkipped, "No redirect", ""},
+	})
+	checkTests(t, decoded.Suites[1], []expectedTest{
+		{"SetUpSuite", statusFailed, "Could not upload the test file: 401", ""},
+		{"TestA", statusMissed, "Not run because a fixture failed", ""},
+		{"TestB", statusMissed, "Not run because a fixture failed", ""},
+	})
+
+	// Empty fields are omitted
+	if strings.Contains(buffer.String(), `"message": ""`) || strings.Contains(buffer.String(), `"site": ""`) {
+		t.Error("Expecting the empty fields to be omitted")
+	}
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/ayllon/http3rd"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"gopkg.in/check.v1"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	copySourceURL      = ""
+	copyDestinationURL = ""
+	copyLargeSize      int64
+)
+
+const (
+	// copyTestSize is the size of the file used by most of the copy tests
+	copyTestSize = 1024 * 1024
+	// copyTestLifetime is the lifetime of the tokens used by the copy tests
+	copyTestLifetime = 5 * time.Minute
+)
+
+// Third party copy test suite
+// A file is uploaded to the source with the X509 credentials, and copied to the
+// destination with DoHTTP3rdCopy, in push and pull mode.
+type CopyTestSuite struct {
+	// ctx aborts the requests and the copies of the suite once done (i.e. when the site times out)
+	ctx context.Context
+	// Parameters of the copies
+	params *http3rd.Params
+	// It has X509 client credentials setup. Used to prepare and check the files on both ends.
+	x509client *http.Client
+	// Base URLs
+	srcBase, dstBase string
+	// File uploaded to the source, and its content
+	source  string
+	content []byte
+	// Where the file is copied to
+	destination string
+	// Large file, only uploaded by TestLargeFile
+	largeSource string
+	largeSize   int64
+}
+
+// newCopyTestSuite returns the suite copying from srcBase into dstBase
+func newCopyTestSuite(ctx context.Context, params *http3rd.Params, srcBase, dstBase string, largeSize int64) (*CopyTestSuite, error) {
+	x509client, e := http3rd.BuildHttpClient(params)
+	if e != nil {
+		return nil, e
+	}
+	return &CopyTestSuite{
+		ctx:        ctx,
+		params:     params,
+		x509client: x509client,
+		srcBase:    srcBase,
+		dstBase:    dstBase,
+		largeSize:  largeSize,
+	}, nil
+}
+
+// joinURL appends the file name to the base URL
+func joinURL(base, name string) string {
+	return strings.TrimSuffix(base, "/") + "/" + name
+}
+
+// randomBody returns a reproducible stream of pseudo random bytes
+func randomBody(seed, size int64) io.Reader {
+	return io.LimitReader(mathrand.New(mathrand.NewSource(seed)), size)
+}
+
+// upload puts the content into the URL, with the X509 credentials
+func (s *CopyTestSuite) upload(uri string, size int64, body func() io.Reader) error {
+	req, e := http.NewRequest("PUT", uri, nil)
+	if e != nil {
+		return e
+	}
+	req.Body = ioutil.NopCloser(body())
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(body()), nil
+	}
+	req.ContentLength = size
+
+	resp, e := http3rd.DoWithRedirectContext(s.ctx, s.x509client, req)
+	if e != nil {
+		return e
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Could not upload %s: %s", uri, resp.Status)
+	}
+	return nil
+}
+
+// remove deletes the URL with the X509 credentials, if it exists
+func (s *CopyTestSuite) remove(uri string) error {
+	req, e := http.NewRequest("DELETE", uri, nil)
+	if e != nil {
+		return e
+	}
+	resp, e := http3rd.DoWithRedirectContext(s.ctx, s.x509client, req)
+	if e != nil {
+		return e
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("Could not remove %s: %s", uri, resp.Status)
+	}
+	return nil
+}
+
+// request sends a request with the X509 credentials, and returns the response
+func (s *CopyTestSuite) request(method, uri string, header http.Header) (*http.Response, error) {
+	req, e := http.NewRequest(method, uri, nil)
+	if e != nil {
+		return nil, e
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	return http3rd.DoWithRedirectContext(s.ctx, s.x509client, req)
+}
+
+// size returns the size of the file, or -1 if it does not exist
+func (s *CopyTestSuite) size(uri string) (int64, error) {
+	resp, e := s.request("HEAD", uri, nil)
+	if e != nil {
+		return 0, e
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return -1, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("Could not stat %s: %s", uri, resp.Status)
+	}
+	return resp.ContentLength, nil
+}
+
+// digests returns the checksums of the file the endpoint sends on Want-Digest (RFC 3230)
+func (s *CopyTestSuite) digests(uri string) (map[string]string, error) {
+	resp, e := s.request("HEAD", uri, http.Header{"Want-Digest": {"adler32, md5"}})
+	if e != nil {
+		return nil, e
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Could not stat %s: %s", uri, resp.Status)
+	}
+
+	digests := make(map[string]string)
+	for _, line := range resp.Header.Values("Digest") {
+		for _, digest := range strings.Split(line, ",") {
+			parts := strings.SplitN(strings.TrimSpace(digest), "=", 2)
+			if len(parts) == 2 {
+				digests[strings.ToLower(parts[0])] = parts[1]
+			}
+		}
+	}
+	return digests, nil
+}
+
+// token asks the endpoint for a macaroon
+func (s *CopyTestSuite) token(c *check.C, uri string, lifetime time.Duration, activities ...string) string {
+	m, e := http3rd.GetMacaroonContext(s.ctx, s.x509client, &http3rd.MacaroonRequest{
+		Resource:   uri,
+		Activities: activities,
+		Lifetime:   lifetime,
+	})
+	if e != nil {
+		c.Fatal(e)
+	}
+	return m.Macaroon
+}
+
+// copy triggers the third party copy with the command line parameters, in the given mode
+// If provider is not nil, it issues the token for the passive endpoint.
+func (s *CopyTestSuite) copy(mode http3rd.CopyMode, provider http3rd.TokenProvider, source, destination string) error {
+	p := *s.params
+	p.Mode = mode
+	if provider != nil {
+		p.TokenProvider = provider
+	}
+	return http3rd.DoHTTP3rdCopyContext(s.ctx, &p, copyTestLifetime, source, destination)
+}
+
+// checkDestination verifies the destination has the same content as the source
+func (s *CopyTestSuite) checkDestination(c *check.C) {
+	resp, e := s.request("GET", s.destination, nil)
+	if e != nil {
+		c.Fatal(e)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.Fatal("Could not download the destination: ", resp.Status)
+	}
+	content, e := ioutil.ReadAll(resp.Body)
+	if e != nil {
+		c.Fatal(e)
+	}
+	if !bytes.Equal(content, s.content) {
+		c.Errorf("The destination does not match the source (%d bytes instead of %d)", len(content), len(s.content))
+	}
+}
+
+// SetUpSuite uploads the file to be copied
+func (s *CopyTestSuite) SetUpSuite(c *check.C) {
+	s.source = joinURL(s.srcBase, "litmus-copy-source")
+	s.largeSource = joinURL(s.srcBase, "litmus-copy-large")
+	s.destination = joinURL(s.dstBase, "litmus-copy-destination")
+
+	s.content = make([]byte, copyTestSize)
+	if _, e := rand.Read(s.content); e != nil {
+		c.Fatal(e)
+	}
+	e := s.upload(s.source, int64(len(s.content)), func() io.Reader {
+		return bytes.NewReader(s.content)
+	})
+	if e != nil {
+		c.Fatal(e)
+	}
+	logrus.Infof("Using %s as source, and %s as destination", s.source, s.destination)
+}
+
+// TearDownSuite removes the source files
+func (s *CopyTestSuite) TearDownSuite(c *check.C) {
+	if e := s.remove(s.source); e != nil {
+		c.Error(e)
+	}
+	if e := s.remove(s.largeSource); e != nil {
+		c.Error(e)
+	}
+}
+
+// SetUpTest removes the destination left by a previous test
+func (s *CopyTestSuite) SetUpTest(c *check.C) {
+	if e := s.remove(s.destination); e != nil {
+		c.Fatal(e)
+	}
+}
+
+// TestPush has the source upload the file into the destination
+func (s *CopyTestSuite) TestPush(c *check.C) {
+	if e := s.copy(http3rd.PushMode, nil, s.source, s.destination); e != nil {
+		c.Fatal(e)
+	}
+	s.checkDestination(c)
+}
+
+// TestPull has the destination download the file from the source
+func (s *CopyTestSuite) TestPull(c *check.C) {
+	if e := s.copy(http3rd.PullMode, nil, s.source, s.destination); e != nil {
+		c.Fatal(e)
+	}
+	s.checkDestination(c)
+}
+
+// TestOverwrite copies on top of an existing file, which is replaced unless Overwrite: F is sent
+func (s *CopyTestSuite) TestOverwrite(c *check.C) {
+	for _, mode := range []http3rd.CopyMode{http3rd.PushMode, http3rd.PullMode} {
+		e := s.upload(s.destination, 5, func() io.Reader {
+			return strings.NewReader("dummy")
+		})
+		if e != nil {
+			c.Fatal(e)
+		}
+
+		p := *s.params
+		p.Mode = mode
+		p.NoOverwrite = true
+		e = http3rd.DoHTTP3rdCopyContext(s.ctx, &p, copyTestLifetime, s.source, s.destination)
+		if e == nil {
+			c.Errorf("%s: expecting the copy to fail with Overwrite: F", mode)
+		} else if size, _ := s.size(s.destination); size != 5 {
+			c.Errorf("%s: the destination has been modified with Overwrite: F", mode)
+		}
+
+		if e = s.copy(mode, nil, s.source, s.destination); e != nil {
+			c.Errorf("%s: %s", mode, e)
+			continue
+		}
+		s.checkDestination(c)
+	}
+}
+
+// TestMissingSource copies a file that does not exist
+func (s *CopyTestSuite) TestMissingSource(c *check.C) {
+	missing := joinURL(s.srcBase, "litmus-copy-missing")
+	for _, mode := range []http3rd.CopyMode{http3rd.PushMode, http3rd.PullMode} {
+		if e := s.copy(mode, nil, missing, s.destination); e == nil {
+			c.Errorf("%s: expecting an error", mode)
+		} else {
+			c.Logf("%s: %s", mode, e)
+		}
+		if size, _ := s.size(s.destination); size >= 0 {
+			c.Errorf("%s: the destination has been created", mode)
+		}
+	}
+}
+
+// TestDestinationNoPermission pushes with a token that does not allow writing the destination
+func (s *CopyTestSuite) TestDestinationNoPermission(c *check.C) {
+	elsewhere := joinURL(s.dstBase, "litmus-copy-elsewhere")
+	token := s.token(c, elsewhere, copyTestLifetime, http3rd.Upload, http3rd.List)
+
+	e := s.copy(http3rd.PushMode, http3rd.StaticToken(token), s.source, s.destination)
+	if e == nil {
+		c.Error("Expecting an error")
+	} else {
+		c.Log(e)
+	}
+	if size, _ := s.size(s.destination); size >= 0 {
+		c.Error("The destination has been created")
+	}
+}
+
+// TestExpiredToken pulls with a token for the source that has expired
+func (s *CopyTestSuite) TestExpiredToken(c *check.C) {
+	token := s.token(c, s.source, 2*time.Second, http3rd.Download, http3rd.List)
+	time.Sleep(3 * time.Second)
+
+	e := s.copy(http3rd.PullMode, http3rd.StaticToken(token), s.source, s.destination)
+	if e == nil {
+		c.Error("Expecting an error")
+	} else {
+		c.Log(e)
+	}
+}
+
+// TestUnderScopedToken pulls with a token for the source that does not allow downloading
+func (s *CopyTestSuite) TestUnderScopedToken(c *check.C) {
+	token := s.token(c, s.source, copyTestLifetime, http3rd.List)
+
+	e := s.copy(http3rd.PullMode, http3rd.StaticToken(token), s.source, s.destination)
+	if e == nil {
+		c.Error("Expecting an error")
+	} else {
+		c.Log(e)
+	}
+}
+
+// rawCopy sends a pull COPY, and returns the response without interpreting it
+func (s *CopyTestSuite) rawCopy(c *check.C, source string) (*http.Response, []byte) {
+	token := s.token(c, source, copyTestLifetime, http3rd.Download, http3rd.List)
+	resp, e := s.request("COPY", s.destination, http.Header{
+		"Source":                      {source},
+		"Credential":                  {"none"},
+		"X-No-Delegate":               {"true"},
+		"Transferheaderauthorization": {"BEARER " + token},
+	})
+	if e != nil {
+		c.Fatal(e)
+	}
+	defer resp.Body.Close()
+	body, e := ioutil.ReadAll(resp.Body)
+	if e != nil {
+		c.Fatal(e)
+	}
+	return resp, body
+}
+
+// lastLine returns the last line of the body that is not empty
+func lastLine(body []byte) string {
+	last := ""
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			last = line
+		}
+	}
+	return last
+}
+
+// TestPerfMarkers checks the format of the performance markers sent during a pull
+func (s *CopyTestSuite) TestPerfMarkers(c *check.C) {
+	start := time.Now()
+	resp, body := s.rawCopy(c, s.source)
+	if resp.StatusCode != http.StatusAccepted {
+		c.Fatal("Expecting a 202, got ", resp.Status)
+	}
+
+	parser := http3rd.NewPerfMarkerParser(bytes.NewReader(body))
+	transferred := make(map[int]int64)
+	count := 0
+	for {
+		marker, e := parser.Next()
+		if e == io.EOF {
+			break
+		} else if e != nil {
+			c.Fatal(e)
+		}
+		count++
+
+		if marker.Timestamp.Before(start.Add(-5*time.Minute)) || marker.Timestamp.After(time.Now().Add(5*time.Minute)) {
+			c.Error("Timestamp out of range: ", marker.Timestamp)
+		}
+		if marker.TotalStripeCount < 1 {
+			c.Error("Invalid total stripe count: ", marker.TotalStripeCount)
+		}
+		if marker.StripeIndex < 0 || marker.StripeIndex >= marker.TotalStripeCount {
+			c.Errorf("Stripe index %d out of range (%d stripes)", marker.StripeIndex, marker.TotalStripeCount)
+		}
+		if marker.StripeBytesTransferred < transferred[marker.StripeIndex] {
+			c.Errorf("The transferred bytes of stripe %d went backwards", marker.StripeIndex)
+		}
+		if marker.StripeBytesTransferred > int64(len(s.content)) {
+			c.Errorf("More bytes transferred (%d) than the file size", marker.StripeBytesTransferred)
+		}
+		transferred[marker.StripeIndex] = marker.StripeBytesTransferred
+	}
+	c.Logf("Got %d performance markers", count)
+	if count == 0 {
+		c.Log("No performance marker has been sent, the format could not be checked")
+	}
+}
+
+// TestFinalLine checks the body ends with a success line, or a failure line if the copy fails
+func (s *CopyTestSuite) TestFinalLine(c *check.C) {
+	resp, body := s.rawCopy(c, s.source)
+	if resp.StatusCode != http.StatusAccepted {
+		c.Fatal("Expecting a 202, got ", resp.Status)
+	}
+	if last := lastLine(body); !strings.HasPrefix(strings.ToLower(last), "success:") {
+		c.Error("Expecting a final success line, got: ", last)
+	}
+
+	resp, body = s.rawCopy(c, joinURL(s.srcBase, "litmus-copy-missing"))
+	switch {
+	case resp.StatusCode == http.StatusAccepted:
+		if last := lastLine(body); !strings.HasPrefix(strings.ToLower(last), "failure:") {
+			c.Error("Expecting a final failure line, got: ", last)
+		}
+	case resp.StatusCode/100 == 2:
+		c.Error("Expecting a failure, got ", resp.Status)
+	default:
+		c.Log("The copy of a missing file has been rejected upfront: ", resp.Status)
+	}
+}
+
+// compareDigests compares the checksums of the source and the destination
+// It skips the test if the endpoints do not have an algorithm in common.
+func (s *CopyTestSuite) compareDigests(c *check.C, source string) {
+	srcDigests, e := s.digests(source)
+	if e != nil {
+		c.Fatal(e)
+	}
+	dstDigests, e := s.digests(s.destination)
+	if e != nil {
+		c.Fatal(e)
+	}
+
+	compared := 0
+	for algorithm, srcDigest := range srcDigests {
+		dstDigest, ok := dstDigests[algorithm]
+		if !ok {
+			continue
+		}
+		compared++
+		// adler32 is hexadecimal, so the case does not matter
+		if algorithm == "adler32" && strings.EqualFold(srcDigest, dstDigest) || srcDigest == dstDigest {
+			c.Logf("%s matches: %s", algorithm, srcDigest)
+		} else {
+			c.Errorf("%s mismatch: %s on the source, %s on the destination", algorithm, srcDigest, dstDigest)
+		}
+	}
+	if compared == 0 {
+		c.Skip("The endpoints do not send a common checksum on Want-Digest")
+	}
+}
+
+// TestChecksum compares the checksums of both ends after the copy
+func (s *CopyTestSuite) TestChecksum(c *check.C) {
+	if e := s.copy(http3rd.PullMode, nil, s.source, s.destination); e != nil {
+		c.Fatal(e)
+	}
+	s.compareDigests(c, s.source)
+}
+
+// TestLargeFile copies a large file, and compares the size and checksums
+func (s *CopyTestSuite) TestLargeFile(c *check.C) {
+	seed := time.Now().UnixNano()
+	start := time.Now()
+	e := s.upload(s.largeSource, s.largeSize, func() io.Reader {
+		return randomBody(seed, s.largeSize)
+	})
+	if e != nil {
+		c.Fatal(e)
+	}
+	c.Logf("Uploaded %d bytes in %s", s.largeSize, time.Since(start))
+
+	start = time.Now()
+	if e = s.copy(s.params.Mode, nil, s.largeSource, s.destination); e != nil {
+		var failed *http3rd.TransferFailedError
+		if errors.As(e, &failed) && failed.LastMarker != nil {
+			c.Logf("Failed after %d bytes", failed.LastMarker.StripeBytesTransferred)
+		}
+		c.Fatal(e)
+	}
+	c.Logf("Copied in %s", time.Since(start))
+
+	size, e := s.size(s.destination)
+	if e != nil {
+		c.Fatal(e)
+	}
+	if size != s.largeSize {
+		c.Errorf("Expecting %d bytes, got %d", s.largeSize, size)
+	}
+	s.compareDigests(c, s.largeSource)
+}
+
+// Run the third party copy test suite
+var copyTestCmd = &cobra.Command{
+	Use:   "copy",
+	Short: "Check the third party copy behaviour of a pair of endpoints",
+	Run: func(cmd *cobra.Command, args []string) {
+		copySourceURL = mockBaseURL(copySourceURL)
+		copyDestinationURL = mockPeerURL(copyDestinationURL)
+		if copySourceURL == "" || copyDestinationURL == "" {
+			logrus.Fatal("--src-url and --dst-url are required")
+		}
+
+		csuite, e := newCopyTestSuite(context.Background(), &params, copySourceURL, copyDestinationURL, copyLargeSize)
+		if e != nil {
+			logrus.Fatal(e)
+		}
+		runCommandSuite("CopyTestSuite", csuite)
+	},
+}
+
+func init() {
+	testCmd.AddCommand(copyTestCmd)
+	flags := copyTestCmd.Flags()
+	flags.StringVar(&copySourceURL, "src-url", "", "Base URL of the source for the tests")
+	flags.StringVar(&copyDestinationURL, "dst-url", "", "Base URL of the destination for the tests")
+	flags.Int64Var(&copyLargeSize, "large-size", 100*1024*1024, "Size, in bytes, of the file used by TestLargeFile")
+	flags.StringVar(&filter, "filter", "", "Filter tests")
+}
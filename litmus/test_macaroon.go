@@ -1,8 +1,7 @@
 package main
 
 import (
-	"encoding/base64"
-	"fmt"
+	"context"
 	"github.com/ayllon/http3rd"
 	"github.com/go-macaroon/macaroon"
 	"github.com/sirupsen/logrus"
@@ -21,32 +20,9 @@ var (
 	filter  = ""
 )
 
-// DecodeMacaroon returns a macaroon.M from the Base64 representation pased as a parameter
-func DecodeMacaroon(encoded string) (*macaroon.Macaroon, error) {
-	decoded := make([]byte, base64.RawURLEncoding.DecodedLen(len(encoded)))
-	_, e := base64.RawURLEncoding.Decode(decoded, []byte(encoded))
-	if e != nil {
-		return nil, fmt.Errorf("Could not base64-decode: %s", e)
-	}
-	M := &macaroon.Macaroon{}
-	e = M.UnmarshalBinary(decoded)
-	return M, e
-}
-
-// EncodeMacaroon returns a serialized base64 macaroon
-func EncodeMacaroon(M *macaroon.Macaroon) (string, error) {
-	token, e := M.MarshalBinary()
-	if e != nil {
-		return "", e
-	}
-	token64 := make([]byte, base64.RawURLEncoding.EncodedLen(len(token)))
-	base64.RawURLEncoding.Encode(token64, token)
-	return string(token64), e
-}
-
 // TryDownload tries to download a file (without actually doing so)
 // Returns the HTTP status code, or an error if can't even try
-func TryDownload(client *http.Client, uri, token string) (int, error) {
+func TryDownload(ctx context.Context, client *http.Client, uri, token string) (int, error) {
 	getReq := &http.Request{
 		Method: "GET",
 		Header: make(http.Header),
@@ -54,7 +30,7 @@ func TryDownload(client *http.Client, uri, token string) (int, error) {
 	getReq.Header.Add("Authorization", "BEARER "+token)
 	getReq.URL, _ = url.Parse(uri)
 
-	resp, err := client.Do(getReq)
+	resp, err := client.Do(getReq.WithContext(ctx))
 	if err != nil {
 		return 0, err
 	}
@@ -63,8 +39,24 @@ func TryDownload(client *http.Client, uri, token string) (int, error) {
 	return resp.StatusCode, nil
 }
 
+// contextTransport sends the requests with the context, for the clients that do not take one
+// (i.e. gowebdav)
+type contextTransport struct {
+	ctx       context.Context
+	transport http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *contextTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return t.transport.RoundTrip(r.WithContext(t.ctx))
+}
+
 // Macaroon test suite
 type MacaroonTestSuite struct {
+	// ctx aborts the requests of the suite once done (i.e. when the site times out)
+	ctx context.Context
+	// Base URL for the tests
+	baseURL string
 	// It has X509 client credentials setup. Used to obtain macaroons, and test setup.
 	x509client *http.Client
 	// Does not have x509 credentials setup, so things can only work if the token is proper.
@@ -78,10 +70,37 @@ type MacaroonTestSuite struct {
 	upUrl string
 }
 
+// newMacaroonTestSuite returns the suite for the base URL
+// The clients are built from params, with and without the X509 credentials.
+func newMacaroonTestSuite(ctx context.Context, params *http3rd.Params, baseURL string) (*MacaroonTestSuite, error) {
+	x509client, e := http3rd.BuildHttpClient(params)
+	if e != nil {
+		return nil, e
+	}
+	logrus.Debug("Created HTTP x509client")
+
+	client, e := http3rd.BuildHttpClient(&http3rd.Params{
+		Insecure:   params.Insecure,
+		CAPath:     params.CAPath,
+		Revocation: params.Revocation,
+		Redirect:   params.Redirect,
+	})
+	if e != nil {
+		return nil, e
+	}
+
+	return &MacaroonTestSuite{
+		ctx:        ctx,
+		baseURL:    baseURL,
+		x509client: x509client,
+		client:     client,
+	}, nil
+}
+
 // NewDavClient creates a new initialized DAV client
 func (s *MacaroonTestSuite) NewDavClient(token string) *gowebdav.Client {
-	dav := gowebdav.NewClient(baseURL, "", "")
-	dav.SetTransport(s.client.Transport)
+	dav := gowebdav.NewClient(s.baseURL, "", "")
+	dav.SetTransport(&contextTransport{ctx: s.ctx, transport: s.client.Transport})
 	if token != "" {
 		dav.SetHeader("Authorization", "BEARER "+token)
 	}
@@ -90,8 +109,8 @@ func (s *MacaroonTestSuite) NewDavClient(token string) *gowebdav.Client {
 
 // SetUpSuite looks for a file that can be used to test the downloading
 func (s *MacaroonTestSuite) SetUpSuite(c *check.C) {
-	dav := gowebdav.NewClient(baseURL, "", "")
-	dav.SetTransport(s.x509client.Transport)
+	dav := gowebdav.NewClient(s.baseURL, "", "")
+	dav.SetTransport(&contextTransport{ctx: s.ctx, transport: s.x509client.Transport})
 	files, e := dav.ReadDir("/")
 	if e != nil {
 		c.Fatal(e)
@@ -107,22 +126,22 @@ func (s *MacaroonTestSuite) SetUpSuite(c *check.C) {
 		c.Fatal("Could not find a file to use")
 	}
 
-	p, _ := url.Parse(baseURL)
+	p, _ := url.Parse(s.baseURL)
 	s.path = p.Path
 
-	if baseURL[len(baseURL)-1] != '/' {
-		s.fileURL = baseURL + "/" + s.file
-		s.upUrl = baseURL + "/macaroon-test-upload"
+	if s.baseURL[len(s.baseURL)-1] != '/' {
+		s.fileURL = s.baseURL + "/" + s.file
+		s.upUrl = s.baseURL + "/macaroon-test-upload"
 	} else {
-		s.fileURL = baseURL + s.file
-		s.upUrl = baseURL + "macaroon-test-upload"
+		s.fileURL = s.baseURL + s.file
+		s.upUrl = s.baseURL + "macaroon-test-upload"
 	}
 }
 
 // SetUpTest does a bit of cleaning up per test
 func (s *MacaroonTestSuite) SetUpTest(c *check.C) {
-	dav := gowebdav.NewClient(baseURL, "", "")
-	dav.SetTransport(s.x509client.Transport)
+	dav := gowebdav.NewClient(s.baseURL, "", "")
+	dav.SetTransport(&contextTransport{ctx: s.ctx, transport: s.x509client.Transport})
 	e := dav.Remove("macaroon-test-upload")
 	if e != nil {
 		c.Fatal(e)
@@ -132,35 +151,35 @@ func (s *MacaroonTestSuite) SetUpTest(c *check.C) {
 // TestPlainRequest asks for a Macaroon and checks it can be deserialized, that's all
 func (s *MacaroonTestSuite) TestPlainRequest(c *check.C) {
 	req := &http3rd.MacaroonRequest{
-		Resource:   baseURL,
+		Resource:   s.baseURL,
 		Activities: []string{http3rd.List},
 		Lifetime:   time.Minute,
 	}
-	resp, err := http3rd.GetMacaroon(s.x509client, req)
+	resp, err := http3rd.GetMacaroonContext(s.ctx, s.x509client, req)
 	if err != nil {
 		c.Fatal(err)
 	}
 
-	M, e := DecodeMacaroon(resp.Macaroon)
+	M, e := http3rd.DecodeMacaroon(resp.Macaroon)
 	if e != nil {
 		c.Fatal(e)
 	}
 
 	c.Log("Decoded with ID ", M.Id())
 
-	for _, caveat := range M.Caveats() {
-		c.Log("Caveat: ", caveat.Id)
+	for _, caveat := range M.RawCaveats() {
+		c.Log("Caveat: ", caveat)
 	}
 }
 
 // TestNoCertRequest asks for a Macaroon using the client without certificates
 func (s *MacaroonTestSuite) TestNoCertRequest(c *check.C) {
 	req := &http3rd.MacaroonRequest{
-		Resource:   baseURL,
+		Resource:   s.baseURL,
 		Activities: []string{http3rd.List},
 		Lifetime:   time.Minute,
 	}
-	_, e := http3rd.GetMacaroon(s.client, req)
+	_, e := http3rd.GetMacaroonContext(s.ctx, s.client, req)
 	if e == nil {
 		c.Error("The request should have failed")
 	}
@@ -178,11 +197,11 @@ func (s *MacaroonTestSuite) TestAccessNoMacaroon(c *check.C) {
 // TestAccess asks for a token, and does a listing, which should work
 func (s *MacaroonTestSuite) TestAccess(c *check.C) {
 	req := &http3rd.MacaroonRequest{
-		Resource:   baseURL,
+		Resource:   s.baseURL,
 		Activities: []string{http3rd.List},
 		Lifetime:   time.Minute,
 	}
-	m, e := http3rd.GetMacaroon(s.x509client, req)
+	m, e := http3rd.GetMacaroonContext(s.ctx, s.x509client, req)
 	if e != nil {
 		c.Fatal(e)
 	}
@@ -215,12 +234,12 @@ func (s *MacaroonTestSuite) TestMadeupMacaroon(c *check.C) {
 	M.AddFirstPartyCaveat("activity:LIST")
 	M.AddFirstPartyCaveat("path:" + s.path)
 
-	token, e := EncodeMacaroon(M)
+	token, e := http3rd.WrapMacaroon(M).Encode()
 	if e != nil {
 		c.Fatal(e)
 	}
 
-	dav := s.NewDavClient(string(token))
+	dav := s.NewDavClient(token)
 	_, e = dav.ReadDir("/")
 	if e == nil {
 		c.Fatal("Expecting an error")
@@ -230,17 +249,17 @@ func (s *MacaroonTestSuite) TestMadeupMacaroon(c *check.C) {
 // TestBadResource asks for a Macaroon, and uses it for a different URL
 func (s *MacaroonTestSuite) TestBadResource(c *check.C) {
 	req := &http3rd.MacaroonRequest{
-		Resource:   baseURL,
+		Resource:   s.baseURL,
 		Activities: []string{http3rd.List},
 		Lifetime:   time.Minute,
 	}
-	m, e := http3rd.GetMacaroon(s.x509client, req)
+	m, e := http3rd.GetMacaroonContext(s.ctx, s.x509client, req)
 	if e != nil {
 		c.Fatal(e)
 	}
 
 	// Download is not fine
-	code, e := TryDownload(s.client, s.fileURL, m.Macaroon)
+	code, e := TryDownload(s.ctx, s.client, s.fileURL, m.Macaroon)
 	if e != nil {
 		c.Fatal(e)
 	}
@@ -252,28 +271,31 @@ func (s *MacaroonTestSuite) TestBadResource(c *check.C) {
 // TestAskBogusCaveat tries to fool the remote endpoint trying to override a caveat
 func (s *MacaroonTestSuite) TestAskBogusCaveat(c *check.C) {
 	req := &http3rd.MacaroonRequest{
-		Resource:   baseURL,
+		Resource:   s.baseURL,
 		Activities: []string{http3rd.List},
 		Lifetime:   time.Minute,
 	}
-	m, e := http3rd.GetMacaroon(s.x509client, req)
+	m, e := http3rd.GetMacaroonContext(s.ctx, s.x509client, req)
 	if e != nil {
 		c.Fatal(e)
 	}
 
-	M, e := DecodeMacaroon(m.Macaroon)
+	M, e := http3rd.DecodeMacaroon(m.Macaroon)
 	if e != nil {
 		c.Fatal(e)
 	}
 
-	M.AddFirstPartyCaveat("path:" + path.Join(s.path, s.file))
+	e = M.AddCaveat(http3rd.PathCaveat(path.Join(s.path, s.file)))
+	if e != nil {
+		c.Fatal(e)
+	}
 
-	token, e := EncodeMacaroon(M)
+	token, e := M.Encode()
 	if e != nil {
 		c.Fatal(e)
 	}
 
-	dav := s.NewDavClient(string(token))
+	dav := s.NewDavClient(token)
 	_, e = dav.Stat("/" + s.file)
 	if e == nil {
 		c.Error("Expecting an error")
@@ -283,11 +305,11 @@ func (s *MacaroonTestSuite) TestAskBogusCaveat(c *check.C) {
 // TestExpired asks for a token, sleeps a bit, trys to perform the action
 func (s *MacaroonTestSuite) TestExpired(c *check.C) {
 	req := &http3rd.MacaroonRequest{
-		Resource:   baseURL,
+		Resource:   s.baseURL,
 		Activities: []string{http3rd.List},
 		Lifetime:   2 * time.Second,
 	}
-	m, e := http3rd.GetMacaroon(s.x509client, req)
+	m, e := http3rd.GetMacaroonContext(s.ctx, s.x509client, req)
 	if e != nil {
 		c.Fatal(e)
 	}
@@ -311,24 +333,26 @@ func (s *MacaroonTestSuite) TestExpired(c *check.C) {
 // Reducing lifetime is acceptable
 func (s *MacaroonTestSuite) TestExpiredReduce(c *check.C) {
 	req := &http3rd.MacaroonRequest{
-		Resource:   baseURL,
+		Resource:   s.baseURL,
 		Activities: []string{http3rd.List},
 		Lifetime:   time.Minute,
 	}
-	m, e := http3rd.GetMacaroon(s.x509client, req)
+	m, e := http3rd.GetMacaroonContext(s.ctx, s.x509client, req)
 	if e != nil {
 		c.Fatal(e)
 	}
 
-	M, e := DecodeMacaroon(m.Macaroon)
+	M, e := http3rd.DecodeMacaroon(m.Macaroon)
 	if e != nil {
 		c.Fatal(e)
 	}
 
-	before := time.Now().Add(time.Second).UTC()
-	M.AddFirstPartyCaveat(fmt.Sprint("before:", before.Format(time.RFC3339)))
+	e = M.RestrictLifetime(time.Second)
+	if e != nil {
+		c.Fatal(e)
+	}
 
-	token, e := EncodeMacaroon(M)
+	token, e := M.Encode()
 	if e != nil {
 		c.Fatal(e)
 	}
@@ -345,24 +369,27 @@ func (s *MacaroonTestSuite) TestExpiredReduce(c *check.C) {
 // TestExpiredIncrease tries to increase the token lifetime, which isn't acceptable
 func (s *MacaroonTestSuite) TestExpiredIncrease(c *check.C) {
 	req := &http3rd.MacaroonRequest{
-		Resource:   baseURL,
+		Resource:   s.baseURL,
 		Activities: []string{http3rd.List},
 		Lifetime:   time.Second,
 	}
-	m, e := http3rd.GetMacaroon(s.x509client, req)
+	m, e := http3rd.GetMacaroonContext(s.ctx, s.x509client, req)
 	if e != nil {
 		c.Fatal(e)
 	}
 
-	M, e := DecodeMacaroon(m.Macaroon)
+	M, e := http3rd.DecodeMacaroon(m.Macaroon)
 	if e != nil {
 		c.Fatal(e)
 	}
 
-	before := time.Now().Add(time.Hour).UTC()
-	M.AddFirstPartyCaveat(fmt.Sprint("before:", before.Format(time.RFC3339)))
+	// AddCaveat does not prevent this, unlike RestrictBefore
+	e = M.AddCaveat(http3rd.BeforeCaveat(time.Now().Add(time.Hour)))
+	if e != nil {
+		c.Fatal(e)
+	}
 
-	token, e := EncodeMacaroon(M)
+	token, e := M.Encode()
 	if e != nil {
 		c.Fatal(e)
 	}
@@ -383,7 +410,7 @@ func (s *MacaroonTestSuite) TestInvalidActivity(c *check.C) {
 		Activities: []string{http3rd.List},
 		Lifetime:   time.Minute,
 	}
-	m, e := http3rd.GetMacaroon(s.x509client, req)
+	m, e := http3rd.GetMacaroonContext(s.ctx, s.x509client, req)
 	if e != nil {
 		c.Fatal(e)
 	}
@@ -397,7 +424,7 @@ func (s *MacaroonTestSuite) TestInvalidActivity(c *check.C) {
 	}
 
 	// Download is not fine
-	code, e := TryDownload(s.client, s.fileURL, m.Macaroon)
+	code, e := TryDownload(s.ctx, s.client, s.fileURL, m.Macaroon)
 	if e != nil {
 		c.Fatal(e)
 	}
@@ -414,19 +441,22 @@ func (s *MacaroonTestSuite) TestReduceActivity(c *check.C) {
 		Activities: []string{http3rd.List, http3rd.Download},
 		Lifetime:   time.Minute,
 	}
-	m, e := http3rd.GetMacaroon(s.x509client, req)
+	m, e := http3rd.GetMacaroonContext(s.ctx, s.x509client, req)
 	if e != nil {
 		c.Fatal(e)
 	}
 
-	M, e := DecodeMacaroon(m.Macaroon)
+	M, e := http3rd.DecodeMacaroon(m.Macaroon)
 	if e != nil {
 		c.Fatal(e)
 	}
 
-	M.AddFirstPartyCaveat("activity:LIST")
+	e = M.RestrictActivities(http3rd.List)
+	if e != nil {
+		c.Fatal(e)
+	}
 
-	token, e := EncodeMacaroon(M)
+	token, e := M.Encode()
 	if e != nil {
 		c.Fatal(e)
 	}
@@ -440,7 +470,7 @@ func (s *MacaroonTestSuite) TestReduceActivity(c *check.C) {
 	}
 
 	// Download is not fine
-	code, e := TryDownload(s.client, s.fileURL, token)
+	code, e := TryDownload(s.ctx, s.client, s.fileURL, token)
 	if e != nil {
 		c.Fatal(e)
 	}
@@ -456,19 +486,23 @@ func (s *MacaroonTestSuite) TestIncreaseActivity(c *check.C) {
 		Activities: []string{http3rd.List},
 		Lifetime:   time.Minute,
 	}
-	m, e := http3rd.GetMacaroon(s.x509client, req)
+	m, e := http3rd.GetMacaroonContext(s.ctx, s.x509client, req)
 	if e != nil {
 		c.Fatal(e)
 	}
 
-	M, e := DecodeMacaroon(m.Macaroon)
+	M, e := http3rd.DecodeMacaroon(m.Macaroon)
 	if e != nil {
 		c.Fatal(e)
 	}
 
-	M.AddFirstPartyCaveat("activity:LIST,DOWNLOAD")
+	// AddCaveat does not prevent this, unlike RestrictActivities
+	e = M.AddCaveat(http3rd.ActivityCaveat(http3rd.List, http3rd.Download))
+	if e != nil {
+		c.Fatal(e)
+	}
 
-	token, e := EncodeMacaroon(M)
+	token, e := M.Encode()
 	if e != nil {
 		c.Fatal(e)
 	}
@@ -482,7 +516,7 @@ func (s *MacaroonTestSuite) TestIncreaseActivity(c *check.C) {
 	}
 
 	// Download is not fine
-	code, e := TryDownload(s.client, s.fileURL, m.Macaroon)
+	code, e := TryDownload(s.ctx, s.client, s.fileURL, m.Macaroon)
 	if e != nil {
 		c.Fatal(e)
 	}
@@ -498,7 +532,7 @@ func (s *MacaroonTestSuite) TestDownloadAndStat(c *check.C) {
 		Activities: []string{http3rd.List, http3rd.Download},
 		Lifetime:   time.Minute,
 	}
-	m, e := http3rd.GetMacaroon(s.x509client, req)
+	m, e := http3rd.GetMacaroonContext(s.ctx, s.x509client, req)
 	if e != nil {
 		c.Fatal(e)
 	}
@@ -512,7 +546,7 @@ func (s *MacaroonTestSuite) TestDownloadAndStat(c *check.C) {
 	}
 
 	// Download is not fine
-	code, e := TryDownload(s.client, s.fileURL, m.Macaroon)
+	code, e := TryDownload(s.ctx, s.client, s.fileURL, m.Macaroon)
 	if e != nil {
 		c.Fatal(e)
 	}
@@ -528,7 +562,7 @@ func (s *MacaroonTestSuite) TestUpload(c *check.C) {
 		Activities: []string{http3rd.Upload},
 		Lifetime:   time.Minute * 2,
 	}
-	m, e := http3rd.GetMacaroon(s.x509client, req)
+	m, e := http3rd.GetMacaroonContext(s.ctx, s.x509client, req)
 	if e != nil {
 		c.Fatal(e)
 	}
@@ -553,7 +587,7 @@ func (s *MacaroonTestSuite) TestUpload(c *check.C) {
 		c.Fatal(e)
 	}
 
-	resp, e := http3rd.DoWithRedirect(s.client, putReq)
+	resp, e := http3rd.DoWithRedirectContext(s.ctx, s.client, putReq)
 	if e != nil {
 		c.Fatal(e)
 	}
@@ -568,47 +602,31 @@ func (s *MacaroonTestSuite) TestUpload(c *check.C) {
 var macaroonTestCmd = &cobra.Command{
 	Use: "macaroon",
 	Run: func(cmd *cobra.Command, args []string) {
-		x509client, e := http3rd.BuildHttpClient(&params)
-		if e != nil {
-			logrus.Fatal(e)
-		}
-		logrus.Debug("Created HTTP x509client")
+		baseURL = mockBaseURL(baseURL)
 
-		client, e := http3rd.BuildHttpClient(&http3rd.Params{
-			Insecure: params.Insecure,
-			CAPath:   params.CAPath,
-		})
+		msuite, e := newMacaroonTestSuite(context.Background(), &params, baseURL)
 		if e != nil {
 			logrus.Fatal(e)
 		}
-
-		msuite := &MacaroonTestSuite{
-			x509client: x509client,
-			client:     client,
-			file:       "",
-		}
-
-		suite := check.Suite(msuite)
-		conf := &check.RunConf{
-			Verbose: true,
-			Filter:  filter,
-		}
-		result := check.Run(suite, conf)
-
-		logrus.Info("Success: ", result.Succeeded)
-		logrus.Info("Skipped: ", result.Skipped)
-		if result.Failed > 0 {
-			logrus.Warn("Failed: ", result.Failed)
-		}
-		if result.Missed > 0 {
-			logrus.Warn("Missed: ", result.Missed)
-		}
-		if result.Panicked > 0 {
-			logrus.Error("Panicked: ", result.Panicked)
-		}
+		runCommandSuite("MacaroonTestSuite", msuite)
 	},
 }
 
+// logResult logs the counts of a test suite run
+func logResult(result *check.Result) {
+	logrus.Info("Success: ", result.Succeeded)
+	logrus.Info("Skipped: ", result.Skipped)
+	if result.Failed > 0 {
+		logrus.Warn("Failed: ", result.Failed)
+	}
+	if result.Missed > 0 {
+		logrus.Warn("Missed: ", result.Missed)
+	}
+	if result.Panicked > 0 {
+		logrus.Error("Panicked: ", result.Panicked)
+	}
+}
+
 func init() {
 	testCmd.AddCommand(macaroonTestCmd)
 	flags := macaroonTestCmd.Flags()
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"github.com/ayllon/http3rd"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"gopkg.in/check.v1"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+var (
+	tokenTestURL       = ""
+	tokenTestOAuth2    = oauth2Flags{}
+	tokenTestProvider  = endpointFlags{oauth2: &tokenTestOAuth2}
+	tokenTestExpiry    = 5 * time.Second
+	tokenTestRevokeCmd = ""
+)
+
+const (
+	// tokenTestLifetime is the lifetime of the tokens, except for TestExpiry
+	tokenTestLifetime = 5 * time.Minute
+	// tokenTestSize is the size of the files used by the tests
+	tokenTestSize = 4096
+	// tokenTestClockSkew is waited after the expiration, in case the clocks differ
+	tokenTestClockSkew = 2 * time.Second
+)
+
+// Opaque token test suite
+// The tokens are never decoded nor modified, only the behaviour of the storage is
+// checked, so any TokenProvider can be used (macaroons, JWTs, ...).
+type TokenTestSuite struct {
+	// ctx aborts the requests of the suite once done (i.e. when the site times out)
+	ctx context.Context
+	// Base URL for the tests
+	baseURL string
+	// Issues the tokens
+	provider http3rd.TokenProvider
+	// scoped is false if the provider returns the same token for any request (i.e. static)
+	scoped bool
+	// Does not have x509 credentials setup, so things can only work if the token is proper.
+	client   *http.Client
+	redirect *http3rd.RedirectPolicy
+	// Lifetime of the token used by TestExpiry
+	expiry time.Duration
+	// Command that revokes the token passed in HTTP3RD_TOKEN
+	revokeCmd []string
+	// File uploaded by the suite, and its content
+	fileURL string
+	content []byte
+	// siblingURL is another file, whose name starts with the name of fileURL
+	siblingURL string
+	// For upload
+	upURL string
+}
+
+// newTokenTestSuite returns the suite for the base URL
+// If provider is nil, macaroons are negotiated with the X509 credentials of params.
+func newTokenTestSuite(ctx context.Context, params *http3rd.Params, baseURL string, provider http3rd.TokenProvider, expiry time.Duration, revokeCmd string) (*TokenTestSuite, error) {
+	if provider == nil {
+		x509client, e := http3rd.BuildHttpClient(params)
+		if e != nil {
+			return nil, e
+		}
+		provider = &http3rd.MacaroonProvider{Client: x509client, Expiry: params.MacaroonExpiry}
+	}
+
+	client, e := http3rd.BuildHttpClient(&http3rd.Params{
+		Insecure:   params.Insecure,
+		CAPath:     params.CAPath,
+		Revocation: params.Revocation,
+		Redirect:   params.Redirect,
+	})
+	if e != nil {
+		return nil, e
+	}
+
+	scoped := true
+	switch provider.(type) {
+	case http3rd.StaticToken, *http3rd.FileToken:
+		scoped = false
+	}
+
+	return &TokenTestSuite{
+		ctx:        ctx,
+		baseURL:    baseURL,
+		provider:   provider,
+		scoped:     scoped,
+		client:     client,
+		redirect:   params.Redirect,
+		expiry:     expiry,
+		revokeCmd:  strings.Fields(revokeCmd),
+		fileURL:    joinURL(baseURL, "litmus-token-test"),
+		siblingURL: joinURL(baseURL, "litmus-token-test-sibling"),
+		upURL:      joinURL(baseURL, "litmus-token-upload"),
+	}, nil
+}
+
+// token asks the provider for a token
+func (s *TokenTestSuite) token(c *check.C, uri string, lifetime time.Duration, activities ...string) string {
+	token, e := s.provider.Token(s.ctx, uri, activities, lifetime)
+	if e != nil {
+		c.Fatal(e)
+	}
+	return token
+}
+
+// requireScoped skips the test if the provider can not issue a token for a given request
+func (s *TokenTestSuite) requireScoped(c *check.C) {
+	if !s.scoped {
+		c.Skip("The provider returns the same token for any request")
+	}
+}
+
+// send sends the request with the token, following the redirects
+func (s *TokenTestSuite) send(method, uri, token string, body []byte) (*http.Response, error) {
+	req, e := http.NewRequest(method, uri, nil)
+	if e != nil {
+		return nil, e
+	}
+	if body != nil {
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+		req.ContentLength = int64(len(body))
+	}
+	if token != "" {
+		req.Header.Add("Authorization", "BEARER "+token)
+	}
+	if method == "PROPFIND" {
+		req.Header.Set("Depth", "1")
+	}
+	return s.redirect.Do(s.ctx, s.client, req)
+}
+
+// status sends the request, and returns the status code of the response
+func (s *TokenTestSuite) status(c *check.C, method, uri, token string, body []byte) int {
+	resp, e := s.send(method, uri, token, body)
+	if e != nil {
+		c.Fatal(e)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// download returns the content of the URL
+func (s *TokenTestSuite) download(c *check.C, uri, token string) []byte {
+	resp, e := s.send("GET", uri, token, nil)
+	if e != nil {
+		c.Fatal(e)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.Fatal("Expecting a 200 for ", uri, ", got ", resp.StatusCode)
+	}
+	content, e := ioutil.ReadAll(resp.Body)
+	if e != nil {
+		c.Fatal(e)
+	}
+	return content
+}
+
+// upload puts the content into the URL, with an UPLOAD token
+func (s *TokenTestSuite) upload(c *check.C, uri string, content []byte) {
+	token := s.token(c, uri, tokenTestLifetime, http3rd.Upload)
+	if code := s.status(c, "PUT", uri, token, content); code/100 != 2 {
+		c.Fatal("Could not upload ", uri, ": ", code)
+	}
+}
+
+// remove deletes the URL with a DELETE token, if it exists
+func (s *TokenTestSuite) remove(uri string) error {
+	token, e := s.provider.Token(s.ctx, uri, []string{http3rd.Delete}, tokenTestLifetime)
+	if e != nil {
+		return e
+	}
+	resp, e := s.send("DELETE", uri, token, nil)
+	if e != nil {
+		return e
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("Could not remove %s: %s", uri, resp.Status)
+	}
+	return nil
+}
+
+// checkDenied expects the request to be refused because of the token
+func checkDenied(c *check.C, what string, code int) {
+	if code != http.StatusUnauthorized && code != http.StatusForbidden {
+		c.Error(what, ": expecting a 401 or 403, got ", code)
+	}
+}
+
+// checkInvalid expects the request to be refused because the token is malformed
+// 400 is accepted as well, since RFC 6750 allows it for malformed requests.
+func checkInvalid(c *check.C, what string, code int) {
+	if code != http.StatusBadRequest && code != http.StatusUnauthorized && code != http.StatusForbidden {
+		c.Error(what, ": expecting a 400, 401 or 403, got ", code)
+	}
+}
+
+// SetUpSuite uploads the files used by the tests
+func (s *TokenTestSuite) SetUpSuite(c *check.C) {
+	s.content = make([]byte, tokenTestSize)
+	if _, e := rand.Read(s.content); e != nil {
+		c.Fatal(e)
+	}
+	s.upload(c, s.fileURL, s.content)
+	s.upload(c, s.siblingURL, s.content)
+}
+
+// TearDownSuite removes the files created by the tests
+func (s *TokenTestSuite) TearDownSuite(c *check.C) {
+	for _, uri := range []string{s.fileURL, s.siblingURL, s.upURL} {
+		if e := s.remove(uri); e != nil {
+			c.Log(e)
+		}
+	}
+}
+
+// TestNoToken tries to download without a token
+func (s *TokenTestSuite) TestNoToken(c *check.C) {
+	checkDenied(c, "GET without token", s.status(c, "GET", s.fileURL, "", nil))
+}
+
+// TestDownload asks for a DOWNLOAD token, and uses it
+func (s *TokenTestSuite) TestDownload(c *check.C) {
+	token := s.token(c, s.fileURL, tokenTestLifetime, http3rd.Download)
+	if !bytes.Equal(s.download(c, s.fileURL, token), s.content) {
+		c.Error("The downloaded content does not match the uploaded one")
+	}
+}
+
+// TestUpload asks for an UPLOAD token, and uses it
+func (s *TokenTestSuite) TestUpload(c *check.C) {
+	token := s.token(c, s.upURL, tokenTestLifetime, http3rd.Upload)
+	code := s.status(c, "PUT", s.upURL, token, s.content)
+	if code != http.StatusCreated && code != http.StatusNoContent && code != http.StatusOK {
+		c.Fatal("Expecting a 201, got ", code)
+	}
+
+	token = s.token(c, s.upURL, tokenTestLifetime, http3rd.Download)
+	if !bytes.Equal(s.download(c, s.upURL, token), s.content) {
+		c.Error("The uploaded content does not match")
+	}
+}
+
+// TestActivityScope tries to modify a file with a DOWNLOAD token
+func (s *TokenTestSuite) TestActivityScope(c *check.C) {
+	s.requireScoped(c)
+	token := s.token(c, s.fileURL, tokenTestLifetime, http3rd.Download)
+
+	checkDenied(c, "PUT with a DOWNLOAD token", s.status(c, "PUT", s.fileURL, token, []byte("overwritten")))
+	checkDenied(c, "DELETE with a DOWNLOAD token", s.status(c, "DELETE", s.fileURL, token, nil))
+
+	if !bytes.Equal(s.download(c, s.fileURL, token), s.content) {
+		c.Error("The file has been modified")
+	}
+}
+
+// TestPathScope uses a token for a file with another one, whose name starts the same
+func (s *TokenTestSuite) TestPathScope(c *check.C) {
+	s.requireScoped(c)
+	token := s.token(c, s.fileURL, tokenTestLifetime, http3rd.Download)
+	checkDenied(c, "GET of a sibling file", s.status(c, "GET", s.siblingURL, token, nil))
+}
+
+// TestParentScope uses a token for a file to list its parent directory
+func (s *TokenTestSuite) TestParentScope(c *check.C) {
+	s.requireScoped(c)
+	token := s.token(c, s.fileURL, tokenTestLifetime, http3rd.List, http3rd.Download)
+	checkDenied(c, "PROPFIND of the parent directory", s.status(c, "PROPFIND", s.baseURL, token, nil))
+}
+
+// TestDirectoryScope uses a token for the base directory to download a file inside
+func (s *TokenTestSuite) TestDirectoryScope(c *check.C) {
+	token := s.token(c, s.baseURL, tokenTestLifetime, http3rd.Download)
+	if !bytes.Equal(s.download(c, s.fileURL, token), s.content) {
+		c.Error("The downloaded content does not match the uploaded one")
+	}
+}
+
+// TestExpiry asks for a short lived token, and uses it after it expires
+func (s *TokenTestSuite) TestExpiry(c *check.C) {
+	s.requireScoped(c)
+	token := s.token(c, s.fileURL, s.expiry, http3rd.Download)
+	expires := time.Now().Add(s.expiry)
+
+	if code := s.status(c, "GET", s.fileURL, token, nil); code != http.StatusOK {
+		c.Fatal("Expecting a 200 before the expiration, got ", code)
+	}
+
+	time.Sleep(time.Until(expires) + tokenTestClockSkew)
+	checkDenied(c, "GET with an expired token", s.status(c, "GET", s.fileURL, token, nil))
+}
+
+// TestRevocation revokes a token with --revoke-cmd, and uses it
+// A static token is not revoked, since the other tests use it as well.
+func (s *TokenTestSuite) TestRevocation(c *check.C) {
+	s.requireScoped(c)
+	if len(s.revokeCmd) == 0 {
+		c.Skip("No command to revoke the tokens")
+	}
+	token := s.token(c, s.fileURL, tokenTestLifetime, http3rd.Download)
+	if code := s.status(c, "GET", s.fileURL, token, nil); code != http.StatusOK {
+		c.Fatal("Expecting a 200 before the revocation, got ", code)
+	}
+
+	cmd := exec.Command(s.revokeCmd[0], s.revokeCmd[1:]...)
+	cmd.Env = append(os.Environ(), "HTTP3RD_TOKEN="+token, "HTTP3RD_RESOURCE="+s.fileURL)
+	if output, e := cmd.CombinedOutput(); e != nil {
+		c.Fatal("Revocation command failed: ", e, " (", strings.TrimSpace(string(output)), ")")
+	}
+
+	checkDenied(c, "GET with a revoked token", s.status(c, "GET", s.fileURL, token, nil))
+}
+
+// TestGarbage uses random data, some of it shaped as a JWT, as token
+func (s *TokenTestSuite) TestGarbage(c *check.C) {
+	random := func(size int) string {
+		data := make([]byte, size)
+		rand.Read(data)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	garbage := map[string]string{
+		"short": random(32),
+		"long":  random(2048),
+		"jwt":   random(36) + "." + random(120) + "." + random(32),
+		"dots":  "..",
+	}
+	for name, token := range garbage {
+		checkInvalid(c, "GET with "+name+" garbage", s.status(c, "GET", s.fileURL, token, nil))
+	}
+}
+
+// TestTruncated uses a valid token without its end
+func (s *TokenTestSuite) TestTruncated(c *check.C) {
+	token := s.token(c, s.fileURL, tokenTestLifetime, http3rd.Download)
+	for _, size := range []int{len(token) - 1, len(token) - 8, len(token) / 2} {
+		if size <= 0 {
+			continue
+		}
+		checkInvalid(c, fmt.Sprintf("GET with the token truncated at %d", size),
+			s.status(c, "GET", s.fileURL, token[:size], nil))
+	}
+}
+
+// TestCorrupted changes one character of a valid token, close to its end
+// where the signature usually is. The last characters are left alone, since with
+// base64 they may only carry padding bits.
+func (s *TokenTestSuite) TestCorrupted(c *check.C) {
+	token := s.token(c, s.fileURL, tokenTestLifetime, http3rd.Download)
+	if len(token) < 8 {
+		c.Skip("The token is too short")
+	}
+	corrupted := []byte(token)
+	i := len(corrupted) - 6
+	if corrupted[i] == 'A' {
+		corrupted[i] = 'B'
+	} else {
+		corrupted[i] = 'A'
+	}
+	checkInvalid(c, "GET with a corrupted token", s.status(c, "GET", s.fileURL, string(corrupted), nil))
+}
+
+// TestRedirect checks that the storage accepts the same token after redirecting
+// the request (i.e. to a disk node), for downloads and uploads
+// The token is used more than once, so single use tokens fail.
+func (s *TokenTestSuite) TestRedirect(c *check.C) {
+	redirected := false
+
+	token := s.token(c, s.fileURL, tokenTestLifetime, http3rd.Download)
+	for i := 0; i < 2; i++ {
+		resp, e := s.send("GET", s.fileURL, token, nil)
+		if e != nil {
+			c.Fatal(e)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			c.Fatal("Expecting a 200 for GET ", resp.Request.URL, ", got ", resp.StatusCode)
+		}
+		if resp.Request.URL.String() != s.fileURL {
+			c.Log("GET redirected to ", resp.Request.URL)
+			redirected = true
+		}
+	}
+
+	token = s.token(c, s.upURL, tokenTestLifetime, http3rd.Upload)
+	resp, e := s.send("PUT", s.upURL, token, s.content)
+	if e != nil {
+		c.Fatal(e)
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		c.Fatal("Expecting a 201 for PUT ", resp.Request.URL, ", got ", resp.StatusCode)
+	}
+	if resp.Request.URL.String() != s.upURL {
+		c.Log("PUT redirected to ", resp.Request.URL)
+		redirected = true
+	}
+
+	if !redirected {
+		c.Skip("The storage did not redirect the requests")
+	}
+}
+
+// Run the opaque token test suite
+var tokenTestCmd = &cobra.Command{
+	Use:   "token",
+	Short: "Test the handling of bearer tokens, without assuming their format",
+	Run: func(cmd *cobra.Command, args []string) {
+		tokenTestURL = mockBaseURL(tokenTestURL)
+
+		provider, e := tokenTestProvider.tokenProvider()
+		if e != nil {
+			logrus.Fatal(e)
+		}
+		tsuite, e := newTokenTestSuite(context.Background(), &params, tokenTestURL, provider, tokenTestExpiry, tokenTestRevokeCmd)
+		if e != nil {
+			logrus.Fatal(e)
+		}
+		runCommandSuite("TokenTestSuite", tsuite)
+	},
+}
+
+func init() {
+	testCmd.AddCommand(tokenTestCmd)
+	flags := tokenTestCmd.Flags()
+	flags.StringVar(&tokenTestURL, "url", "https://arioch.cern.ch/dpm/cern.ch/home/dteam/", "Base URL for the tests")
+	flags.StringVar(&filter, "filter", "", "Filter tests")
+	flags.StringVar(&tokenTestProvider.token, "token", "", "Pre-issued token (the scoping tests are skipped)")
+	flags.StringVar(&tokenTestProvider.tokenFile, "token-file", "", "File containing a pre-issued token (the scoping tests are skipped)")
+	flags.StringVar(&tokenTestProvider.tokenCmd, "token-cmd", "", "Command that prints a token")
+	flags.BoolVar(&tokenTestProvider.jwt, "jwt", false, "Get JWTs from the OAuth2 issuer")
+	flags.StringVar(&tokenTestProvider.jwtBasePath, "jwt-base-path", "", "Path the storage scopes are relative to")
+	tokenTestOAuth2.register(flags)
+	flags.DurationVar(&tokenTestExpiry, "expiry", 5*time.Second, "Lifetime of the token used by TestExpiry (set it to the one of the issuer if it can not be requested)")
+	flags.StringVar(&tokenTestRevokeCmd, "revoke-cmd", "", "Command that revokes the token given in HTTP3RD_TOKEN (TestRevocation is skipped if not set)")
+}
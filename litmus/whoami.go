@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ayllon/http3rd"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"time"
+)
+
+var whoamiCmd = &cobra.Command{
+	Use:   "whoami",
+	Short: "Print the identity, and the VOMS attributes, presented to the endpoints",
+	Run: func(cmd *cobra.Command, args []string) {
+		creds, e := http3rd.LoadCredentials(params.UserCert, params.UserKey)
+		if e != nil {
+			logrus.Fatal(e)
+		}
+
+		fmt.Printf("Subject:  %s\n", creds.Subject)
+		fmt.Printf("Identity: %s\n", creds.Identity)
+		if creds.Proxy {
+			fmt.Printf("Type:     proxy\n")
+		} else {
+			fmt.Printf("Type:     certificate\n")
+		}
+
+		remaining := time.Until(creds.NotAfter).Truncate(time.Second)
+		if remaining <= 0 {
+			fmt.Printf("Expiry:   %s (expired %s ago)\n", creds.NotAfter.Format(time.RFC3339), -remaining)
+		} else {
+			fmt.Printf("Expiry:   %s (%s left)\n", creds.NotAfter.Format(time.RFC3339), remaining)
+		}
+
+		if len(creds.VOMS) == 0 {
+			fmt.Printf("VOMS:     none\n")
+		}
+		for _, attr := range creds.VOMS {
+			status := ""
+			if time.Now().After(attr.NotAfter) {
+				status = " (expired)"
+			}
+			fmt.Printf("VOMS:     %s %s until %s%s\n", attr.VO, attr.FQAN, attr.NotAfter.Format(time.RFC3339), status)
+		}
+
+		if e = creds.Check(); e != nil {
+			logrus.Fatal(e)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(whoamiCmd)
+}
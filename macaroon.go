@@ -2,6 +2,7 @@ package http3rd
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/sirupsen/logrus"
@@ -21,18 +22,44 @@ const (
 	Manage   = "MANAGE"
 )
 
+// ExpiryMode selects how the lifetime of the macaroon is requested
+type ExpiryMode int
+
+const (
+	// ExpiryAuto sends both the validity field and a before caveat, so servers that ignore the
+	// field still issue a macaroon that expires. Only the caveat is sent if the field is rejected.
+	ExpiryAuto ExpiryMode = iota
+	// ExpiryBefore sends a "before:" caveat, computed with the local clock
+	ExpiryBefore
+	// ExpiryValidity sends the validity field (dCache style), so the server computes the expiration
+	// with its own clock, and clock skew does not matter
+	ExpiryValidity
+)
+
 type (
 	// jsonMacaroonRequest models a Macaroon request sent to the server
 	jsonMacaroonRequest struct {
 		// List of serialized caveats
 		Caveats []string `json:"caveats,omitempty"`
+		// ISO8601 duration
+		Validity string `json:"validity,omitempty"`
 	}
 
 	// MacaroonRequest wraps the supported request fields for a Grid SE Macaroon
 	MacaroonRequest struct {
-		Resource   string
-		Lifetime   time.Duration
+		Resource string
+		Lifetime time.Duration
+		// Activities allowed by the macaroon. If empty, no activity caveat is requested,
+		// and the storage decides.
 		Activities []string
+		// Before, if set, is the absolute expiration time, and Lifetime is ignored
+		Before time.Time
+		// Caveats are additional first party caveats (i.e. path or ip restrictions)
+		Caveats []Caveat
+		// Expiry selects how Lifetime is sent. An absolute Before is always sent as a caveat.
+		Expiry ExpiryMode
+		// Retry, if set, retries transient failures
+		Retry *RetryPolicy
 	}
 
 	// MacaroonResponse models the reply from the server
@@ -47,17 +74,57 @@ type (
 	}
 )
 
+// String returns the name of the expiry mode
+func (m ExpiryMode) String() string {
+	switch m {
+	case ExpiryAuto:
+		return "auto"
+	case ExpiryBefore:
+		return "before"
+	case ExpiryValidity:
+		return "validity"
+	}
+	return fmt.Sprintf("ExpiryMode(%d)", int(m))
+}
+
+// ParseExpiryMode returns the ExpiryMode matching the given name
+func ParseExpiryMode(name string) (ExpiryMode, error) {
+	switch strings.ToLower(name) {
+	case "auto":
+		return ExpiryAuto, nil
+	case "before":
+		return ExpiryBefore, nil
+	case "validity":
+		return ExpiryValidity, nil
+	}
+	return ExpiryAuto, fmt.Errorf("Unknown expiry mode: %s", name)
+}
+
 // buildHTTPRequest builds a Macaroon request
-func buildHTTPRequest(request *MacaroonRequest) (*http.Request, error) {
-	payload := &jsonMacaroonRequest{
-		Caveats: []string{
-			fmt.Sprint("activity:", strings.Join(request.Activities, ",")),
-		},
+func buildHTTPRequest(request *MacaroonRequest, mode ExpiryMode) (*http.Request, error) {
+	payload := &jsonMacaroonRequest{}
+
+	caveats := []Caveat{}
+	if len(request.Activities) > 0 {
+		caveats = append(caveats, ActivityCaveat(request.Activities...))
 	}
+	if !request.Before.IsZero() {
+		caveats = append(caveats, BeforeCaveat(request.Before))
+	} else if request.Lifetime > 0 {
+		if mode == ExpiryValidity || mode == ExpiryAuto {
+			payload.Validity = FormatISO8601Duration(request.Lifetime)
+		}
+		if mode == ExpiryBefore || mode == ExpiryAuto {
+			caveats = append(caveats, BeforeCaveat(time.Now().Add(request.Lifetime)))
+		}
+	}
+	caveats = append(caveats, request.Caveats...)
 
-	if request.Lifetime > 0 {
-		before := time.Now().Add(request.Lifetime).UTC()
-		payload.Caveats = append(payload.Caveats, fmt.Sprint("before:", before.Format(time.RFC3339)))
+	for _, caveat := range caveats {
+		if e := caveat.Validate(); e != nil {
+			return nil, e
+		}
+		payload.Caveats = append(payload.Caveats, caveat.String())
 	}
 
 	payloadData, e := json.Marshal(payload)
@@ -81,35 +148,80 @@ func buildHTTPRequest(request *MacaroonRequest) (*http.Request, error) {
 
 // GetMacaroon returns a token for the resource
 func GetMacaroon(client *http.Client, request *MacaroonRequest) (*MacaroonResponse, error) {
-	req, e := buildHTTPRequest(request)
+	return GetMacaroonContext(context.Background(), client, request)
+}
+
+// GetMacaroonContext returns a token for the resource
+// The request is aborted if the context is cancelled or expires, and retried
+// according to request.Retry
+func GetMacaroonContext(ctx context.Context, client *http.Client, request *MacaroonRequest) (*MacaroonResponse, error) {
+	var response *MacaroonResponse
+	e := request.Retry.Do(ctx, func() (e error) {
+		response, e = getMacaroonOnce(ctx, client, request)
+		return
+	})
+	return response, e
+}
+
+// getMacaroonOnce requests the macaroon, choosing how to send the lifetime
+func getMacaroonOnce(ctx context.Context, client *http.Client, request *MacaroonRequest) (*MacaroonResponse, error) {
+	if request.Expiry != ExpiryAuto || !request.Before.IsZero() || request.Lifetime <= 0 {
+		response, _, e := requestMacaroon(ctx, client, request, request.Expiry)
+		return response, e
+	}
+
+	response, status, e := requestMacaroon(ctx, client, request, ExpiryAuto)
+	if e != nil && (status == http.StatusBadRequest || status == http.StatusUnprocessableEntity) {
+		logrus.Debug("The validity field has been rejected, retry with a before caveat")
+		response, _, e = requestMacaroon(ctx, client, request, ExpiryBefore)
+	}
+	return response, e
+}
+
+// requestMacaroon sends the macaroon request, and returns the response status code as well
+func requestMacaroon(ctx context.Context, client *http.Client, request *MacaroonRequest, mode ExpiryMode) (*MacaroonResponse, int, error) {
+	req, e := buildHTTPRequest(request, mode)
 	if e != nil {
-		return nil, e
+		return nil, 0, e
 	}
+	req = req.WithContext(ctx)
 
 	reqRaw, e := httputil.DumpRequest(req, true)
 	if e != nil {
-		return nil, e
+		return nil, 0, e
 	}
 	logrus.Debug(string(reqRaw))
 
 	resp, e := client.Do(req)
 	if e != nil {
-		return nil, e
+		return nil, 0, e
 	}
+	defer resp.Body.Close()
 	logrus.Debug("Response status code: ", resp.StatusCode)
 
 	respBody, e := ioutil.ReadAll(resp.Body)
 	if e != nil {
-		return nil, e
+		return nil, resp.StatusCode, e
 	}
 
-	logrus.Debug("Response: ", string(respBody))
-
 	if resp.StatusCode/100 != 2 {
-		return nil, fmt.Errorf("Unexpected status code: %d", resp.StatusCode)
+		logrus.Debug("Response: ", string(respBody))
+		tokenErr := &TokenRequestError{
+			HTTPError: newHTTPError(request.Resource, resp, respBody),
+		}
+		switch resp.StatusCode {
+		case http.StatusMethodNotAllowed, http.StatusUnsupportedMediaType, http.StatusNotImplemented:
+			tokenErr.Err = ErrNoMacaroonSupport
+		}
+		return nil, resp.StatusCode, tokenErr
 	}
 
+	// The reply is the macaroon itself, which is not logged in clear
 	tokenResponse := &MacaroonResponse{}
-	e = json.Unmarshal(respBody, tokenResponse)
-	return tokenResponse, e
+	if e = json.Unmarshal(respBody, tokenResponse); e != nil {
+		logrus.Debug("Response: ", redactToken(string(respBody)))
+	} else {
+		logrus.Debug("Response: macaroon ", redactToken(tokenResponse.Macaroon))
+	}
+	return tokenResponse, resp.StatusCode, e
 }
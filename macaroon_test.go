@@ -0,0 +1,100 @@
+package http3rd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// macaroonRequests records the macaroon requests, and rejects the validity field if told so
+type macaroonRequests struct {
+	mutex          sync.Mutex
+	requests       []jsonMacaroonRequest
+	rejectValidity bool
+}
+
+// ServeHTTP implements http.Handler
+func (m *macaroonRequests) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	request := jsonMacaroonRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	m.mutex.Lock()
+	m.requests = append(m.requests, request)
+	m.mutex.Unlock()
+
+	if m.rejectValidity && request.Validity != "" {
+		http.Error(w, "Unknown field validity", http.StatusBadRequest)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"macaroon": "MDAxY2xvY2F0aW9u"})
+}
+
+// hasBefore returns true if the request carries a before caveat
+func hasBefore(request jsonMacaroonRequest) bool {
+	for _, caveat := range request.Caveats {
+		if strings.HasPrefix(caveat, "before:") {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMacaroonExpiryAuto(t *testing.T) {
+	handler := &macaroonRequests{}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	request := &MacaroonRequest{Resource: server.URL + "/file", Activities: []string{Download}, Lifetime: time.Minute}
+	if _, err := GetMacaroon(server.Client(), request); err != nil {
+		t.Fatal(err)
+	}
+	if len(handler.requests) != 1 {
+		t.Fatal("Expecting one request, got ", len(handler.requests))
+	}
+	// A server ignoring the validity field still gets the caveat
+	if handler.requests[0].Validity != "PT1M" || !hasBefore(handler.requests[0]) {
+		t.Error("Expecting both the validity and a before caveat, got ", handler.requests[0])
+	}
+}
+
+func TestMacaroonExpiryFallback(t *testing.T) {
+	handler := &macaroonRequests{rejectValidity: true}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	request := &MacaroonRequest{Resource: server.URL + "/file", Activities: []string{Download}, Lifetime: time.Minute}
+	if _, err := GetMacaroon(server.Client(), request); err != nil {
+		t.Fatal(err)
+	}
+	if len(handler.requests) != 2 {
+		t.Fatal("Expecting a second request, got ", len(handler.requests))
+	}
+	if handler.requests[1].Validity != "" || !hasBefore(handler.requests[1]) {
+		t.Error("Expecting only a before caveat, got ", handler.requests[1])
+	}
+}
+
+func TestMacaroonExpiryModes(t *testing.T) {
+	handler := &macaroonRequests{}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	for _, mode := range []ExpiryMode{ExpiryBefore, ExpiryValidity} {
+		request := &MacaroonRequest{Resource: server.URL, Activities: []string{List}, Lifetime: time.Hour, Expiry: mode}
+		if _, err := GetMacaroon(server.Client(), request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if before := handler.requests[0]; before.Validity != "" || !hasBefore(before) {
+		t.Error("Expecting only a before caveat, got ", before)
+	}
+	if validity := handler.requests[1]; validity.Validity != "PT1H" || hasBefore(validity) {
+		t.Error("Expecting only the validity, got ", validity)
+	}
+}
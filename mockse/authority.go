@@ -0,0 +1,184 @@
+package mockse
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Authority is a self signed CA, with a user certificate issued by it
+// The CA path and the user credentials are written to a temporary directory,
+// so they can be used as any grid CA path and proxy.
+type Authority struct {
+	// CAPath is a directory with the CA certificate (.0) and an empty CRL (.r0)
+	CAPath string
+	// UserCert contains the user certificate and its private key
+	UserCert string
+	// UserDN is the subject of the user certificate
+	UserDN string
+
+	dir  string
+	cert *x509.Certificate
+	key  *rsa.PrivateKey
+	pool *x509.CertPool
+}
+
+// certLifetime is the validity of the generated certificates
+const certLifetime = 24 * time.Hour
+
+// randomSerial returns a random serial number for a certificate
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 63))
+}
+
+// NewAuthority generates a new CA and user certificate
+// Close must be called to remove the temporary files.
+func NewAuthority() (*Authority, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"http3rd"}, CommonName: "Mock SE CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(certLifetime),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Authority{cert: cert, key: key, pool: x509.NewCertPool()}
+	a.pool.AddCert(cert)
+
+	if a.dir, err = ioutil.TempDir("", "mockse"); err != nil {
+		return nil, err
+	}
+	if err = a.writeFiles(); err != nil {
+		a.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// writeFiles writes the CA path and the user credentials into the temporary directory
+func (a *Authority) writeFiles() error {
+	a.CAPath = filepath.Join(a.dir, "certificates")
+	if err := os.Mkdir(a.CAPath, 0755); err != nil {
+		return err
+	}
+
+	// The name only has to look like a hash, no tool computes it
+	digest := sha1.Sum(a.cert.RawSubject)
+	hash := hex.EncodeToString(digest[:4])
+
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: a.cert.Raw})
+	if err := ioutil.WriteFile(filepath.Join(a.CAPath, hash+".0"), caPEM, 0644); err != nil {
+		return err
+	}
+
+	crl, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: time.Now().Add(certLifetime),
+	}, a.cert, a.key)
+	if err != nil {
+		return err
+	}
+	crlPEM := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl})
+	if err = ioutil.WriteFile(filepath.Join(a.CAPath, hash+".r0"), crlPEM, 0644); err != nil {
+		return err
+	}
+
+	userCert, err := a.Issue(pkix.Name{Organization: []string{"http3rd"}, CommonName: "Mock SE User"}, nil)
+	if err != nil {
+		return err
+	}
+	a.UserDN = userCert.Leaf.Subject.String()
+
+	userPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: userCert.Certificate[0]})
+	userPEM = append(userPEM, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(userCert.PrivateKey.(*rsa.PrivateKey)),
+	})...)
+	a.UserCert = filepath.Join(a.dir, "usercert.pem")
+	return ioutil.WriteFile(a.UserCert, userPEM, 0600)
+}
+
+// Issue returns a certificate for the given subject, signed by the CA
+// If hosts is empty, it is a client certificate. Otherwise, a server certificate for them.
+func (a *Authority) Issue(subject pkix.Name, hosts []string) (*tls.Certificate, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(certLifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if len(hosts) > 0 {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, a.cert, &key.PublicKey, a.key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, a.cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// CertPool returns a pool with the CA certificate
+func (a *Authority) CertPool() *x509.CertPool {
+	return a.pool
+}
+
+// Close removes the temporary files
+func (a *Authority) Close() error {
+	return os.RemoveAll(a.dir)
+}
@@ -0,0 +1,238 @@
+package mockse
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/ayllon/http3rd"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// transferHeaderPrefix marks the headers to be passed to the passive endpoint
+const transferHeaderPrefix = "Transferheader"
+
+type (
+	// markerWriter sends the performance markers while the transfer runs
+	markerWriter struct {
+		mutex sync.Mutex
+		w     io.Writer
+		bytes int64
+	}
+
+	// countingReader counts the bytes read into the marker writer
+	countingReader struct {
+		r       io.Reader
+		markers *markerWriter
+	}
+)
+
+// Read implements io.Reader
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	atomic.AddInt64(&c.markers.bytes, int64(n))
+	return n, err
+}
+
+// printf writes to the client, and flushes so it is not buffered
+func (m *markerWriter) printf(format string, args ...interface{}) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	fmt.Fprintf(m.w, format, args...)
+	if flusher, ok := m.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// marker sends a performance marker with the bytes transferred so far
+func (m *markerWriter) marker() {
+	m.printf("Perf Marker\n\tTimestamp: %d\n\tStripe Index: 0\n\tStripe Bytes Transferred: %d\n\tTotal Stripe Count: 1\nEnd\n",
+		time.Now().Unix(), atomic.LoadInt64(&m.bytes))
+}
+
+// run sends a marker every interval, until the context is done
+func (m *markerWriter) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.marker()
+		}
+	}
+}
+
+// transferHeaders returns the TransferHeader headers, without the prefix
+func transferHeaders(r *http.Request) http.Header {
+	headers := http.Header{}
+	for key, values := range r.Header {
+		if strings.HasPrefix(key, transferHeaderPrefix) && len(key) > len(transferHeaderPrefix) {
+			for _, value := range values {
+				headers.Add(key[len(transferHeaderPrefix):], value)
+			}
+		}
+	}
+	return headers
+}
+
+// transferClient returns the client used to talk with the passive endpoint
+// With GridSite delegation, it authenticates with the proxy delegated by the user.
+func (s *Server) transferClient(r *http.Request) (*http.Client, error) {
+	config := &tls.Config{RootCAs: s.Authority.CertPool()}
+	if strings.EqualFold(r.Header.Get("Credential"), "gridsite") {
+		dn, err := s.identity(r)
+		if err != nil {
+			return nil, err
+		}
+		proxy := s.delegation.proxy(dn)
+		if proxy == nil {
+			return nil, fmt.Errorf("No delegated proxy for %s", dn)
+		}
+		config.Certificates = []tls.Certificate{*proxy}
+	}
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config}}, nil
+}
+
+// serveCopy performs a third party copy
+// The local file needs UPLOAD if it is pulled, and DOWNLOAD if it is pushed.
+func (s *Server) serveCopy(w http.ResponseWriter, r *http.Request) {
+	local := path.Clean(r.URL.Path)
+	remote := r.Header.Get("Source")
+	push := remote == ""
+	activity := http3rd.Upload
+	if push {
+		remote = r.Header.Get("Destination")
+		activity = http3rd.Download
+	}
+
+	if status, err := s.authorize(r, activity, local); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	client, err := s.transferClient(r)
+	if err != nil {
+		w.Header().Set("X-Delegate-To", s.URL+delegationPath)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	headers := transferHeaders(r)
+	overwrite := !strings.EqualFold(r.Header.Get("Overwrite"), "F")
+
+	if push && !s.Exists(local) {
+		http.Error(w, "No such file "+local, http.StatusNotFound)
+		return
+	}
+	if !overwrite && s.remoteExists(r.Context(), client, headers, push, local, remote) {
+		http.Error(w, "The destination exists", http.StatusPreconditionFailed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/perf-marker-stream")
+	w.WriteHeader(http.StatusAccepted)
+
+	markers := &markerWriter{w: w}
+	ctx, cancel := context.WithCancel(r.Context())
+	go markers.run(ctx, s.MarkerInterval)
+	if push {
+		err = s.push(ctx, client, headers, local, remote, markers)
+	} else {
+		err = s.pull(ctx, client, headers, remote, local, markers)
+	}
+	cancel()
+
+	markers.marker()
+	if err != nil {
+		markers.printf("failure: %s\n", err)
+	} else {
+		markers.printf("success: Created\n")
+	}
+}
+
+// remoteExists returns true if the destination of the copy exists
+// A pushed destination is listed, since the token for it does not allow downloading.
+func (s *Server) remoteExists(ctx context.Context, client *http.Client, headers http.Header, push bool, local, remote string) bool {
+	if !push {
+		return s.Exists(local)
+	}
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", remote, nil)
+	if err != nil {
+		return false
+	}
+	req.Header = headers.Clone()
+	req.Header.Set("Depth", "0")
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusMultiStatus
+}
+
+// pull downloads the remote file into the local one
+func (s *Server) pull(ctx context.Context, client *http.Client, headers http.Header, remote, local string, markers *markerWriter) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", remote, nil)
+	if err != nil {
+		return err
+	}
+	req.Header = headers.Clone()
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", remote, resp.Status)
+	}
+
+	if err = s.mkdirAll(ctx, path.Dir(local)); err != nil {
+		return err
+	}
+	f, err := s.fs.OpenFile(ctx, local, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, &countingReader{r: resp.Body, markers: markers}); err != nil {
+		f.Close()
+		s.fs.RemoveAll(ctx, local)
+		return err
+	}
+	return f.Close()
+}
+
+// push uploads the local file into the remote one
+func (s *Server) push(ctx context.Context, client *http.Client, headers http.Header, local, remote string, markers *markerWriter) error {
+	f, err := s.fs.OpenFile(ctx, local, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", remote, &countingReader{r: f, markers: markers})
+	if err != nil {
+		return err
+	}
+	req.Header = headers.Clone()
+	req.ContentLength = info.Size()
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("PUT %s: %s", remote, resp.Status)
+	}
+	return nil
+}
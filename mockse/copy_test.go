@@ -0,0 +1,88 @@
+package mockse
+
+import (
+	"context"
+	"github.com/ayllon/http3rd"
+	"testing"
+	"time"
+)
+
+// newServerPair starts a source and a destination that trust each other
+// Both have a /dteam directory.
+func newServerPair(t *testing.T) (*Server, *Server) {
+	authority, err := NewAuthority()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { authority.Close() })
+
+	var servers []*Server
+	for i := 0; i < 2; i++ {
+		s, err := NewServer(authority)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		s.MarkerInterval = 10 * time.Millisecond
+		if err = s.mkdirAll(context.Background(), "/dteam"); err != nil {
+			t.Fatal(err)
+		}
+		servers = append(servers, s)
+	}
+	return servers[0], servers[1]
+}
+
+func TestCopy(t *testing.T) {
+	src, dst := newServerPair(t)
+	if err := src.WriteFile("/dteam/file", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []http3rd.CopyMode{http3rd.PushMode, http3rd.PullMode} {
+		params := src.Params()
+		params.Mode = mode
+		destination := dst.URL + "/dteam/" + mode.String()
+		if err := http3rd.DoHTTP3rdCopy(params, time.Minute, src.URL+"/dteam/file", destination); err != nil {
+			t.Fatal(mode, ": ", err)
+		}
+		content, err := dst.ReadFile("/dteam/" + mode.String())
+		if err != nil {
+			t.Fatal(mode, ": ", err)
+		}
+		if string(content) != "content" {
+			t.Error(mode, ": unexpected content ", string(content))
+		}
+	}
+}
+
+func TestCopyMissingSource(t *testing.T) {
+	src, dst := newServerPair(t)
+
+	for _, mode := range []http3rd.CopyMode{http3rd.PushMode, http3rd.PullMode} {
+		params := src.Params()
+		params.Mode = mode
+		if err := http3rd.DoHTTP3rdCopy(params, time.Minute, src.URL+"/missing", dst.URL+"/dteam/file"); err == nil {
+			t.Error(mode, ": expecting the copy of a missing file to fail")
+		}
+		if dst.Exists("/dteam/file") {
+			t.Error(mode, ": the destination has been created")
+		}
+	}
+}
+
+func TestCopyGridsite(t *testing.T) {
+	src, dst := newServerPair(t)
+	if err := src.WriteFile("/dteam/file", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The delegation service is the one advertised with X-Delegate-To
+	params := src.Params()
+	params.Credential = http3rd.GridsiteCredential
+	if err := http3rd.DoHTTP3rdCopy(params, time.Minute, src.URL+"/dteam/file", dst.URL+"/dteam/delegated"); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := dst.ReadFile("/dteam/delegated"); err != nil || string(content) != "content" {
+		t.Error("Unexpected content: ", string(content), err)
+	}
+}
@@ -0,0 +1,204 @@
+package mockse
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// delegationPath is where the GridSite delegation service is served
+const delegationPath = "/gridsite-delegation"
+
+// oidProxyCertInfo is the RFC 3820 ProxyCertInfo extension
+var oidProxyCertInfo = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 14}
+
+type (
+	// delegationService keeps the pending requests, and the proxies delegated by each user
+	delegationService struct {
+		mutex   sync.Mutex
+		pending map[string]*rsa.PrivateKey
+		proxies map[string]*tls.Certificate
+	}
+
+	// delegationEnvelope models the operations sent to the service
+	delegationEnvelope struct {
+		XMLName xml.Name `xml:"Envelope"`
+		Body    struct {
+			GetNewProxyReq *struct{} `xml:"getNewProxyReq"`
+			PutProxy       *struct {
+				DelegationID string `xml:"delegationID"`
+				Proxy        string `xml:"proxy"`
+			} `xml:"putProxy"`
+		} `xml:"Body"`
+	}
+)
+
+// newDelegationService returns an empty delegation service
+func newDelegationService() *delegationService {
+	return &delegationService{
+		pending: make(map[string]*rsa.PrivateKey),
+		proxies: make(map[string]*tls.Certificate),
+	}
+}
+
+// delegationID returns the delegation ID of the user
+func delegationID(dn string) string {
+	digest := sha1.Sum([]byte(dn))
+	return hex.EncodeToString(digest[:8])
+}
+
+// proxy returns the proxy delegated by the user, if any and still valid
+func (d *delegationService) proxy(dn string) *tls.Certificate {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	proxy := d.proxies[dn]
+	if proxy == nil || time.Now().After(proxy.Leaf.NotAfter) {
+		return nil
+	}
+	return proxy
+}
+
+// writeSOAP sends the body wrapped in a SOAP envelope
+func writeSOAP(w http.ResponseWriter, status int, body string) {
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?>`+
+		`<SOAP-ENV:Envelope xmlns:SOAP-ENV="http://schemas.xmlsoap.org/soap/envelope/" `+
+		`xmlns:deleg="http://www.gridsite.org/namespaces/delegation-2">`+
+		`<SOAP-ENV:Body>`+body+`</SOAP-ENV:Body></SOAP-ENV:Envelope>`)
+}
+
+// writeFault sends a SOAP fault
+func writeFault(w http.ResponseWriter, message string) {
+	buffer := &bytes.Buffer{}
+	xml.EscapeText(buffer, []byte(message))
+	writeSOAP(w, http.StatusInternalServerError,
+		`<SOAP-ENV:Fault><faultcode>SOAP-ENV:Server</faultcode><faultstring>`+buffer.String()+
+			`</faultstring></SOAP-ENV:Fault>`)
+}
+
+// serveDelegation implements getNewProxyReq and putProxy, for clients with a certificate
+func (s *Server) serveDelegation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	dn, err := s.identity(r)
+	if err != nil {
+		http.Error(w, "A client certificate is required to delegate", http.StatusUnauthorized)
+		return
+	}
+
+	envelope := &delegationEnvelope{}
+	if err = xml.NewDecoder(r.Body).Decode(envelope); err != nil {
+		writeFault(w, "Malformed request: "+err.Error())
+		return
+	}
+
+	switch {
+	case envelope.Body.GetNewProxyReq != nil:
+		id, csr, err := s.delegation.getNewProxyReq(dn)
+		if err != nil {
+			writeFault(w, err.Error())
+			return
+		}
+		buffer := &bytes.Buffer{}
+		xml.EscapeText(buffer, csr)
+		writeSOAP(w, http.StatusOK, `<deleg:getNewProxyReqResponse><getNewProxyReqReturn>`+
+			`<proxyRequest>`+buffer.String()+`</proxyRequest>`+
+			`<delegationID>`+id+`</delegationID>`+
+			`</getNewProxyReqReturn></deleg:getNewProxyReqResponse>`)
+	case envelope.Body.PutProxy != nil:
+		put := envelope.Body.PutProxy
+		if err = s.putProxy(dn, put.DelegationID, []byte(put.Proxy)); err != nil {
+			writeFault(w, err.Error())
+			return
+		}
+		writeSOAP(w, http.StatusOK, `<deleg:putProxyResponse/>`)
+	default:
+		writeFault(w, "Unsupported operation")
+	}
+}
+
+// getNewProxyReq generates a key for the user, and returns a PEM certificate request for it
+func (d *delegationService) getNewProxyReq(dn string) (string, []byte, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", nil, err
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	id := delegationID(dn)
+	d.mutex.Lock()
+	d.pending[id] = key
+	d.mutex.Unlock()
+	return id, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+// putProxy stores the proxy, which must match the pending request, and be issued by the user
+func (s *Server) putProxy(dn, id string, proxyPEM []byte) error {
+	d := s.delegation
+	if id != delegationID(dn) {
+		return errors.New("The delegation ID does not belong to the user")
+	}
+	d.mutex.Lock()
+	key := d.pending[id]
+	d.mutex.Unlock()
+	if key == nil {
+		return errors.New("No pending request for the delegation ID " + id)
+	}
+
+	proxy := &tls.Certificate{PrivateKey: key}
+	var chain []*x509.Certificate
+	for block, rest := pem.Decode(proxyPEM); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return err
+		}
+		chain = append(chain, cert)
+		proxy.Certificate = append(proxy.Certificate, block.Bytes)
+	}
+	if len(chain) == 0 {
+		return errors.New("No certificate in the proxy")
+	}
+	proxy.Leaf = chain[0]
+
+	public, ok := chain[0].PublicKey.(*rsa.PublicKey)
+	if !ok || !public.Equal(&key.PublicKey) {
+		return errors.New("The proxy does not match the request")
+	}
+	if !isProxy(chain[0]) {
+		return errors.New("The delegated certificate is not a proxy")
+	}
+	owner, err := s.verifyChain(chain)
+	if err != nil {
+		return err
+	}
+	if owner != dn {
+		return fmt.Errorf("The proxy belongs to %s, not to %s", owner, dn)
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.pending, id)
+	d.proxies[dn] = proxy
+	return nil
+}
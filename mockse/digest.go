@@ -0,0 +1,31 @@
+package mockse
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"hash/adler32"
+	"strings"
+)
+
+// digest returns the Digest header (RFC 3230) of the file with the algorithms asked in
+// Want-Digest that are supported (adler32 and md5), or an empty string if none is
+func (s *Server) digest(name, want string) string {
+	content, err := s.ReadFile(name)
+	if err != nil {
+		return ""
+	}
+	var digests []string
+	for _, algorithm := range strings.Split(want, ",") {
+		// Quality values are ignored, all the supported algorithms are returned
+		algorithm = strings.ToLower(strings.TrimSpace(strings.SplitN(algorithm, ";", 2)[0]))
+		switch algorithm {
+		case "adler32":
+			digests = append(digests, fmt.Sprintf("adler32=%08x", adler32.Checksum(content)))
+		case "md5":
+			sum := md5.Sum(content)
+			digests = append(digests, "md5="+base64.StdEncoding.EncodeToString(sum[:]))
+		}
+	}
+	return strings.Join(digests, ",")
+}
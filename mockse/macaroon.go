@@ -0,0 +1,268 @@
+package mockse
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ayllon/http3rd"
+	"github.com/go-macaroon/macaroon"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// supportedCaveats are the caveats understood when verifying a macaroon
+// Any other caveat makes the macaroon invalid.
+var supportedCaveats = map[string]bool{
+	"activity": true,
+	"before":   true,
+	"path":     true,
+	"ip":       true,
+}
+
+type (
+	// macaroonRequest is the body of a macaroon request
+	macaroonRequest struct {
+		Caveats  []string `json:"caveats"`
+		Validity string   `json:"validity"`
+	}
+
+	// caveat is a first party caveat, serialized as key:value
+	// The mock parses and checks them itself, rather than with http3rd, so what the
+	// client sends is actually put to the test.
+	caveat struct {
+		key, value string
+	}
+
+	// caveatChecker evaluates the caveats of a macaroon for a request
+	caveatChecker struct {
+		activity string
+		resource string
+		remote   net.IP
+		// root is the path the macaroon is restricted to
+		root string
+	}
+)
+
+// parseCaveat splits a serialized caveat
+// As dCache does, no blank is allowed around the key, and unknown keys are rejected.
+func parseCaveat(serialized string) (caveat, error) {
+	colon := strings.IndexByte(serialized, ':')
+	if colon <= 0 {
+		return caveat{}, fmt.Errorf("Malformed caveat %q", serialized)
+	}
+	c := caveat{key: serialized[:colon], value: serialized[colon+1:]}
+	if !supportedCaveats[c.key] {
+		return c, fmt.Errorf("Unsupported caveat %q", c.key)
+	}
+	if c.value == "" {
+		return c, fmt.Errorf("Empty caveat %s", c.key)
+	}
+	return c, nil
+}
+
+// String returns the serialized caveat
+func (c caveat) String() string {
+	return c.key + ":" + c.value
+}
+
+// validate checks the value of a caveat before it is added to a macaroon
+func (c caveat) validate() error {
+	switch c.key {
+	case "activity":
+		for _, activity := range strings.Split(c.value, ",") {
+			switch activity {
+			case http3rd.Download, http3rd.Upload, http3rd.List, http3rd.Delete, http3rd.Manage:
+			default:
+				return fmt.Errorf("Unknown activity %q", activity)
+			}
+		}
+	case "before":
+		if _, err := time.Parse(time.RFC3339, c.value); err != nil {
+			return fmt.Errorf("Invalid before caveat: %s", err)
+		}
+	case "path":
+		if !strings.HasPrefix(c.value, "/") {
+			return fmt.Errorf("The path caveat %s is not absolute", c.value)
+		}
+	case "ip":
+		for _, allowed := range strings.Split(c.value, ",") {
+			if _, _, err := net.ParseCIDR(allowed); err != nil && net.ParseIP(allowed) == nil {
+				return fmt.Errorf("Invalid address %q", allowed)
+			}
+		}
+	}
+	return nil
+}
+
+// beforeCaveat returns a caveat expiring at the given time
+func beforeCaveat(t time.Time) caveat {
+	return caveat{key: "before", value: t.UTC().Format(time.RFC3339)}
+}
+
+// serveMacaroon issues a macaroon for the requested path, to clients with a certificate
+// The path, and the expiration, are added by the server before the requested caveats.
+func (s *Server) serveMacaroon(w http.ResponseWriter, r *http.Request) {
+	if _, err := s.identity(r); err != nil {
+		http.Error(w, "A client certificate is required to request a macaroon", http.StatusUnauthorized)
+		return
+	}
+
+	request := &macaroonRequest{}
+	if err := json.NewDecoder(r.Body).Decode(request); err != nil {
+		http.Error(w, "Malformed macaroon request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	caveats := []caveat{{key: "path", value: path.Clean(r.URL.Path)}}
+	hasBefore := false
+	for _, serialized := range request.Caveats {
+		c, err := parseCaveat(serialized)
+		if err == nil {
+			err = c.validate()
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		hasBefore = hasBefore || c.key == "before"
+		caveats = append(caveats, c)
+	}
+
+	switch {
+	case request.Validity != "":
+		validity, err := http3rd.ParseISO8601Duration(request.Validity)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		caveats = append(caveats, beforeCaveat(time.Now().Add(validity)))
+	case !hasBefore:
+		caveats = append(caveats, beforeCaveat(time.Now().Add(s.DefaultValidity)))
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	M, err := macaroon.New(s.rootKey, hex.EncodeToString(id), s.URL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, c := range caveats {
+		if err = M.AddFirstPartyCaveat(c.String()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	token, err := http3rd.WrapMacaroon(M).Encode()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := &http3rd.MacaroonResponse{Macaroon: token}
+	response.Uri.Target = s.URL + r.URL.Path
+	response.Uri.Base = s.URL
+	response.Uri.TargetWithMacaroon = response.Uri.Target + "?authz=" + token
+	response.Uri.BaseWithMacaroon = response.Uri.Base + "?authz=" + token
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// remoteIP returns the address of the client
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// check returns an error if the caveat does not allow the request
+func (c *caveatChecker) check(caveat caveat) error {
+	switch caveat.key {
+	case "activity":
+		for _, activity := range strings.Split(caveat.value, ",") {
+			if activity == c.activity {
+				return nil
+			}
+		}
+		return fmt.Errorf("The activity %s is not allowed", c.activity)
+	case "before":
+		before, err := time.Parse(time.RFC3339, caveat.value)
+		if err != nil {
+			return err
+		}
+		if time.Now().After(before) {
+			return fmt.Errorf("The macaroon expired on %s", caveat.value)
+		}
+	case "path":
+		// As dCache does, each path caveat is relative to the previous one
+		if c.root == "" {
+			c.root = path.Clean("/" + caveat.value)
+		} else {
+			c.root = path.Join(c.root, caveat.value)
+		}
+	case "ip":
+		for _, allowed := range strings.Split(caveat.value, ",") {
+			if _, network, err := net.ParseCIDR(allowed); err == nil && network.Contains(c.remote) {
+				return nil
+			} else if ip := net.ParseIP(allowed); ip != nil && ip.Equal(c.remote) {
+				return nil
+			}
+		}
+		return fmt.Errorf("The address %s is not allowed", c.remote)
+	default:
+		return fmt.Errorf("Unsupported caveat %s", caveat.key)
+	}
+	return nil
+}
+
+// verifyMacaroon checks the signature and the caveats of the macaroon
+// A macaroon that is not valid gets a 401, while a valid one that does not allow the
+// request gets a 403.
+func (s *Server) verifyMacaroon(r *http.Request, token, activity, resource string) (int, error) {
+	M, err := http3rd.DecodeMacaroon(token)
+	if err != nil {
+		return http.StatusUnauthorized, fmt.Errorf("Invalid token: %s", err)
+	}
+
+	// The caveats are evaluated once the signature is known to be good
+	var caveats []caveat
+	err = M.Unwrap().Verify(s.rootKey, func(serialized string) error {
+		c, err := parseCaveat(serialized)
+		if err != nil {
+			return err
+		}
+		caveats = append(caveats, c)
+		return nil
+	}, nil)
+	if err != nil {
+		return http.StatusUnauthorized, fmt.Errorf("Invalid macaroon: %s", err)
+	}
+
+	checker := &caveatChecker{activity: activity, resource: resource, remote: remoteIP(r)}
+	for _, caveat := range caveats {
+		if err = checker.check(caveat); err != nil {
+			if caveat.key == "before" {
+				return http.StatusUnauthorized, err
+			}
+			return http.StatusForbidden, err
+		}
+	}
+
+	resource = path.Clean("/" + resource)
+	if checker.root != "" && checker.root != "/" && resource != checker.root &&
+		!strings.HasPrefix(resource, checker.root+"/") {
+		return http.StatusForbidden, errors.New("The path " + resource + " is not allowed")
+	}
+	return 0, nil
+}
@@ -0,0 +1,162 @@
+package mockse
+
+import (
+	"bytes"
+	"github.com/ayllon/http3rd"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCaveat(t *testing.T) {
+	valid := []string{
+		"activity:DOWNLOAD,LIST",
+		"before:2030-01-01T00:00:00Z",
+		"path:/dteam",
+		"ip:127.0.0.1,10.0.0.0/8",
+	}
+	for _, serialized := range valid {
+		c, err := parseCaveat(serialized)
+		if err == nil {
+			err = c.validate()
+		}
+		if err != nil {
+			t.Errorf("%s: %s", serialized, err)
+		} else if c.String() != serialized {
+			t.Errorf("Expecting %s, got %s", serialized, c)
+		}
+	}
+
+	invalid := []string{
+		"activity",
+		":DOWNLOAD",
+		" activity:DOWNLOAD",
+		"activity:",
+		"activity:DOWNLOAD, LIST",
+		"activity:READ",
+		"before:tomorrow",
+		"path:dteam",
+		"ip:localhost",
+		"role:admin",
+	}
+	for _, serialized := range invalid {
+		c, err := parseCaveat(serialized)
+		if err == nil {
+			err = c.validate()
+		}
+		if err == nil {
+			t.Errorf("Expecting %s to be rejected", serialized)
+		}
+	}
+}
+
+func TestGetMacaroon(t *testing.T) {
+	s, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err = s.WriteFile("/dteam/file", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	client, err := s.X509Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := http3rd.GetMacaroon(client, &http3rd.MacaroonRequest{
+		Resource:   s.URL + "/dteam/file",
+		Activities: []string{http3rd.Download, http3rd.List},
+		Lifetime:   time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	M, err := http3rd.DecodeMacaroon(response.Macaroon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if activities := M.Activities(); strings.Join(activities, ",") != "DOWNLOAD,LIST" {
+		t.Error("Unexpected activities: ", activities)
+	}
+	if paths := M.Paths(); len(paths) != 1 || paths[0] != "/dteam/file" {
+		t.Error("Unexpected paths: ", paths)
+	}
+	if expiry, ok := M.Expiry(); !ok || expiry.After(time.Now().Add(time.Minute)) {
+		t.Error("Unexpected expiry: ", expiry, ok)
+	}
+
+	// The macaroon allows what has been requested, and only that
+	get, _ := http.NewRequest("GET", s.URL+"/dteam/file", nil)
+	get.Header.Set("Authorization", "Bearer "+response.Macaroon)
+	resp, err := s.Client().Do(get)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "content" {
+		t.Error("Expecting the download to be allowed, got ", resp.Status, string(body))
+	}
+
+	put, _ := http.NewRequest("PUT", s.URL+"/dteam/file", strings.NewReader("overwritten"))
+	put.Header.Set("Authorization", "Bearer "+response.Macaroon)
+	resp, err = s.Client().Do(put)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Error("Expecting the upload to be forbidden, got ", resp.Status)
+	}
+}
+
+func TestGetMacaroonCaveats(t *testing.T) {
+	s, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err = s.WriteFile("/dteam/file", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	client, err := s.X509Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The client is connecting from 127.0.0.1, so this one can not be used
+	response, err := http3rd.GetMacaroon(client, &http3rd.MacaroonRequest{
+		Resource:   s.URL + "/dteam/file",
+		Activities: []string{http3rd.Download},
+		Lifetime:   time.Minute,
+		Caveats:    []http3rd.Caveat{http3rd.IPCaveat("10.0.0.0/8")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	get, _ := http.NewRequest("GET", s.URL+"/dteam/file", nil)
+	get.Header.Set("Authorization", "Bearer "+response.Macaroon)
+	resp, err := s.Client().Do(get)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Error("Expecting the ip caveat to be enforced, got ", resp.Status)
+	}
+
+	// A malformed caveat is rejected when the macaroon is requested
+	resp, err = client.Post(s.URL+"/dteam/file", "application/macaroon-request",
+		bytes.NewBufferString(`{"caveats": ["activity:READ"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Error("Expecting an unknown activity to be rejected, got ", resp.Status)
+	}
+}
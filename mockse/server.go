@@ -0,0 +1,338 @@
+// Package mockse implements an in-process storage element, serving WebDAV over TLS,
+// issuing macaroons and performing third party copies, so http3rd and litmus can be
+// tested without a live storage.
+package mockse
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"github.com/ayllon/http3rd"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/webdav"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Server is a WebDAV storage element backed by memory
+// Clients are authenticated with an X509 certificate (or proxy) issued by the Authority,
+// which is allowed to do anything, or with a macaroon issued by the server itself,
+// which is allowed whatever its caveats allow.
+type Server struct {
+	// URL of the root of the storage, without trailing slash
+	URL string
+	// Authority issued the server certificate, and the trusted client certificates
+	Authority *Authority
+	// DefaultValidity of the macaroons requested without validity nor before caveat
+	DefaultValidity time.Duration
+	// MarkerInterval is the time between performance markers during a COPY
+	MarkerInterval time.Duration
+
+	fs            webdav.FileSystem
+	dav           *webdav.Handler
+	rootKey       []byte
+	server        *http.Server
+	ownsAuthority bool
+	delegation    *delegationService
+}
+
+// New starts a server with its own Authority
+func New() (*Server, error) {
+	authority, err := NewAuthority()
+	if err != nil {
+		return nil, err
+	}
+	s, err := NewServer(authority)
+	if err != nil {
+		authority.Close()
+		return nil, err
+	}
+	s.ownsAuthority = true
+	return s, nil
+}
+
+// NewServer starts a server with a certificate issued by the authority
+// Servers sharing the authority trust each other, so they can copy between them.
+func NewServer(authority *Authority) (*Server, error) {
+	s := &Server{
+		Authority:       authority,
+		DefaultValidity: time.Hour,
+		MarkerInterval:  500 * time.Millisecond,
+		fs:              webdav.NewMemFS(),
+		rootKey:         make([]byte, 32),
+		delegation:      newDelegationService(),
+	}
+	s.dav = &webdav.Handler{FileSystem: s.fs, LockSystem: webdav.NewMemLS()}
+	if _, err := rand.Read(s.rootKey); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	cert, err := authority.Issue(pkix.Name{Organization: []string{"http3rd"}, CommonName: "localhost"},
+		[]string{"127.0.0.1", "localhost"})
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	s.URL = "https://" + listener.Addr().String()
+	s.server = &http.Server{
+		Handler: s,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{*cert},
+			// Proxies are not understood by crypto/tls, so the chain is verified by the handler
+			ClientAuth: tls.RequestClientCert,
+		},
+		ErrorLog: log.New(logrus.StandardLogger().WriterLevel(logrus.DebugLevel), "", 0),
+	}
+	go s.server.ServeTLS(listener, "", "")
+	logrus.Debug("Mock storage listening on ", s.URL)
+	return s, nil
+}
+
+// Close stops the server, and removes the Authority files if it was created by New
+func (s *Server) Close() error {
+	err := s.server.Close()
+	if s.ownsAuthority {
+		s.Authority.Close()
+	}
+	return err
+}
+
+// Params returns the parameters to talk with the server with the user credentials
+func (s *Server) Params() *http3rd.Params {
+	return &http3rd.Params{
+		UserCert: s.Authority.UserCert,
+		UserKey:  s.Authority.UserCert,
+		CAPath:   s.Authority.CAPath,
+	}
+}
+
+// Client returns a client without credentials, that trusts the server
+func (s *Server) Client() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: s.Authority.CertPool()},
+		},
+	}
+}
+
+// X509Client returns a client that authenticates with the user certificate
+func (s *Server) X509Client() (*http.Client, error) {
+	cert, err := tls.LoadX509KeyPair(s.Authority.UserCert, s.Authority.UserCert)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				RootCAs:      s.Authority.CertPool(),
+				Certificates: []tls.Certificate{cert},
+			},
+		},
+	}, nil
+}
+
+// WriteFile creates, or replaces, a file with the given content, and its parent directories
+func (s *Server) WriteFile(name string, content []byte) error {
+	ctx := context.Background()
+	if err := s.mkdirAll(ctx, path.Dir(path.Clean("/"+name))); err != nil {
+		return err
+	}
+	f, err := s.fs.OpenFile(ctx, name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// mkdirAll creates the directory and all its parents
+func (s *Server) mkdirAll(ctx context.Context, dir string) error {
+	if dir == "/" {
+		return nil
+	}
+	if err := s.mkdirAll(ctx, path.Dir(dir)); err != nil {
+		return err
+	}
+	if err := s.fs.Mkdir(ctx, dir, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ReadFile returns the content of a file
+func (s *Server) ReadFile(name string) ([]byte, error) {
+	f, err := s.fs.OpenFile(context.Background(), name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+// Exists returns true if the file or directory exists
+func (s *Server) Exists(name string) bool {
+	_, err := s.fs.Stat(context.Background(), name)
+	return err == nil
+}
+
+// allowedMethods are the methods advertised on OPTIONS
+const allowedMethods = "OPTIONS, GET, HEAD, POST, PUT, DELETE, MKCOL, PROPFIND, PROPPATCH, COPY, MOVE, LOCK, UNLOCK"
+
+// methodActivity returns the activity needed for the method
+func methodActivity(method string) (string, bool) {
+	switch method {
+	case "GET", "HEAD":
+		return http3rd.Download, true
+	case "PROPFIND":
+		return http3rd.List, true
+	case "PUT", "MKCOL":
+		return http3rd.Upload, true
+	case "DELETE":
+		return http3rd.Delete, true
+	case "COPY", "MOVE", "PROPPATCH", "LOCK", "UNLOCK":
+		return http3rd.Manage, true
+	}
+	return "", false
+}
+
+// isThirdPartyCopy returns true if the COPY involves another endpoint
+func isThirdPartyCopy(r *http.Request) bool {
+	if r.Method != "COPY" {
+		return false
+	}
+	if r.Header.Get("Source") != "" || r.Header.Get("Credential") != "" {
+		return true
+	}
+	destination, err := url.Parse(r.Header.Get("Destination"))
+	return err == nil && destination.Host != "" && destination.Host != r.Host
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logrus.Debug("Mock storage: ", r.Method, " ", r.URL.Path)
+
+	switch {
+	case r.URL.Path == delegationPath:
+		s.serveDelegation(w, r)
+	case r.Method == "POST" && strings.HasPrefix(r.Header.Get("Content-Type"), "application/macaroon-request"):
+		s.serveMacaroon(w, r)
+	case isThirdPartyCopy(r):
+		s.serveCopy(w, r)
+	case r.Method == "OPTIONS":
+		// The webdav handler does not advertise COPY for missing files, so it would not be
+		// possible to pull into them
+		w.Header().Set("Allow", allowedMethods)
+		w.Header().Set("DAV", "1, 2")
+		w.Header().Set("Accept-Post", "application/macaroon-request")
+	default:
+		activity, ok := methodActivity(r.Method)
+		if !ok {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if status, err := s.authorize(r, activity, r.URL.Path); err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if want := r.Header.Get("Want-Digest"); want != "" && activity == http3rd.Download {
+			if digest := s.digest(r.URL.Path, want); digest != "" {
+				w.Header().Set("Digest", digest)
+			}
+		}
+		s.dav.ServeHTTP(w, r)
+	}
+}
+
+// bearerToken returns the token sent with the Authorization header, or the authz query parameter
+func bearerToken(r *http.Request) string {
+	fields := strings.Fields(r.Header.Get("Authorization"))
+	if len(fields) == 2 && strings.EqualFold(fields[0], "bearer") {
+		return fields[1]
+	}
+	return r.URL.Query().Get("authz")
+}
+
+// authorize checks the request is allowed to perform the activity on the resource
+// It returns the status code to send back if it is not.
+func (s *Server) authorize(r *http.Request, activity, resource string) (int, error) {
+	if token := bearerToken(r); token != "" {
+		return s.verifyMacaroon(r, token, activity, resource)
+	}
+	if _, err := s.identity(r); err != nil {
+		logrus.Debug("Mock storage: ", err)
+		return http.StatusUnauthorized, errors.New("Authentication required")
+	}
+	return 0, nil
+}
+
+// isProxy returns true if the certificate is a RFC 3820 or legacy proxy
+func isProxy(cert *x509.Certificate) bool {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidProxyCertInfo) {
+			return true
+		}
+	}
+	return cert.Subject.CommonName == "proxy" || cert.Subject.CommonName == "limited proxy"
+}
+
+// verifyChain verifies a client chain, which may start with proxies, and returns the
+// subject of the end entity certificate
+func (s *Server) verifyChain(chain []*x509.Certificate) (string, error) {
+	i := 0
+	for ; i < len(chain) && isProxy(chain[i]); i++ {
+		if i+1 == len(chain) {
+			return "", errors.New("Incomplete proxy chain")
+		}
+		proxy := chain[i]
+		if err := chain[i+1].CheckSignature(proxy.SignatureAlgorithm, proxy.RawTBSCertificate, proxy.Signature); err != nil {
+			return "", fmt.Errorf("Invalid proxy signature: %w", err)
+		}
+		if now := time.Now(); now.Before(proxy.NotBefore) || now.After(proxy.NotAfter) {
+			return "", errors.New("Expired proxy")
+		}
+	}
+	if i == len(chain) {
+		return "", errors.New("No client certificate")
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[i+1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := chain[i].Verify(x509.VerifyOptions{
+		Roots:         s.Authority.CertPool(),
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return "", err
+	}
+	return chain[i].Subject.String(), nil
+}
+
+// identity returns the subject of the client certificate
+func (s *Server) identity(r *http.Request) (string, error) {
+	if r.TLS == nil {
+		return "", errors.New("No client certificate")
+	}
+	return s.verifyChain(r.TLS.PeerCertificates)
+}
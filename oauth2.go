@@ -0,0 +1,293 @@
+package http3rd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OAuth2Grant selects how the OAuth2Provider authenticates with the issuer
+type OAuth2Grant int
+
+const (
+	// ClientCredentialsGrant authenticates as the client itself
+	ClientCredentialsGrant OAuth2Grant = iota
+	// TokenExchangeGrant exchanges a token (i.e. of the user) for a scoped one (RFC 8693)
+	TokenExchangeGrant
+)
+
+const (
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+	accessTokenType        = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// wlcgScopes maps the activities to WLCG storage scopes
+// storage.modify implies storage.create, so it is used for uploads, which may overwrite.
+var wlcgScopes = map[string]string{
+	Download: "storage.read",
+	List:     "storage.read",
+	Upload:   "storage.modify",
+	Delete:   "storage.modify",
+	Manage:   "storage.modify",
+}
+
+type (
+	// OAuth2Provider obtains WLCG (or SciTokens) JWTs from an OAuth2 issuer,
+	// scoped down to the requested resource and activities
+	OAuth2Provider struct {
+		// Client used to talk with the issuer. If nil, http.DefaultClient is used.
+		Client *http.Client
+		// Issuer URL, used to discover the token endpoint
+		Issuer string
+		// TokenEndpoint, if set, skips the discovery
+		TokenEndpoint          string
+		ClientID, ClientSecret string
+		Grant                  OAuth2Grant
+		// SubjectToken is the token exchanged with TokenExchangeGrant
+		SubjectToken TokenProvider
+		// Audience of the token. If empty, the scheme and host of the resource.
+		Audience string
+		// BasePath is removed from the resource path, since storage scopes are relative
+		// to the area the issuer is authoritative for (i.e. /dpm/cern.ch/home/dteam)
+		BasePath string
+
+		discoveryMutex sync.Mutex
+	}
+
+	// oauth2TokenResponse models the reply of the token endpoint
+	oauth2TokenResponse struct {
+		AccessToken      string `json:"access_token"`
+		TokenType        string `json:"token_type"`
+		ExpiresIn        int64  `json:"expires_in"`
+		Scope            string `json:"scope"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+
+	// oauth2Configuration models the part of the issuer metadata we need
+	oauth2Configuration struct {
+		TokenEndpoint string `json:"token_endpoint"`
+	}
+)
+
+// String returns the name of the grant
+func (g OAuth2Grant) String() string {
+	switch g {
+	case ClientCredentialsGrant:
+		return "client_credentials"
+	case TokenExchangeGrant:
+		return "token_exchange"
+	}
+	return fmt.Sprintf("OAuth2Grant(%d)", int(g))
+}
+
+// ParseOAuth2Grant returns the grant matching the given name
+func ParseOAuth2Grant(name string) (OAuth2Grant, error) {
+	switch strings.Replace(strings.ToLower(name), "-", "_", -1) {
+	case "client_credentials":
+		return ClientCredentialsGrant, nil
+	case "token_exchange":
+		return TokenExchangeGrant, nil
+	}
+	return ClientCredentialsGrant, fmt.Errorf("Unknown OAuth2 grant: %s", name)
+}
+
+// WLCGScopes returns the storage scopes needed to perform the activities on the path
+func WLCGScopes(scopePath string, activities []string) ([]string, error) {
+	if scopePath == "" {
+		scopePath = "/"
+	}
+	seen := make(map[string]bool)
+	scopes := []string{}
+	for _, activity := range activities {
+		scope, ok := wlcgScopes[strings.ToUpper(activity)]
+		if !ok {
+			return nil, fmt.Errorf("Activity %s can not be mapped to a storage scope", activity)
+		}
+		scope = scope + ":" + scopePath
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, nil
+}
+
+// scopePath returns the path for the storage scopes, relative to BasePath
+func (p *OAuth2Provider) scopePath(resource *url.URL) (string, error) {
+	resourcePath := path.Clean("/" + resource.Path)
+	base := path.Clean("/" + p.BasePath)
+	if base == "/" {
+		return resourcePath, nil
+	}
+	if resourcePath == base {
+		return "/", nil
+	}
+	if !strings.HasPrefix(resourcePath, base+"/") {
+		return "", fmt.Errorf("Resource %s is outside of the base path %s", resource.Path, p.BasePath)
+	}
+	return resourcePath[len(base):], nil
+}
+
+// httpClient returns the client to use with the issuer
+func (p *OAuth2Provider) httpClient() *http.Client {
+	if p.Client != nil {
+		return p.Client
+	}
+	return http.DefaultClient
+}
+
+// tokenEndpoint returns the configured token endpoint, or discovers it from the issuer metadata
+func (p *OAuth2Provider) tokenEndpoint(ctx context.Context) (string, error) {
+	p.discoveryMutex.Lock()
+	defer p.discoveryMutex.Unlock()
+
+	if p.TokenEndpoint != "" {
+		return p.TokenEndpoint, nil
+	}
+	if p.Issuer == "" {
+		return "", errors.New("Neither an issuer nor a token endpoint have been configured")
+	}
+
+	configURL := strings.TrimSuffix(p.Issuer, "/") + "/.well-known/openid-configuration"
+	logrus.Debug("Discovering token endpoint from ", configURL)
+
+	req, e := http.NewRequest("GET", configURL, nil)
+	if e != nil {
+		return "", e
+	}
+	resp, e := p.httpClient().Do(req.WithContext(ctx))
+	if e != nil {
+		return "", e
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("Unexpected status code getting the issuer configuration: %d", resp.StatusCode)
+	}
+
+	config := &oauth2Configuration{}
+	if e = json.NewDecoder(resp.Body).Decode(config); e != nil {
+		return "", e
+	}
+	if config.TokenEndpoint == "" {
+		return "", fmt.Errorf("The issuer %s does not advertise a token endpoint", p.Issuer)
+	}
+
+	p.TokenEndpoint = config.TokenEndpoint
+	logrus.Debug("Token endpoint: ", p.TokenEndpoint)
+	return p.TokenEndpoint, nil
+}
+
+// Token implements TokenProvider
+// The lifetime can not be requested with the standard grants, so it is up to the issuer.
+// A warning is logged if the token is shorter lived than requested.
+func (p *OAuth2Provider) Token(ctx context.Context, resource string, activities []string, lifetime time.Duration) (string, error) {
+	token, _, e := p.TokenWithExpiry(ctx, resource, activities, lifetime)
+	return token, e
+}
+
+// TokenWithExpiry implements ExpiringTokenProvider, with the expires_in sent by the issuer
+func (p *OAuth2Provider) TokenWithExpiry(ctx context.Context, resource string, activities []string, lifetime time.Duration) (string, time.Time, error) {
+	var expires time.Time
+	resourceURL, e := url.Parse(resource)
+	if e != nil {
+		return "", expires, e
+	}
+	scopePath, e := p.scopePath(resourceURL)
+	if e != nil {
+		return "", expires, e
+	}
+	scopes, e := WLCGScopes(scopePath, activities)
+	if e != nil {
+		return "", expires, e
+	}
+
+	audience := p.Audience
+	if audience == "" {
+		audience = resourceURL.Scheme + "://" + resourceURL.Host
+	}
+
+	form := url.Values{}
+	form.Set("scope", strings.Join(scopes, " "))
+	form.Set("audience", audience)
+
+	switch p.Grant {
+	case ClientCredentialsGrant:
+		form.Set("grant_type", "client_credentials")
+	case TokenExchangeGrant:
+		if p.SubjectToken == nil {
+			return "", expires, errors.New("Token exchange requires a subject token")
+		}
+		subject, e := p.SubjectToken.Token(ctx, resource, activities, lifetime)
+		if e != nil {
+			return "", expires, e
+		}
+		form.Set("grant_type", tokenExchangeGrantType)
+		form.Set("subject_token", subject)
+		form.Set("subject_token_type", accessTokenType)
+		form.Set("requested_token_type", accessTokenType)
+	default:
+		return "", expires, fmt.Errorf("Unsupported OAuth2 grant: %s", p.Grant)
+	}
+
+	endpoint, e := p.tokenEndpoint(ctx)
+	if e != nil {
+		return "", expires, e
+	}
+
+	req, e := http.NewRequest("POST", endpoint, strings.NewReader(form.Encode()))
+	if e != nil {
+		return "", expires, e
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+	logrus.Debug("Requesting scopes ", form.Get("scope"), " for ", audience, " to ", endpoint)
+
+	resp, e := p.httpClient().Do(req.WithContext(ctx))
+	if e != nil {
+		return "", expires, e
+	}
+	defer resp.Body.Close()
+
+	respBody, e := ioutil.ReadAll(resp.Body)
+	if e != nil {
+		return "", expires, e
+	}
+
+	tokenResponse := &oauth2TokenResponse{}
+	if e = json.Unmarshal(respBody, tokenResponse); e != nil && resp.StatusCode/100 == 2 {
+		return "", expires, e
+	}
+	// The reply carries the access token, so only the outcome is logged
+	logrus.Debugf("Response status code: %d, error: %q %q, expires in: %ds",
+		resp.StatusCode, tokenResponse.Error, tokenResponse.ErrorDescription, tokenResponse.ExpiresIn)
+	if resp.StatusCode/100 != 2 || tokenResponse.Error != "" {
+		return "", expires, &TokenRequestError{
+			HTTPError: newHTTPError(endpoint, resp, respBody),
+		}
+	}
+	if tokenResponse.AccessToken == "" {
+		return "", expires, fmt.Errorf("The issuer did not return any access token")
+	}
+
+	if tokenResponse.ExpiresIn > 0 {
+		expires = time.Now().Add(time.Duration(tokenResponse.ExpiresIn) * time.Second)
+		if time.Duration(tokenResponse.ExpiresIn)*time.Second < lifetime {
+			logrus.Warnf("The token expires in %ds, less than the requested %s", tokenResponse.ExpiresIn, lifetime)
+		}
+	}
+	return tokenResponse.AccessToken, expires, nil
+}
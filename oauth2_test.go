@@ -0,0 +1,295 @@
+package http3rd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testIssuer is a stand-in OAuth2 issuer, with discovery and a token endpoint
+type testIssuer struct {
+	*httptest.Server
+	clientID, clientSecret string
+	expiresIn              int64
+	// errorStatus and errorCode, if set, make the token endpoint fail
+	errorStatus int
+	errorCode   string
+
+	mutex sync.Mutex
+	// forms are the token requests received
+	forms []url.Values
+}
+
+// newTestIssuer starts an issuer accepting the given client
+func newTestIssuer(t *testing.T, clientID, clientSecret string) *testIssuer {
+	issuer := &testIssuer{clientID: clientID, clientSecret: clientSecret, expiresIn: 3600}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":         issuer.URL,
+			"token_endpoint": issuer.URL + "/token",
+		})
+	})
+	mux.HandleFunc("/token", issuer.serveToken)
+	issuer.Server = httptest.NewServer(mux)
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+// reply writes a JSON reply
+func reply(w http.ResponseWriter, status int, body map[string]interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// serveToken issues "<grant>:<scope>" tokens, or "exchanged:<subject>" for the token exchange
+func (i *testIssuer) serveToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		reply(w, http.StatusMethodNotAllowed, map[string]interface{}{"error": "invalid_request"})
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		reply(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid_request"})
+		return
+	}
+	i.mutex.Lock()
+	i.forms = append(i.forms, r.PostForm)
+	i.mutex.Unlock()
+
+	user, password, ok := r.BasicAuth()
+	if !ok || user != i.clientID || password != i.clientSecret {
+		reply(w, http.StatusUnauthorized, map[string]interface{}{
+			"error": "invalid_client", "error_description": "Bad client credentials",
+		})
+		return
+	}
+	if i.errorStatus != 0 {
+		reply(w, i.errorStatus, map[string]interface{}{
+			"error": i.errorCode, "error_description": "Refused by the test issuer",
+		})
+		return
+	}
+
+	var token string
+	switch r.PostForm.Get("grant_type") {
+	case "client_credentials":
+		token = "client_credentials:" + r.PostForm.Get("scope")
+	case tokenExchangeGrantType:
+		if r.PostForm.Get("subject_token_type") != accessTokenType || r.PostForm.Get("subject_token") == "" {
+			reply(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid_request"})
+			return
+		}
+		token = "exchanged:" + r.PostForm.Get("subject_token")
+	default:
+		reply(w, http.StatusBadRequest, map[string]interface{}{"error": "unsupported_grant_type"})
+		return
+	}
+	reply(w, http.StatusOK, map[string]interface{}{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   i.expiresIn,
+		"scope":        r.PostForm.Get("scope"),
+	})
+}
+
+// requests returns how many token requests have been received
+func (i *testIssuer) requests() int {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	return len(i.forms)
+}
+
+// lastForm returns the last token request received
+func (i *testIssuer) lastForm(t *testing.T) url.Values {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if len(i.forms) == 0 {
+		t.Fatal("The issuer did not receive any token request")
+	}
+	return i.forms[len(i.forms)-1]
+}
+
+func TestWLCGScopes(t *testing.T) {
+	tests := []struct {
+		path       string
+		activities []string
+		expected   []string
+	}{
+		{"/file", []string{Download, List}, []string{"storage.read:/file"}},
+		{"/file", []string{Upload}, []string{"storage.modify:/file"}},
+		{"/dir", []string{Delete, Manage, Upload}, []string{"storage.modify:/dir"}},
+		{"/dir", []string{List, Upload}, []string{"storage.read:/dir", "storage.modify:/dir"}},
+		{"", []string{"download"}, []string{"storage.read:/"}},
+	}
+	for _, test := range tests {
+		scopes, err := WLCGScopes(test.path, test.activities)
+		if err != nil {
+			t.Errorf("%s %v: %s", test.path, test.activities, err)
+		} else if !reflect.DeepEqual(scopes, test.expected) {
+			t.Errorf("%s %v: expecting %v, got %v", test.path, test.activities, test.expected, scopes)
+		}
+	}
+
+	if _, err := WLCGScopes("/file", []string{Download, "UNKNOWN"}); err == nil {
+		t.Error("Expecting an error for an unknown activity")
+	}
+}
+
+func TestOAuth2ClientCredentials(t *testing.T) {
+	issuer := newTestIssuer(t, "litmus", "s3cr3t")
+	provider := &OAuth2Provider{
+		Issuer:       issuer.URL,
+		ClientID:     "litmus",
+		ClientSecret: "s3cr3t",
+		BasePath:     "/dpm/cern.ch/home/dteam",
+	}
+
+	token, err := provider.Token(context.Background(), "https://se.example.com:8443/dpm/cern.ch/home/dteam/dir/file",
+		[]string{Download, List}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "client_credentials:storage.read:/dir/file" {
+		t.Error("Unexpected token: ", token)
+	}
+	if provider.TokenEndpoint != issuer.URL+"/token" {
+		t.Error("The token endpoint has not been discovered: ", provider.TokenEndpoint)
+	}
+
+	form := issuer.lastForm(t)
+	if form.Get("grant_type") != "client_credentials" {
+		t.Error("Unexpected grant type: ", form.Get("grant_type"))
+	}
+	if form.Get("audience") != "https://se.example.com:8443" {
+		t.Error("Unexpected audience: ", form.Get("audience"))
+	}
+
+	// The base path itself maps to the root scope
+	token, err = provider.Token(context.Background(), "https://se.example.com:8443/dpm/cern.ch/home/dteam/",
+		[]string{Upload}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "client_credentials:storage.modify:/" {
+		t.Error("Unexpected token: ", token)
+	}
+
+	// Outside of the base path, no token is requested
+	requests := issuer.requests()
+	if _, err = provider.Token(context.Background(), "https://se.example.com:8443/dpm/cern.ch/home/atlas/file",
+		[]string{Download}, time.Minute); err == nil {
+		t.Error("Expecting an error for a resource outside of the base path")
+	}
+	if issuer.requests() != requests {
+		t.Error("The issuer should not have been contacted")
+	}
+}
+
+func TestOAuth2TokenExchange(t *testing.T) {
+	issuer := newTestIssuer(t, "litmus", "s3cr3t")
+	provider := &OAuth2Provider{
+		TokenEndpoint: issuer.URL + "/token",
+		ClientID:      "litmus",
+		ClientSecret:  "s3cr3t",
+		Grant:         TokenExchangeGrant,
+		Audience:      "https://wlcg.cern.ch/jwt/v1/any",
+		SubjectToken:  StaticToken("user-token"),
+	}
+
+	token, err := provider.Token(context.Background(), "https://se.example.com/dteam/file", []string{Upload}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "exchanged:user-token" {
+		t.Error("Unexpected token: ", token)
+	}
+
+	form := issuer.lastForm(t)
+	expected := map[string]string{
+		"grant_type":           tokenExchangeGrantType,
+		"subject_token":        "user-token",
+		"subject_token_type":   accessTokenType,
+		"requested_token_type": accessTokenType,
+		"audience":             "https://wlcg.cern.ch/jwt/v1/any",
+		"scope":                "storage.modify:/dteam/file",
+	}
+	for key, value := range expected {
+		if form.Get(key) != value {
+			t.Errorf("Expecting %s=%s, got %s", key, value, form.Get(key))
+		}
+	}
+
+	provider.SubjectToken = nil
+	if _, err = provider.Token(context.Background(), "https://se.example.com/dteam/file", []string{Upload}, time.Minute); err == nil {
+		t.Error("Expecting an error without subject token")
+	}
+}
+
+func TestOAuth2ErrorResponse(t *testing.T) {
+	issuer := newTestIssuer(t, "litmus", "s3cr3t")
+	provider := &OAuth2Provider{
+		Issuer:       issuer.URL,
+		ClientID:     "litmus",
+		ClientSecret: "wrong",
+	}
+
+	_, err := provider.Token(context.Background(), "https://se.example.com/dteam/file", []string{Download}, time.Minute)
+	var tokenErr *TokenRequestError
+	if !errors.As(err, &tokenErr) {
+		t.Fatal("Expecting a TokenRequestError, got ", err)
+	}
+	if tokenErr.StatusCode != http.StatusUnauthorized || !tokenErr.Unauthorized() {
+		t.Error("Unexpected status code: ", tokenErr.StatusCode)
+	}
+	if tokenErr.Message != "Bad client credentials" {
+		t.Error("Unexpected message: ", tokenErr.Message)
+	}
+	if tokenErr.Parsed["error"] != "invalid_client" {
+		t.Error("Unexpected error: ", tokenErr.Parsed["error"])
+	}
+
+	provider.ClientSecret = "s3cr3t"
+	issuer.errorStatus = http.StatusBadRequest
+	issuer.errorCode = "invalid_scope"
+	_, err = provider.Token(context.Background(), "https://se.example.com/dteam/file", []string{Download}, time.Minute)
+	if !errors.As(err, &tokenErr) {
+		t.Fatal("Expecting a TokenRequestError, got ", err)
+	}
+	if tokenErr.StatusCode != http.StatusBadRequest || tokenErr.Parsed["error"] != "invalid_scope" {
+		t.Error("Unexpected error: ", tokenErr)
+	}
+	if !strings.Contains(tokenErr.Error(), "Refused by the test issuer") {
+		t.Error("The message of the issuer is missing: ", tokenErr)
+	}
+
+	// Some issuers reply with an error, but a 200
+	issuer.errorStatus = http.StatusOK
+	_, err = provider.Token(context.Background(), "https://se.example.com/dteam/file", []string{Download}, time.Minute)
+	if !errors.As(err, &tokenErr) {
+		t.Fatal("Expecting a TokenRequestError, got ", err)
+	}
+}
+
+func TestOAuth2Discovery(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	provider := &OAuth2Provider{Issuer: server.URL}
+	if _, err := provider.Token(context.Background(), "https://se.example.com/dteam/file", []string{Download}, time.Minute); err == nil {
+		t.Error("Expecting an error when the issuer metadata can not be retrieved")
+	}
+
+	provider = &OAuth2Provider{}
+	if _, err := provider.Token(context.Background(), "https://se.example.com/dteam/file", []string{Download}, time.Minute); err == nil {
+		t.Error("Expecting an error without issuer nor token endpoint")
+	}
+}
@@ -0,0 +1,165 @@
+package http3rd
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// PerfMarker models one of the performance markers sent by the active endpoint
+	// while the transfer is running
+	PerfMarker struct {
+		Timestamp              time.Time
+		StripeIndex            int
+		StripeBytesTransferred int64
+		TotalStripeCount       int
+	}
+
+	// CopyResult models the final line of a COPY response body
+	CopyResult struct {
+		Success bool
+		// Message is whatever follows "success:" or "failure:"
+		Message string
+	}
+
+	// PerfMarkerParser reads the body of a COPY response, returning the performance
+	// markers as they arrive, and the final result once the body has been consumed
+	PerfMarkerParser struct {
+		reader *bufio.Reader
+		result *CopyResult
+	}
+)
+
+// NewPerfMarkerParser returns a parser for the given COPY response body
+func NewPerfMarkerParser(r io.Reader) *PerfMarkerParser {
+	return &PerfMarkerParser{
+		reader: bufio.NewReader(r),
+	}
+}
+
+// readLine returns the next line without the trailing new line
+// A last line without new line is returned as well
+func (p *PerfMarkerParser) readLine() (string, error) {
+	line, err := p.reader.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	if err != nil {
+		return "", err
+	}
+	logrus.Debug(line)
+	return strings.TrimSpace(line), nil
+}
+
+// parseMarkerField sets the field of the marker matching key
+// Unknown fields (i.e. State, RemoteConnections) are ignored
+func parseMarkerField(marker *PerfMarker, key, value string) error {
+	var err error
+	switch key {
+	case "Timestamp":
+		var ts float64
+		if ts, err = strconv.ParseFloat(value, 64); err == nil {
+			sec := int64(ts)
+			marker.Timestamp = time.Unix(sec, int64((ts-float64(sec))*1e9)).UTC()
+		}
+	case "Stripe Index":
+		marker.StripeIndex, err = strconv.Atoi(value)
+	case "Stripe Bytes Transferred":
+		marker.StripeBytesTransferred, err = strconv.ParseInt(value, 10, 64)
+	case "Total Stripe Count":
+		marker.TotalStripeCount, err = strconv.Atoi(value)
+	}
+	if err != nil {
+		return fmt.Errorf("Malformed performance marker field %s: %s", key, err)
+	}
+	return nil
+}
+
+// parseMarker reads a marker until the "End" line
+func (p *PerfMarkerParser) parseMarker() (*PerfMarker, error) {
+	marker := &PerfMarker{}
+	for {
+		line, err := p.readLine()
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return nil, err
+		}
+
+		if line == "End" {
+			return marker, nil
+		} else if line == "" {
+			continue
+		}
+
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			return nil, fmt.Errorf("Malformed performance marker line: %s", line)
+		}
+		key := strings.TrimSpace(line[:colon])
+		value := strings.TrimSpace(line[colon+1:])
+		if err = parseMarkerField(marker, key, value); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Next returns the next performance marker
+// It returns io.EOF once the final success or failure line has been read,
+// and io.ErrUnexpectedEOF if the body ends without it.
+func (p *PerfMarkerParser) Next() (*PerfMarker, error) {
+	if p.result != nil {
+		return nil, io.EOF
+	}
+
+	for {
+		line, err := p.readLine()
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return nil, err
+		}
+
+		lower := strings.ToLower(line)
+		switch {
+		case line == "":
+			continue
+		case line == "Perf Marker":
+			return p.parseMarker()
+		case strings.HasPrefix(lower, "success:"):
+			p.result = &CopyResult{Success: true, Message: strings.TrimSpace(line[8:])}
+			return nil, io.EOF
+		case strings.HasPrefix(lower, "failure:"):
+			p.result = &CopyResult{Success: false, Message: strings.TrimSpace(line[8:])}
+			return nil, io.EOF
+		default:
+			logrus.Debug("Ignoring unexpected line in COPY response: ", line)
+		}
+	}
+}
+
+// Result returns the final result of the copy, or nil if it has not been read yet
+func (p *PerfMarkerParser) Result() *CopyResult {
+	return p.result
+}
+
+// Drain consumes the whole body, passing each marker to the callback (if not nil),
+// and returns the final result
+func (p *PerfMarkerParser) Drain(callback func(*PerfMarker)) (*CopyResult, error) {
+	for {
+		marker, err := p.Next()
+		if err == io.EOF {
+			return p.result, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if callback != nil {
+			callback(marker)
+		}
+	}
+}
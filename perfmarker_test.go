@@ -0,0 +1,152 @@
+package http3rd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// markers formats a body with a performance marker for each stripe
+func markers(timestamp string, stripes ...string) string {
+	var body strings.Builder
+	for index, transferred := range stripes {
+		body.WriteString("Perf Marker\n")
+		body.WriteString("\tTimestamp: " + timestamp + "\n")
+		body.WriteString("\tState: Running\n")
+		body.WriteString("\tStripe Index: " + strconv.Itoa(index) + "\n")
+		body.WriteString("\tStripe Bytes Transferred: " + transferred + "\n")
+		body.WriteString("\tTotal Stripe Count: " + strconv.Itoa(len(stripes)) + "\n")
+		body.WriteString("End\n")
+	}
+	return body.String()
+}
+
+func TestPerfMarkerParser(t *testing.T) {
+	body := markers("1700000000.5", "100", "200") +
+		"\n" +
+		markers("1700000001", "300", "400") +
+		"success: Created"
+
+	var received []*PerfMarker
+	result, err := NewPerfMarkerParser(strings.NewReader(body)).Drain(func(marker *PerfMarker) {
+		received = append(received, marker)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Success || result.Message != "Created" {
+		t.Errorf("Unexpected result: %+v", result)
+	}
+	if len(received) != 4 {
+		t.Fatal("Expecting 4 markers, got ", len(received))
+	}
+
+	expected := []PerfMarker{
+		{time.Unix(1700000000, 5e8).UTC(), 0, 100, 2},
+		{time.Unix(1700000000, 5e8).UTC(), 1, 200, 2},
+		{time.Unix(1700000001, 0).UTC(), 0, 300, 2},
+		{time.Unix(1700000001, 0).UTC(), 1, 400, 2},
+	}
+	for i, marker := range received {
+		if !marker.Timestamp.Equal(expected[i].Timestamp) || marker.StripeIndex != expected[i].StripeIndex ||
+			marker.StripeBytesTransferred != expected[i].StripeBytesTransferred ||
+			marker.TotalStripeCount != expected[i].TotalStripeCount {
+			t.Errorf("Marker %d: expecting %+v, got %+v", i, expected[i], *marker)
+		}
+	}
+}
+
+func TestPerfMarkerParserResult(t *testing.T) {
+	tests := []struct {
+		name, body string
+		success    bool
+		message    string
+	}{
+		{"failure", markers("1700000000", "100") + "failure: Connection refused\n", false, "Connection refused"},
+		{"case insensitive", "Success: ok\n", true, "ok"},
+		{"unexpected lines", "Hello\n" + markers("1700000000", "100") + "  \nDone?\nfailure: timeout", false, "timeout"},
+	}
+	for _, test := range tests {
+		parser := NewPerfMarkerParser(strings.NewReader(test.body))
+		if parser.Result() != nil {
+			t.Errorf("%s: the result must be nil before being read", test.name)
+		}
+		result, err := parser.Drain(nil)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		} else if result.Success != test.success || result.Message != test.message {
+			t.Errorf("%s: unexpected result %+v", test.name, result)
+		}
+		// Anything after the final line is ignored
+		if marker, err := parser.Next(); marker != nil || err != io.EOF {
+			t.Errorf("%s: expecting io.EOF after the result, got %v", test.name, err)
+		}
+	}
+}
+
+func TestPerfMarkerParserErrors(t *testing.T) {
+	tests := []struct {
+		name, body string
+		expected   error
+	}{
+		{"empty", "", io.ErrUnexpectedEOF},
+		{"no final line", markers("1700000000", "100"), io.ErrUnexpectedEOF},
+		{"truncated marker", "Perf Marker\n\tTimestamp: 1700000000\n", io.ErrUnexpectedEOF},
+		{"malformed bytes", strings.Replace(markers("1700000000", "100"), ": 100", ": 1OO", 1) + "success: ok", nil},
+		{"malformed timestamp", markers("yesterday", "100") + "success: ok", nil},
+		{"malformed line", "Perf Marker\n\tStripe Index 0\nEnd\nsuccess: ok", nil},
+	}
+	for _, test := range tests {
+		_, err := NewPerfMarkerParser(strings.NewReader(test.body)).Drain(nil)
+		if err == nil {
+			t.Errorf("%s: expecting an error", test.name)
+		} else if test.expected != nil && err != test.expected {
+			t.Errorf("%s: expecting %s, got %s", test.name, test.expected, err)
+		}
+	}
+}
+
+func TestRequestRawCopyResult(t *testing.T) {
+	tests := []struct {
+		name, body string
+		incomplete bool
+		// lastMarker is expected to be kept in the error
+		lastMarker bool
+	}{
+		{"no final line", markers("1700000000", "100"), true, true},
+		{"failure", markers("1700000000", "100") + "failure: Connection refused", false, true},
+		{"malformed marker", "Perf Marker\n\tStripe Bytes Transferred: many\nEnd\nsuccess: Created", true, false},
+	}
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// The status code is a success, only the body tells otherwise
+			w.WriteHeader(http.StatusAccepted)
+			io.WriteString(w, test.body)
+		}))
+
+		_, err := requestRawCopy(context.Background(), server.Client(), nil, &copyRequest{
+			Mode:        PullMode,
+			Source:      "https://src.example.com/file",
+			Destination: server.URL + "/file",
+		}, nil)
+		server.Close()
+
+		var failed *TransferFailedError
+		if !errors.As(err, &failed) {
+			t.Errorf("%s: expecting a TransferFailedError, got %v", test.name, err)
+			continue
+		}
+		if failed.Incomplete != test.incomplete {
+			t.Errorf("%s: expecting incomplete=%t, got %+v", test.name, test.incomplete, failed)
+		}
+		if test.lastMarker && (failed.LastMarker == nil || failed.LastMarker.StripeBytesTransferred != 100) {
+			t.Errorf("%s: expecting the last marker, got %+v", test.name, failed.LastMarker)
+		}
+	}
+}
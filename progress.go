@@ -0,0 +1,75 @@
+package http3rd
+
+import (
+	"time"
+)
+
+type (
+	// Progress is a snapshot of a running third party copy
+	Progress struct {
+		// Total bytes transferred, over all stripes
+		BytesTransferred int64
+		// Instantaneous rate, in bytes per second, between the last two markers
+		Rate float64
+		// Time since the COPY was submitted
+		Elapsed time.Duration
+		// Marker that triggered this update
+		Marker *PerfMarker
+	}
+
+	// ProgressFunc is called each time a performance marker is received
+	ProgressFunc func(*Progress)
+
+	// progressTracker aggregates performance markers into Progress snapshots
+	progressTracker struct {
+		start     time.Time
+		stripes   map[int]int64
+		lastBytes int64
+		// Remote and local time of the previous marker
+		lastRemote, lastLocal time.Time
+	}
+)
+
+// newProgressTracker returns a tracker whose elapsed time counts from now
+func newProgressTracker() *progressTracker {
+	now := time.Now()
+	return &progressTracker{
+		start:     now,
+		stripes:   make(map[int]int64),
+		lastLocal: now,
+	}
+}
+
+// update accounts for the marker, and returns the new snapshot
+func (t *progressTracker) update(marker *PerfMarker) *Progress {
+	t.stripes[marker.StripeIndex] = marker.StripeBytesTransferred
+
+	var total int64
+	for _, bytes := range t.stripes {
+		total += bytes
+	}
+
+	progress := &Progress{
+		BytesTransferred: total,
+		Elapsed:          time.Since(t.start),
+		Marker:           marker,
+	}
+
+	// Prefer the remote timestamps, since the markers may be buffered on the way,
+	// but fall back to the local clock if they are missing or did not move
+	local := time.Now()
+	var delta time.Duration
+	if !t.lastRemote.IsZero() && marker.Timestamp.After(t.lastRemote) {
+		delta = marker.Timestamp.Sub(t.lastRemote)
+	} else {
+		delta = local.Sub(t.lastLocal)
+	}
+	if delta > 0 {
+		progress.Rate = float64(total-t.lastBytes) / delta.Seconds()
+	}
+
+	t.lastBytes = total
+	t.lastRemote = marker.Timestamp
+	t.lastLocal = local
+	return progress
+}
@@ -0,0 +1,73 @@
+package http3rd
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestProgressTracker(t *testing.T) {
+	start := time.Unix(1700000000, 0).UTC()
+	tests := []struct {
+		marker PerfMarker
+		total  int64
+		// rate is only checked when the remote timestamps move forward, -1 otherwise
+		rate float64
+	}{
+		{PerfMarker{start, 0, 100, 2}, 100, -1},
+		{PerfMarker{start, 1, 200, 2}, 300, -1},
+		{PerfMarker{start.Add(time.Second), 0, 600, 2}, 800, 500},
+		{PerfMarker{start.Add(3 * time.Second), 1, 1200, 2}, 1800, 500},
+		// The stripes are cumulative, the same value adds nothing
+		{PerfMarker{start.Add(4 * time.Second), 1, 1200, 2}, 1800, 0},
+		// A new stripe
+		{PerfMarker{start.Add(6 * time.Second), 2, 1000, 3}, 2800, 500},
+	}
+
+	tracker := newProgressTracker()
+	var elapsed time.Duration
+	for i, test := range tests {
+		marker := test.marker
+		progress := tracker.update(&marker)
+		if progress.Marker != &marker {
+			t.Errorf("Marker %d: the snapshot must point to its marker", i)
+		}
+		if progress.BytesTransferred != test.total {
+			t.Errorf("Marker %d: expecting %d bytes, got %d", i, test.total, progress.BytesTransferred)
+		}
+		if test.rate >= 0 && progress.Rate != test.rate {
+			t.Errorf("Marker %d: expecting a rate of %f, got %f", i, test.rate, progress.Rate)
+		}
+		if progress.Rate < 0 {
+			t.Errorf("Marker %d: negative rate %f", i, progress.Rate)
+		}
+		if progress.Elapsed < elapsed {
+			t.Errorf("Marker %d: the elapsed time went backwards", i)
+		}
+		elapsed = progress.Elapsed
+	}
+}
+
+func TestProgressTrackerLocalClock(t *testing.T) {
+	tracker := newProgressTracker()
+	tracker.update(&PerfMarker{StripeBytesTransferred: 1000})
+
+	// Without remote timestamps, the rate is computed with the local clock
+	tracker.lastLocal = tracker.lastLocal.Add(-2 * time.Second)
+	progress := tracker.update(&PerfMarker{StripeBytesTransferred: 2000})
+	if progress.BytesTransferred != 2000 {
+		t.Error("Expecting 2000 bytes, got ", progress.BytesTransferred)
+	}
+	if math.Abs(progress.Rate-500) > 10 {
+		t.Error("Expecting a rate close to 500, got ", progress.Rate)
+	}
+
+	// Same if the remote timestamp goes backwards
+	remote := time.Now()
+	tracker.update(&PerfMarker{Timestamp: remote, StripeBytesTransferred: 2000})
+	tracker.lastLocal = tracker.lastLocal.Add(-time.Second)
+	progress = tracker.update(&PerfMarker{Timestamp: remote.Add(-time.Minute), StripeBytesTransferred: 2500})
+	if math.Abs(progress.Rate-500) > 10 {
+		t.Error("Expecting a rate close to 500, got ", progress.Rate)
+	}
+}
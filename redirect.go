@@ -0,0 +1,279 @@
+package http3rd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DefaultMaxRedirects is the number of redirects followed when the policy does not specify it
+const DefaultMaxRedirects = 10
+
+// maxDiscard limits how much of a redirection body is read, so the connection can be reused
+const maxDiscard = 2 << 10
+
+// ErrBodyNotRewindable is returned when a redirect requires sending the request body again,
+// but it has already been consumed and can not be rewound
+var ErrBodyNotRewindable = errors.New("the request body has already been sent and can not be rewound")
+
+// RedirectCredentials selects what happens with the credentials when a redirect leaves the
+// original host
+type RedirectCredentials int
+
+const (
+	// StripCredentials follows the redirect, but without the credential headers
+	StripCredentials RedirectCredentials = iota
+	// SameHostOnly refuses to follow redirects to another host
+	SameHostOnly
+	// KeepCredentials sends the credentials to any host
+	KeepCredentials
+)
+
+type (
+	// RedirectPolicy decides which redirects DoWithRedirect follows, and where the credentials
+	// (Authorization, TransferHeader* and Cookie headers) are sent
+	// A nil policy uses the defaults.
+	RedirectPolicy struct {
+		// MaxRedirects is the maximum number of redirects followed. Defaults to DefaultMaxRedirects.
+		MaxRedirects int
+		// Credentials applies when the redirect leaves the original host, or downgrades to http
+		Credentials RedirectCredentials
+		// TrustedDomains are treated as the original host (i.e. the disk nodes of a storage).
+		// A domain matches itself and its subdomains.
+		TrustedDomains []string
+	}
+
+	// trackedBody remembers if the request body has been read
+	trackedBody struct {
+		io.Reader
+		read bool
+	}
+)
+
+// Read implements io.Reader
+func (b *trackedBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if n > 0 {
+		b.read = true
+	}
+	return n, err
+}
+
+// String returns the name of the credentials mode
+func (c RedirectCredentials) String() string {
+	switch c {
+	case StripCredentials:
+		return "strip"
+	case SameHostOnly:
+		return "same-host"
+	case KeepCredentials:
+		return "keep"
+	}
+	return fmt.Sprintf("RedirectCredentials(%d)", int(c))
+}
+
+// ParseRedirectCredentials returns the RedirectCredentials matching the given name
+func ParseRedirectCredentials(name string) (RedirectCredentials, error) {
+	switch strings.Replace(strings.ToLower(name), "_", "-", -1) {
+	case "strip":
+		return StripCredentials, nil
+	case "same-host":
+		return SameHostOnly, nil
+	case "keep":
+		return KeepCredentials, nil
+	}
+	return StripCredentials, fmt.Errorf("Unknown redirect credentials mode: %s", name)
+}
+
+// isCredentialHeader returns true if the header carries credentials
+func isCredentialHeader(name string) bool {
+	name = http.CanonicalHeaderKey(name)
+	return name == "Authorization" || name == "Cookie" || strings.HasPrefix(name, "Transferheader")
+}
+
+// isRedirect returns true if the status code is a redirection with a Location to follow
+// 301 and 302 keep the method and the body, as 307 and 308 do, since WebDAV servers use
+// them to send COPY and PUT to the disk nodes.
+func isRedirect(statusCode int) bool {
+	switch statusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// maxRedirects returns the configured limit, or the default
+func (p *RedirectPolicy) maxRedirects() int {
+	if p == nil || p.MaxRedirects <= 0 {
+		return DefaultMaxRedirects
+	}
+	return p.MaxRedirects
+}
+
+// trusted returns true if the credentials sent to origin can be sent to target too
+func (p *RedirectPolicy) trusted(origin, target *url.URL) bool {
+	if origin.Scheme == "https" && target.Scheme != "https" {
+		return false
+	}
+	host := strings.ToLower(target.Hostname())
+	if host == strings.ToLower(origin.Hostname()) {
+		return true
+	}
+	if p == nil {
+		return false
+	}
+	for _, domain := range p.TrustedDomains {
+		domain = strings.ToLower(strings.Trim(domain, "."))
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyCredentials enforces the credentials policy on the headers of a redirect from origin to target
+// original are the headers of the first request, in case they have to be restored
+func (p *RedirectPolicy) applyCredentials(origin, target *url.URL, header, original http.Header) error {
+	credentials := StripCredentials
+	if p != nil {
+		credentials = p.Credentials
+	}
+
+	if credentials == KeepCredentials || p.trusted(origin, target) {
+		// Put back what http.Client may have removed
+		for name, values := range original {
+			if isCredentialHeader(name) && header.Get(name) == "" {
+				header[name] = values
+			}
+		}
+		return nil
+	}
+	if credentials == SameHostOnly {
+		return &RedirectRefusedError{URL: origin.String(), Location: target.String()}
+	}
+	for name := range header {
+		if isCredentialHeader(name) {
+			logrus.Debug("Removing ", name, " from the redirect to ", target.Host)
+			header.Del(name)
+		}
+	}
+	return nil
+}
+
+// CheckRedirect can be used as http.Client.CheckRedirect to apply the policy to the redirects
+// followed by the client itself
+func (p *RedirectPolicy) CheckRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > p.maxRedirects() {
+		visited := make([]string, 0, len(via))
+		for _, r := range via {
+			visited = append(visited, r.URL.String())
+		}
+		return &RedirectLoopError{URL: visited[0], Visited: visited}
+	}
+	return p.applyCredentials(via[0].URL, req.URL, req.Header, via[0].Header)
+}
+
+// rewindBody returns the body to send again after a redirect
+func rewindBody(r *http.Request, body *trackedBody) (io.ReadCloser, error) {
+	if r.GetBody != nil {
+		return r.GetBody()
+	}
+	if !body.read {
+		return ioutil.NopCloser(body), nil
+	}
+	if seeker, ok := body.Reader.(io.Seeker); ok {
+		logrus.Debug("Rewind request body")
+		if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		body.read = false
+		return ioutil.NopCloser(body), nil
+	}
+	return nil, ErrBodyNotRewindable
+}
+
+// Do sends the request, following the redirects allowed by the policy
+// Unlike http.Client, the method and body are kept for 301 and 302, and only 303
+// switches to GET. Other 3xx codes, or redirects without Location, are returned as they are.
+func (p *RedirectPolicy) Do(ctx context.Context, client *http.Client, r *http.Request) (*http.Response, error) {
+	// The redirects are followed here, so the client must not follow them on its own
+	noFollow := *client
+	noFollow.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	r = r.WithContext(ctx)
+	origin := r.URL
+	originalHeader := r.Header
+
+	// Wrap the body to avoid it being closed on a redirect
+	var body *trackedBody
+	if r.Body != nil && r.Body != http.NoBody {
+		defer r.Body.Close()
+		body = &trackedBody{Reader: r.Body}
+		r.Body = ioutil.NopCloser(body)
+	}
+
+	visited := []string{}
+	seen := make(map[string]bool)
+	for {
+		resp, err := noFollow.Do(r)
+		if err != nil {
+			return nil, err
+		}
+		location := resp.Header.Get("Location")
+		if !isRedirect(resp.StatusCode) || location == "" {
+			return resp, nil
+		}
+
+		// Discard the redirection body, so the connection can be reused
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, maxDiscard))
+		resp.Body.Close()
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		current := r.URL.String()
+		visited = append(visited, current)
+		seen[current] = true
+
+		target, err := r.URL.Parse(location)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid redirect location %q: %w", location, err)
+		}
+		if seen[target.String()] {
+			return nil, &RedirectLoopError{URL: visited[0], Visited: append(visited, target.String()), Loop: true}
+		}
+		if len(visited) > p.maxRedirects() {
+			return nil, &RedirectLoopError{URL: visited[0], Visited: visited}
+		}
+		logrus.Debug("Following redirect: ", target)
+
+		next := r.Clone(ctx)
+		next.URL = target
+		next.Host = ""
+		if err = p.applyCredentials(origin, target, next.Header, originalHeader); err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusSeeOther && r.Method != "HEAD" {
+			next.Method = "GET"
+			next.Body = nil
+			next.GetBody = nil
+			next.ContentLength = 0
+			next.Header.Del("Content-Type")
+			body = nil
+		} else if body != nil {
+			if next.Body, err = rewindBody(r, body); err != nil {
+				return nil, err
+			}
+		}
+		r = next
+	}
+}
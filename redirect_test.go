@@ -0,0 +1,449 @@
+package http3rd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testHosts is a server answering for any host name
+// A request with a "to" query parameter is redirected there, any other is answered with a 200,
+// and its headers are recorded by host.
+type testHosts struct {
+	*httptest.Server
+	// status of the redirections
+	status int
+
+	mutex    sync.Mutex
+	received map[string]http.Header
+}
+
+// newTestHosts starts a server redirecting with a 307
+func newTestHosts(t *testing.T) *testHosts {
+	hosts := &testHosts{status: http.StatusTemporaryRedirect, received: make(map[string]http.Header)}
+	hosts.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if to := r.URL.Query().Get("to"); to != "" {
+			http.Redirect(w, r, to, hosts.status)
+			return
+		}
+		hosts.mutex.Lock()
+		hosts.received[r.Host] = r.Header.Clone()
+		hosts.mutex.Unlock()
+	}))
+	t.Cleanup(hosts.Close)
+	return hosts
+}
+
+// client returns a client that connects to the server whatever the host name
+func (h *testHosts) client() *http.Client {
+	dialer := &net.Dialer{}
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, h.Listener.Addr().String())
+			},
+		},
+	}
+}
+
+// header returns the headers received by the host, or nil if it has not been reached
+func (h *testHosts) header(host string) http.Header {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.received[host]
+}
+
+// redirectURL returns an URL on the host that redirects to the given location
+func redirectURL(host, to string) string {
+	return "http://" + host + "/redirect?to=" + url.QueryEscape(to)
+}
+
+// credentialHeaders are sent by the redirect tests
+var credentialHeaders = map[string]string{
+	"Authorization":               "Bearer secret",
+	"Cookie":                      "session=secret",
+	"TransferHeaderAuthorization": "Bearer other-secret",
+}
+
+// hasCredentials returns true if all the credential headers have been received,
+// and false if none has. Anything else is an error.
+func hasCredentials(t *testing.T, header http.Header) bool {
+	received := 0
+	for name, value := range credentialHeaders {
+		if header.Get(name) == value {
+			received++
+		}
+	}
+	if received != 0 && received != len(credentialHeaders) {
+		t.Error("Only some of the credentials have been received: ", header)
+	}
+	return received == len(credentialHeaders)
+}
+
+func TestRedirectCredentials(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *RedirectPolicy
+		// url is requested, and final is expected to be reached
+		url, final string
+		keep       bool
+	}{
+		{"same host", nil,
+			redirectURL("se.cern.ch", "http://se.cern.ch/file"), "se.cern.ch", true},
+		{"another host", nil,
+			redirectURL("se.cern.ch", "http://disk.example.org/file"), "disk.example.org", false},
+		{"back to the origin", nil,
+			redirectURL("se.cern.ch", redirectURL("disk.example.org", "http://se.cern.ch/file")), "se.cern.ch", true},
+		{"trusted domain", &RedirectPolicy{TrustedDomains: []string{"cern.ch"}},
+			redirectURL("se.cern.ch", "http://disk01.cern.ch/file"), "disk01.cern.ch", true},
+		{"trusted domain itself", &RedirectPolicy{TrustedDomains: []string{".cern.ch"}},
+			redirectURL("se.cern.ch", "http://cern.ch/file"), "cern.ch", true},
+		{"domain suffix", &RedirectPolicy{TrustedDomains: []string{"cern.ch"}},
+			redirectURL("se.cern.ch", "http://evilcern.ch/file"), "evilcern.ch", false},
+		{"keep", &RedirectPolicy{Credentials: KeepCredentials},
+			redirectURL("se.cern.ch", "http://disk.example.org/file"), "disk.example.org", true},
+		{"same host only", &RedirectPolicy{Credentials: SameHostOnly},
+			redirectURL("se.cern.ch", "http://se.cern.ch/file"), "se.cern.ch", true},
+	}
+
+	for _, test := range tests {
+		hosts := newTestHosts(t)
+		req, _ := http.NewRequest("GET", test.url, nil)
+		for name, value := range credentialHeaders {
+			req.Header.Set(name, value)
+		}
+		req.Header.Set("Destination", "https://dst.example.com/file")
+
+		resp, err := test.policy.Do(context.Background(), hosts.client(), req)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		resp.Body.Close()
+
+		header := hosts.header(test.final)
+		if header == nil {
+			t.Errorf("%s: %s has not been reached", test.name, test.final)
+			continue
+		}
+		if hasCredentials(t, header) != test.keep {
+			t.Errorf("%s: expecting the credentials to be kept=%t, got %v", test.name, test.keep, header)
+		}
+		if header.Get("Destination") != "https://dst.example.com/file" {
+			t.Errorf("%s: the other headers must be kept, got %v", test.name, header)
+		}
+		// The request is not modified
+		if req.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("%s: the original request has been modified", test.name)
+		}
+	}
+}
+
+func TestRedirectSameHostOnly(t *testing.T) {
+	hosts := newTestHosts(t)
+	policy := &RedirectPolicy{Credentials: SameHostOnly, TrustedDomains: []string{"example.org"}}
+	req, _ := http.NewRequest("GET", redirectURL("se.cern.ch", "http://disk.cern.ch/file"), nil)
+
+	_, err := policy.Do(context.Background(), hosts.client(), req)
+	var refused *RedirectRefusedError
+	if !errors.As(err, &refused) {
+		t.Fatal("Expecting a RedirectRefusedError, got ", err)
+	}
+	if refused.Location != "http://disk.cern.ch/file" {
+		t.Error("Unexpected location: ", refused.Location)
+	}
+	if hosts.header("disk.cern.ch") != nil {
+		t.Error("The redirect has been followed")
+	}
+
+	// A trusted domain is treated as the original host
+	req, _ = http.NewRequest("GET", redirectURL("se.example.org", "http://disk.example.org/file"), nil)
+	resp, err := policy.Do(context.Background(), hosts.client(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+}
+
+func TestRedirectTrusted(t *testing.T) {
+	policy := &RedirectPolicy{TrustedDomains: []string{"cern.ch"}}
+	tests := []struct {
+		origin, target string
+		trusted        bool
+	}{
+		{"https://se.cern.ch/a", "https://SE.cern.ch:8443/b", true},
+		{"https://se.cern.ch/a", "https://disk.cern.ch/b", true},
+		{"https://se.cern.ch/a", "https://cern.ch/b", true},
+		{"https://se.cern.ch/a", "https://evilcern.ch/b", false},
+		{"https://se.cern.ch/a", "https://cern.ch.evil.org/b", false},
+		{"https://se.cern.ch/a", "http://se.cern.ch/b", false},
+		{"http://se.cern.ch/a", "https://disk.cern.ch/b", true},
+	}
+	for _, test := range tests {
+		origin, _ := url.Parse(test.origin)
+		target, _ := url.Parse(test.target)
+		if trusted := policy.trusted(origin, target); trusted != test.trusted {
+			t.Errorf("%s -> %s: expecting %t, got %t", test.origin, test.target, test.trusted, trusted)
+		}
+	}
+
+	// Without policy, only the same host
+	origin, _ := url.Parse("https://se.cern.ch/a")
+	target, _ := url.Parse("https://disk.cern.ch/b")
+	var none *RedirectPolicy
+	if none.trusted(origin, target) {
+		t.Error("Another host must not be trusted without policy")
+	}
+}
+
+func TestRedirectCheckRedirect(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     *RedirectPolicy
+		url, final string
+		keep       bool
+	}{
+		{"another host", nil,
+			redirectURL("se.cern.ch", "http://disk.example.org/file"), "disk.example.org", false},
+		{"domain suffix", &RedirectPolicy{TrustedDomains: []string{"cern.ch"}},
+			redirectURL("se.cern.ch", "http://evilcern.ch/file"), "evilcern.ch", false},
+		// http.Client strips Authorization and Cookie, the policy puts them back
+		{"trusted domain", &RedirectPolicy{TrustedDomains: []string{"cern.ch"}},
+			redirectURL("se.cern.ch", "http://disk01.cern.ch/file"), "disk01.cern.ch", true},
+		{"keep", &RedirectPolicy{Credentials: KeepCredentials},
+			redirectURL("se.cern.ch", "http://disk.example.org/file"), "disk.example.org", true},
+	}
+
+	for _, test := range tests {
+		hosts := newTestHosts(t)
+		client := hosts.client()
+		client.CheckRedirect = test.policy.CheckRedirect
+		req, _ := http.NewRequest("GET", test.url, nil)
+		for name, value := range credentialHeaders {
+			req.Header.Set(name, value)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		resp.Body.Close()
+		if header := hosts.header(test.final); header == nil {
+			t.Errorf("%s: %s has not been reached", test.name, test.final)
+		} else if hasCredentials(t, header) != test.keep {
+			t.Errorf("%s: expecting the credentials to be kept=%t, got %v", test.name, test.keep, header)
+		}
+	}
+
+	hosts := newTestHosts(t)
+	client := hosts.client()
+	client.CheckRedirect = (&RedirectPolicy{Credentials: SameHostOnly}).CheckRedirect
+	_, err := client.Get(redirectURL("se.cern.ch", "http://disk.example.org/file"))
+	var refused *RedirectRefusedError
+	if !errors.As(err, &refused) {
+		t.Error("Expecting a RedirectRefusedError, got ", err)
+	}
+}
+
+// redirectServer redirects /redirect/<code>?to=<location> with the given status code,
+// /hops/<n> n times before reaching /final, /loop/a and /loop/b to each other,
+// and records what /final receives.
+type redirectServer struct {
+	*httptest.Server
+
+	mutex  sync.Mutex
+	method string
+	body   string
+	header http.Header
+}
+
+func newRedirectServer(t *testing.T) *redirectServer {
+	s := &redirectServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var code, hops int
+		switch {
+		case r.URL.Path == "/final":
+			body, _ := ioutil.ReadAll(r.Body)
+			s.mutex.Lock()
+			s.method, s.body, s.header = r.Method, string(body), r.Header.Clone()
+			s.mutex.Unlock()
+		case r.URL.Path == "/not-modified":
+			w.Header().Set("Location", "/final")
+			w.WriteHeader(http.StatusNotModified)
+		case r.URL.Path == "/loop/a":
+			http.Redirect(w, r, "/loop/b", http.StatusFound)
+		case r.URL.Path == "/loop/b":
+			http.Redirect(w, r, "/loop/a", http.StatusFound)
+		case strings.HasPrefix(r.URL.Path, "/hops/"):
+			hops, _ = strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/hops/"))
+			if hops == 0 {
+				w.Header().Set("Location", "/final")
+			} else {
+				w.Header().Set("Location", "/hops/"+strconv.Itoa(hops-1))
+			}
+			w.WriteHeader(http.StatusFound)
+		default:
+			// The body is not read, as most storages do when redirecting
+			code, _ = strconv.Atoi(path.Base(r.URL.Path))
+			w.Header().Set("Location", r.URL.Query().Get("to"))
+			w.WriteHeader(code)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// received returns what /final has received, or an empty method if it has not been reached
+func (s *redirectServer) received() (string, string, http.Header) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.method, s.body, s.header
+}
+
+func TestRedirectRelativeLocation(t *testing.T) {
+	s := newRedirectServer(t)
+	req, _ := http.NewRequest("GET", s.URL+"/dir/redirect/302?to="+url.QueryEscape("../../final"), nil)
+	resp, err := (*RedirectPolicy)(nil).Do(context.Background(), s.Client(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if method, _, _ := s.received(); method != "GET" {
+		t.Error("Expecting the relative location to be resolved, /final got ", method)
+	}
+	if resp.Request.URL.Path != "/final" {
+		t.Error("Unexpected final URL: ", resp.Request.URL)
+	}
+}
+
+func TestRedirectMethod(t *testing.T) {
+	tests := []struct {
+		code int
+		// expected at the final location
+		method, body string
+	}{
+		{http.StatusSeeOther, "GET", ""},
+		{http.StatusTemporaryRedirect, "PUT", "content"},
+		{http.StatusPermanentRedirect, "PUT", "content"},
+	}
+
+	file := filepath.Join(t.TempDir(), "content")
+	if err := ioutil.WriteFile(file, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range tests {
+		// GetBody, set by http.NewRequest, and a file that can be rewound
+		seekable, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodies := map[string]io.Reader{
+			"GetBody":  strings.NewReader("content"),
+			"Seekable": seekable,
+		}
+		for name, body := range bodies {
+			s := newRedirectServer(t)
+			req, _ := http.NewRequest("PUT", s.URL+"/redirect/"+strconv.Itoa(test.code)+"?to=/final", body)
+			req.Header.Set("Content-Type", "text/plain")
+			resp, err := (*RedirectPolicy)(nil).Do(context.Background(), s.Client(), req)
+			if err != nil {
+				t.Errorf("%d %s: %s", test.code, name, err)
+				continue
+			}
+			resp.Body.Close()
+
+			method, received, header := s.received()
+			if method != test.method || received != test.body {
+				t.Errorf("%d %s: expecting %s %q, got %s %q", test.code, name, test.method, test.body, method, received)
+			}
+			if test.method == "GET" && header.Get("Content-Type") != "" {
+				t.Errorf("%d %s: the Content-Type must be removed with the body", test.code, name)
+			}
+		}
+	}
+}
+
+func TestRedirectBodyNotRewindable(t *testing.T) {
+	s := newRedirectServer(t)
+	body := struct{ io.Reader }{strings.NewReader("content")}
+	req, _ := http.NewRequest("PUT", s.URL+"/redirect/307?to=/final", body)
+	_, err := (*RedirectPolicy)(nil).Do(context.Background(), s.Client(), req)
+	if !errors.Is(err, ErrBodyNotRewindable) {
+		t.Error("Expecting ErrBodyNotRewindable, got ", err)
+	}
+	if method, _, _ := s.received(); method != "" {
+		t.Error("The redirect has been followed without the body")
+	}
+}
+
+func TestRedirectLoop(t *testing.T) {
+	s := newRedirectServer(t)
+	req, _ := http.NewRequest("GET", s.URL+"/loop/a", nil)
+	_, err := (*RedirectPolicy)(nil).Do(context.Background(), s.Client(), req)
+	var loop *RedirectLoopError
+	if !errors.As(err, &loop) {
+		t.Fatal("Expecting a RedirectLoopError, got ", err)
+	}
+	if !loop.Loop || loop.URL != s.URL+"/loop/a" || len(loop.Visited) != 3 {
+		t.Errorf("Unexpected error: %+v", loop)
+	}
+}
+
+func TestRedirectMaxRedirects(t *testing.T) {
+	s := newRedirectServer(t)
+	policy := &RedirectPolicy{MaxRedirects: 3}
+
+	// Three redirects to get there
+	req, _ := http.NewRequest("GET", s.URL+"/hops/2", nil)
+	resp, err := policy.Do(context.Background(), s.Client(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	req, _ = http.NewRequest("GET", s.URL+"/hops/3", nil)
+	_, err = policy.Do(context.Background(), s.Client(), req)
+	var loop *RedirectLoopError
+	if !errors.As(err, &loop) {
+		t.Fatal("Expecting a RedirectLoopError, got ", err)
+	}
+	if loop.Loop || len(loop.Visited) != 4 {
+		t.Errorf("Unexpected error: %+v", loop)
+	}
+
+	// The default
+	req, _ = http.NewRequest("GET", s.URL+"/hops/"+strconv.Itoa(DefaultMaxRedirects), nil)
+	if _, err = (*RedirectPolicy)(nil).Do(context.Background(), s.Client(), req); !errors.As(err, &loop) {
+		t.Error("Expecting the default limit to be enforced, got ", err)
+	}
+}
+
+func TestRedirectNotModified(t *testing.T) {
+	s := newRedirectServer(t)
+	req, _ := http.NewRequest("GET", s.URL+"/not-modified", nil)
+	resp, err := (*RedirectPolicy)(nil).Do(context.Background(), s.Client(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotModified {
+		t.Error("Expecting the 304 to be returned, got ", resp.Status)
+	}
+	if method, _, _ := s.received(); method != "" {
+		t.Error("The Location of a 304 has been followed")
+	}
+}
@@ -0,0 +1,192 @@
+package http3rd
+
+import (
+	"context"
+	"errors"
+	"github.com/sirupsen/logrus"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// DefaultRetryableStatus are the status codes retried when the policy does not specify any
+var DefaultRetryableStatus = []int{
+	http.StatusRequestTimeout,
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// RetryPolicy decides if, and when, a failed request is retried
+// A nil policy never retries. Zero values take sensible defaults.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one. Defaults to 3.
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry. Defaults to one second.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between attempts. Defaults to one minute.
+	MaxBackoff time.Duration
+	// Multiplier increases the wait after each attempt. Defaults to 2.
+	Multiplier float64
+	// Jitter randomizes the wait by this fraction (i.e. 0.2 means +-20%)
+	Jitter float64
+	// RetryableStatus are the status codes worth retrying. Defaults to DefaultRetryableStatus.
+	RetryableStatus []int
+	// IgnoreRetryAfter does not wait as much as the server asks with Retry-After.
+	// By default, a longer Retry-After is honoured, up to MaxBackoff.
+	IgnoreRetryAfter bool
+	// RetryPartialCopy re-issues a COPY that failed after it was accepted.
+	// The remote transfer may have started, or even be still running, so this is off by default.
+	RetryPartialCopy bool
+}
+
+// DefaultMaxAttempts is used when the policy does not set MaxAttempts
+const DefaultMaxAttempts = 3
+
+// DefaultRetryPolicy returns a policy with three attempts and exponential backoff
+func DefaultRetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:    DefaultMaxAttempts,
+		InitialBackoff: time.Second,
+		MaxBackoff:     time.Minute,
+		Multiplier:     2,
+		Jitter:         0.2,
+	}
+}
+
+// parseRetryAfter parses the Retry-After header, which can be a number of seconds or a date
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
+
+// retryable returns if the error is worth retrying, and how long the server asked to wait
+func (p *RetryPolicy) retryable(err error) (bool, time.Duration) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false, 0
+	}
+
+	var transferErr *TransferFailedError
+	if errors.As(err, &transferErr) {
+		return p.RetryPartialCopy, 0
+	}
+
+	var httpErr *HTTPError
+	var tokenErr *TokenRequestError
+	var copyErr *CopyRejectedError
+	switch {
+	case errors.As(err, &tokenErr):
+		httpErr = &tokenErr.HTTPError
+	case errors.As(err, &copyErr):
+		httpErr = &copyErr.HTTPError
+	case errors.As(err, &httpErr):
+	}
+	if httpErr != nil {
+		statuses := p.RetryableStatus
+		if statuses == nil {
+			statuses = DefaultRetryableStatus
+		}
+		for _, status := range statuses {
+			if status == httpErr.StatusCode {
+				return true, httpErr.RetryAfter
+			}
+		}
+		return false, 0
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true, 0
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return true, 0
+	}
+	return false, 0
+}
+
+// backoff returns the wait before the given retry (starting at 1)
+func (p *RetryPolicy) backoff(retry int, retryAfter time.Duration) time.Duration {
+	wait := p.InitialBackoff
+	if wait <= 0 {
+		wait = time.Second
+	}
+	maxBackoff := p.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = time.Minute
+	}
+	multiplier := p.Multiplier
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+
+	for i := 1; i < retry && wait < maxBackoff; i++ {
+		wait = time.Duration(float64(wait) * multiplier)
+	}
+	if wait > maxBackoff {
+		wait = maxBackoff
+	}
+	if p.Jitter > 0 {
+		wait = time.Duration(float64(wait) * (1 - p.Jitter + 2*p.Jitter*rand.Float64()))
+	}
+	if !p.IgnoreRetryAfter && retryAfter > wait {
+		wait = retryAfter
+		if wait > maxBackoff {
+			wait = maxBackoff
+		}
+	}
+	return wait
+}
+
+// maxAttempts returns the configured number of attempts, or the default
+func (p *RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts <= 0 {
+		return DefaultMaxAttempts
+	}
+	return p.MaxAttempts
+}
+
+// Do runs op until it succeeds, fails with an error not worth retrying,
+// the attempts are exhausted, or the context is done
+func (p *RetryPolicy) Do(ctx context.Context, op func() error) error {
+	err := op()
+	if p == nil {
+		return err
+	}
+
+	maxAttempts := p.maxAttempts()
+	for attempt := 2; err != nil && attempt <= maxAttempts; attempt++ {
+		retry, retryAfter := p.retryable(err)
+		if !retry {
+			return err
+		}
+
+		wait := p.backoff(attempt-1, retryAfter)
+		logrus.Warnf("Attempt %d/%d failed, retrying in %s: %s", attempt-1, maxAttempts, wait, err)
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		err = op()
+	}
+	return err
+}
@@ -0,0 +1,80 @@
+package http3rd
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRetryAfter(t *testing.T) {
+	policy := &RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 10 * time.Second}
+
+	// Honoured by default
+	if wait := policy.backoff(1, 5*time.Second); wait != 5*time.Second {
+		t.Error("Expecting the Retry-After to be honoured, got ", wait)
+	}
+	// But never beyond the maximum backoff
+	if wait := policy.backoff(1, time.Hour); wait != 10*time.Second {
+		t.Error("Expecting the Retry-After to be capped, got ", wait)
+	}
+	// Shorter than the backoff
+	if wait := policy.backoff(3, time.Second); wait != 4*time.Second {
+		t.Error("Expecting the exponential backoff, got ", wait)
+	}
+
+	policy.IgnoreRetryAfter = true
+	if wait := policy.backoff(1, 5*time.Second); wait != time.Second {
+		t.Error("Expecting the Retry-After to be ignored, got ", wait)
+	}
+}
+
+func TestRetryDo(t *testing.T) {
+	policy := &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	attempts := 0
+	err := policy.Do(context.Background(), func() error {
+		attempts++
+		if attempts < 3 {
+			return &HTTPError{StatusCode: http.StatusServiceUnavailable, RetryAfter: time.Hour}
+		}
+		return nil
+	})
+	if err != nil || attempts != 3 {
+		t.Error("Expecting success after three attempts, got ", attempts, err)
+	}
+
+	attempts = 0
+	err = policy.Do(context.Background(), func() error {
+		attempts++
+		return &HTTPError{StatusCode: http.StatusForbidden}
+	})
+	if err == nil || attempts != 1 {
+		t.Error("Expecting a single attempt for a non retryable error, got ", attempts, err)
+	}
+}
+
+func TestRetryDefaultAttempts(t *testing.T) {
+	// A zero MaxAttempts still retries
+	policy := &RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	attempts := 0
+	err := policy.Do(context.Background(), func() error {
+		attempts++
+		return &HTTPError{StatusCode: http.StatusServiceUnavailable}
+	})
+	if err == nil || attempts != DefaultMaxAttempts {
+		t.Error("Expecting the default number of attempts, got ", attempts, err)
+	}
+
+	// A single attempt disables the retries
+	policy.MaxAttempts = 1
+	attempts = 0
+	policy.Do(context.Background(), func() error {
+		attempts++
+		return &HTTPError{StatusCode: http.StatusServiceUnavailable}
+	})
+	if attempts != 1 {
+		t.Error("Expecting a single attempt, got ", attempts)
+	}
+}
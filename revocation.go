@@ -0,0 +1,178 @@
+package http3rd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"gitlab.cern.ch/flutter/go-proxy"
+	"golang.org/x/crypto/ocsp"
+	"strings"
+	"time"
+)
+
+// RevocationMode selects how the revocation of the server certificates is checked
+type RevocationMode int
+
+const (
+	// RevocationNone does not check the revocation
+	RevocationNone RevocationMode = iota
+	// RevocationSoftFail rejects revoked certificates, but accepts those whose status can not
+	// be determined (i.e. missing or expired CRL)
+	RevocationSoftFail
+	// RevocationHardFail rejects too the certificates whose status can not be determined
+	RevocationHardFail
+)
+
+// revocationChecker verifies the server certificates against the CRLs of the CA path,
+// and the stapled OCSP response
+type revocationChecker struct {
+	mode RevocationMode
+	ocsp bool
+	// crls indexed by the raw issuer name
+	crls map[string]*x509.RevocationList
+}
+
+// String returns the name of the revocation mode
+func (m RevocationMode) String() string {
+	switch m {
+	case RevocationNone:
+		return "none"
+	case RevocationSoftFail:
+		return "soft"
+	case RevocationHardFail:
+		return "hard"
+	}
+	return fmt.Sprintf("RevocationMode(%d)", int(m))
+}
+
+// ParseRevocationMode returns the RevocationMode matching the given name
+func ParseRevocationMode(name string) (RevocationMode, error) {
+	switch strings.ToLower(name) {
+	case "none":
+		return RevocationNone, nil
+	case "soft", "soft-fail":
+		return RevocationSoftFail, nil
+	case "hard", "hard-fail":
+		return RevocationHardFail, nil
+	}
+	return RevocationNone, fmt.Errorf("Unknown revocation mode: %s", name)
+}
+
+// newRevocationChecker builds a checker from the CAs and CRLs of the pool
+// CRLs that can not be parsed, or that are not signed by a known CA, are skipped.
+func newRevocationChecker(mode RevocationMode, ocsp bool, pool *proxy.CertPool) *revocationChecker {
+	crls := make(map[string]*x509.RevocationList)
+	for hash, list := range pool.Crls {
+		// go-proxy decodes with the deprecated pkix types, re-encode to get the x509 one
+		raw, e := asn1.Marshal(*list)
+		if e == nil {
+			var crl *x509.RevocationList
+			if crl, e = x509.ParseRevocationList(raw); e == nil {
+				e = checkCRLSignature(crl, pool.CaByHash)
+			}
+			if e == nil {
+				// Keep the most recent one if there are several for the same CA
+				if previous, ok := crls[string(crl.RawIssuer)]; !ok || crl.ThisUpdate.After(previous.ThisUpdate) {
+					crls[string(crl.RawIssuer)] = crl
+				}
+				continue
+			}
+		}
+		logrus.Warn("Skipping CRL ", hash, ": ", e)
+	}
+	logrus.Debug("Loaded ", len(crls), " CRLs")
+	return &revocationChecker{mode: mode, ocsp: ocsp, crls: crls}
+}
+
+// checkCRLSignature verifies that the CRL is signed by one of the CAs
+func checkCRLSignature(crl *x509.RevocationList, cas map[string]*x509.Certificate) error {
+	for _, ca := range cas {
+		if bytes.Equal(ca.RawSubject, crl.RawIssuer) && crl.CheckSignatureFrom(ca) == nil {
+			return nil
+		}
+	}
+	return errors.New("Not signed by any known CA")
+}
+
+// undetermined applies the policy when the status of a certificate can not be determined
+func (c *revocationChecker) undetermined(err error) error {
+	if c.mode == RevocationHardFail {
+		return err
+	}
+	logrus.Warn(err)
+	return nil
+}
+
+// checkCRL verifies the certificate against the CRL of its issuer
+func (c *revocationChecker) checkCRL(cert *x509.Certificate) error {
+	crl, ok := c.crls[string(cert.RawIssuer)]
+	if !ok {
+		return c.undetermined(fmt.Errorf("No CRL for the issuer of %s", cert.Subject))
+	}
+	for _, entry := range crl.RevokedCertificateEntries {
+		if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			return &CertificateRevokedError{
+				Subject:   cert.Subject.String(),
+				Serial:    cert.SerialNumber.String(),
+				RevokedAt: entry.RevocationTime,
+				Source:    "CRL",
+			}
+		}
+	}
+	if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+		return c.undetermined(fmt.Errorf("The CRL of %s expired on %s", crl.Issuer, crl.NextUpdate.Format(time.RFC3339)))
+	}
+	return nil
+}
+
+// checkOCSP verifies the certificate against the OCSP response stapled by the server
+func (c *revocationChecker) checkOCSP(staple []byte, cert, issuer *x509.Certificate) error {
+	resp, e := ocsp.ParseResponseForCert(staple, cert, issuer)
+	if e != nil {
+		return c.undetermined(fmt.Errorf("Invalid OCSP response for %s: %w", cert.Subject, e))
+	}
+	switch resp.Status {
+	case ocsp.Good:
+		if !resp.NextUpdate.IsZero() && time.Now().After(resp.NextUpdate) {
+			return c.undetermined(fmt.Errorf("The OCSP response for %s expired on %s", cert.Subject, resp.NextUpdate.Format(time.RFC3339)))
+		}
+		return nil
+	case ocsp.Revoked:
+		return &CertificateRevokedError{
+			Subject:   cert.Subject.String(),
+			Serial:    cert.SerialNumber.String(),
+			RevokedAt: resp.RevokedAt,
+			Source:    "OCSP",
+		}
+	}
+	return c.undetermined(fmt.Errorf("The OCSP responder does not know the status of %s", cert.Subject))
+}
+
+// verifyConnection can be used as tls.Config.VerifyConnection
+// The leaf is checked with the stapled OCSP response, if enabled and sent by the server, otherwise
+// with the CRL. The intermediate CAs are checked with the CRLs.
+func (c *revocationChecker) verifyConnection(state tls.ConnectionState) error {
+	if len(state.VerifiedChains) == 0 {
+		logrus.Debug("The server certificate has not been verified, skipping the revocation check")
+		return nil
+	}
+	chain := state.VerifiedChains[0]
+
+	// The last one is the trust anchor
+	for i := 0; i < len(chain)-1; i++ {
+		var e error
+		if i == 0 && c.ocsp && len(state.OCSPResponse) > 0 {
+			e = c.checkOCSP(state.OCSPResponse, chain[0], chain[1])
+		} else {
+			e = c.checkCRL(chain[i])
+		}
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
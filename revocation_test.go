@@ -0,0 +1,239 @@
+package http3rd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"golang.org/x/crypto/ocsp"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a CA whose certificate is stored in its own CA path
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	dir  string
+}
+
+// testCAHash names the files of the test CAs
+const testCAHash = "a1b2c3d4"
+
+// newTestCA generates a CA, all of them share the same subject
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(raw)
+
+	ca := &testCA{cert: cert, key: key, dir: t.TempDir()}
+	pemCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: raw})
+	if err = ioutil.WriteFile(filepath.Join(ca.dir, testCAHash+".0"), pemCert, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return ca
+}
+
+// issue returns a server certificate for 127.0.0.1
+func (ca *testCA) issue(t *testing.T, serial int64) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(raw)
+	return tls.Certificate{Certificate: [][]byte{raw}, PrivateKey: key, Leaf: leaf}
+}
+
+// writeCRL writes into dir a CRL revoking the given serials
+func (ca *testCA) writeCRL(t *testing.T, dir string, nextUpdate time.Time, revoked ...int64) {
+	template := &x509.RevocationList{
+		Number:     big.NewInt(time.Now().UnixNano()),
+		ThisUpdate: time.Now().Add(-2 * time.Hour),
+		NextUpdate: nextUpdate,
+	}
+	for _, serial := range revoked {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now().Add(-time.Hour),
+		})
+	}
+	raw, err := x509.CreateRevocationList(rand.Reader, template, ca.cert, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemCRL := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: raw})
+	if err = ioutil.WriteFile(filepath.Join(dir, testCAHash+".r0"), pemCRL, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// staple returns an OCSP response for the certificate, signed by the CA
+func (ca *testCA) staple(t *testing.T, cert tls.Certificate, status int) []byte {
+	raw, err := ocsp.CreateResponse(ca.cert, ca.cert, ocsp.Response{
+		Status:       status,
+		SerialNumber: cert.Leaf.SerialNumber,
+		ThisUpdate:   time.Now().Add(-time.Hour),
+		NextUpdate:   time.Now().Add(time.Hour),
+		RevokedAt:    time.Now().Add(-time.Hour),
+	}, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// get connects to a server presenting the certificate, and returns the error, if any
+func get(t *testing.T, params *Params, cert tls.Certificate) error {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	// The rejected handshakes are expected
+	server.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	client, err := BuildHttpClient(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func TestRevocationCRL(t *testing.T) {
+	const (
+		noCRL = iota
+		validCRL
+		expiredCRL
+		otherCA
+	)
+	tests := []struct {
+		name    string
+		crl     int
+		revoked bool
+		// expected to be accepted in each mode
+		soft, hard bool
+	}{
+		{"valid CRL", validCRL, false, true, true},
+		{"revoked", validCRL, true, false, false},
+		{"revoked with an expired CRL", expiredCRL, true, false, false},
+		{"no CRL", noCRL, false, true, false},
+		{"expired CRL", expiredCRL, false, true, false},
+		// Same subject, another key: the CRL is ignored
+		{"CRL of another CA", otherCA, true, true, false},
+	}
+
+	for _, test := range tests {
+		ca := newTestCA(t)
+		cert := ca.issue(t, 42)
+		var revoked []int64
+		if test.revoked {
+			revoked = append(revoked, 42)
+		}
+		switch test.crl {
+		case validCRL:
+			ca.writeCRL(t, ca.dir, time.Now().Add(time.Hour), revoked...)
+		case expiredCRL:
+			ca.writeCRL(t, ca.dir, time.Now().Add(-time.Minute), revoked...)
+		case otherCA:
+			newTestCA(t).writeCRL(t, ca.dir, time.Now().Add(time.Hour), revoked...)
+		}
+
+		for mode, accepted := range map[RevocationMode]bool{RevocationSoftFail: test.soft, RevocationHardFail: test.hard} {
+			err := get(t, &Params{CAPath: ca.dir, Revocation: mode}, cert)
+			if accepted && err != nil {
+				t.Errorf("%s (%s): expecting the certificate to be accepted, got %s", test.name, mode, err)
+			} else if !accepted && err == nil {
+				t.Errorf("%s (%s): expecting the certificate to be rejected", test.name, mode)
+			}
+
+			var revokedErr *CertificateRevokedError
+			if errors.As(err, &revokedErr) != (test.revoked && !accepted && test.crl != otherCA) {
+				t.Errorf("%s (%s): unexpected error %v", test.name, mode, err)
+			} else if revokedErr != nil && (revokedErr.Source != "CRL" || revokedErr.Serial != "42") {
+				t.Errorf("%s (%s): unexpected revocation %+v", test.name, mode, revokedErr)
+			}
+		}
+
+		// Not checked at all
+		if err := get(t, &Params{CAPath: ca.dir}, cert); err != nil {
+			t.Errorf("%s: expecting no revocation check, got %s", test.name, err)
+		}
+	}
+}
+
+func TestRevocationOCSP(t *testing.T) {
+	ca := newTestCA(t)
+	revoked := ca.issue(t, 42)
+	good := ca.issue(t, 43)
+	ca.writeCRL(t, ca.dir, time.Now().Add(time.Hour), 42)
+
+	// The stapled response takes precedence over the CRL
+	revoked.OCSPStaple = ca.staple(t, revoked, ocsp.Good)
+	if err := get(t, &Params{CAPath: ca.dir, Revocation: RevocationHardFail, OCSPStapling: true}, revoked); err != nil {
+		t.Error("Expecting the stapled response to be used, got ", err)
+	}
+	// Unless disabled
+	var revokedErr *CertificateRevokedError
+	err := get(t, &Params{CAPath: ca.dir, Revocation: RevocationHardFail}, revoked)
+	if !errors.As(err, &revokedErr) || revokedErr.Source != "CRL" {
+		t.Error("Expecting the CRL to be used, got ", err)
+	}
+
+	good.OCSPStaple = ca.staple(t, good, ocsp.Revoked)
+	err = get(t, &Params{CAPath: ca.dir, Revocation: RevocationSoftFail, OCSPStapling: true}, good)
+	if !errors.As(err, &revokedErr) || revokedErr.Source != "OCSP" {
+		t.Error("Expecting the stapled response to be used, got ", err)
+	}
+
+	// A response for another certificate can not be used
+	good.OCSPStaple = ca.staple(t, revoked, ocsp.Good)
+	if err = get(t, &Params{CAPath: ca.dir, Revocation: RevocationHardFail, OCSPStapling: true}, good); err == nil {
+		t.Error("Expecting an invalid stapled response to be rejected in hard mode")
+	}
+	if err = get(t, &Params{CAPath: ca.dir, Revocation: RevocationSoftFail, OCSPStapling: true}, good); err != nil {
+		t.Error("Expecting an invalid stapled response to be accepted in soft mode, got ", err)
+	}
+}
@@ -0,0 +1,144 @@
+package http3rd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+type (
+	// TokenProvider is implemented by any mechanism able to issue a bearer token
+	// for a resource, valid for the given activities
+	// The token is opaque: it is just passed along in the Authorization headers.
+	TokenProvider interface {
+		Token(ctx context.Context, resource string, activities []string, lifetime time.Duration) (string, error)
+	}
+
+	// ExpiringTokenProvider is a TokenProvider that is told when the tokens it issues expire
+	// The expiration is zero if unknown.
+	ExpiringTokenProvider interface {
+		TokenProvider
+		TokenWithExpiry(ctx context.Context, resource string, activities []string, lifetime time.Duration) (string, time.Time, error)
+	}
+
+	// MacaroonProvider negotiates a macaroon with the storage holding the resource
+	MacaroonProvider struct {
+		// Client must be configured with credentials the storage accepts (i.e. X509)
+		Client *http.Client
+		// Expiry selects how the lifetime is sent
+		Expiry ExpiryMode
+		// Retry, if set, retries transient failures
+		Retry *RetryPolicy
+	}
+
+	// StaticToken is a pre-issued token, returned as is regardless of the request
+	StaticToken string
+
+	// FileToken reads a pre-issued token from a file
+	// The file is read for each request, so it can be refreshed by an external process.
+	FileToken struct {
+		Path string
+	}
+
+	// CommandToken runs an external command, and uses its standard output as the token
+	// The request is passed to the command via the environment variables
+	// HTTP3RD_RESOURCE, HTTP3RD_ACTIVITIES (comma separated) and HTTP3RD_LIFETIME (seconds).
+	CommandToken struct {
+		Command string
+		Args    []string
+	}
+)
+
+// Token implements TokenProvider
+func (p *MacaroonProvider) Token(ctx context.Context, resource string, activities []string, lifetime time.Duration) (string, error) {
+	resp, err := GetMacaroonContext(ctx, p.Client, &MacaroonRequest{
+		Resource:   resource,
+		Activities: activities,
+		Lifetime:   lifetime,
+		Expiry:     p.Expiry,
+		Retry:      p.Retry,
+	})
+	if err != nil {
+		return "", err
+	}
+	return resp.Macaroon, nil
+}
+
+// Token implements TokenProvider
+func (t StaticToken) Token(ctx context.Context, resource string, activities []string, lifetime time.Duration) (string, error) {
+	if t == "" {
+		return "", errors.New("Empty static token")
+	}
+	return string(t), nil
+}
+
+// Token implements TokenProvider
+func (f *FileToken) Token(ctx context.Context, resource string, activities []string, lifetime time.Duration) (string, error) {
+	content, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return "", fmt.Errorf("Empty token file: %s", f.Path)
+	}
+	return token, nil
+}
+
+// Token implements TokenProvider
+func (c *CommandToken) Token(ctx context.Context, resource string, activities []string, lifetime time.Duration) (string, error) {
+	cmd := exec.CommandContext(ctx, c.Command, c.Args...)
+	cmd.Env = append(os.Environ(),
+		"HTTP3RD_RESOURCE="+resource,
+		"HTTP3RD_ACTIVITIES="+strings.Join(activities, ","),
+		fmt.Sprint("HTTP3RD_LIFETIME=", int64(lifetime.Seconds())),
+	)
+
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("Token command %s failed: %s (%s)", c.Command, err, strings.TrimSpace(stderr.String()))
+	}
+
+	token := strings.TrimSpace(string(output))
+	if token == "" {
+		return "", fmt.Errorf("Token command %s did not print any token", c.Command)
+	}
+	return token, nil
+}
+
+// redactToken returns enough of the token to tell it apart in the logs, but not to use it
+func redactToken(token string) string {
+	const shown = 8
+	if len(token) <= 2*shown {
+		return fmt.Sprintf("<%d characters>", len(token))
+	}
+	return fmt.Sprintf("%s...<%d characters>", token[:shown], len(token))
+}
+
+// redactedRequest returns a copy of the request, with the credential headers redacted, to be logged
+// The authorization scheme (i.e. Bearer) is kept.
+func redactedRequest(r *http.Request) *http.Request {
+	redacted := r.Clone(r.Context())
+	for name, values := range redacted.Header {
+		if !isCredentialHeader(name) {
+			continue
+		}
+		for i, value := range values {
+			if space := strings.IndexByte(value, ' '); space > 0 {
+				values[i] = value[:space+1] + redactToken(value[space+1:])
+			} else {
+				values[i] = redactToken(value)
+			}
+		}
+	}
+	return redacted
+}
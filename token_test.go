@@ -0,0 +1,96 @@
+package http3rd
+
+import (
+	"bytes"
+	"context"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedactToken(t *testing.T) {
+	token := "MDAxY2xvY2F0aW9uIAowMDE4aWRlbnRpZmllciBzZWNyZXQK"
+	redacted := redactToken(token)
+	if strings.Contains(redacted, token[8:]) {
+		t.Error("The token is not redacted: ", redacted)
+	}
+	if !strings.HasPrefix(redacted, token[:8]) {
+		t.Error("Expecting the beginning of the token, got ", redacted)
+	}
+	if redacted = redactToken("short"); strings.Contains(redacted, "short") {
+		t.Error("A short token must not be shown at all: ", redacted)
+	}
+}
+
+func TestRedactedRequest(t *testing.T) {
+	token := "MDAxY2xvY2F0aW9uIAowMDE4aWRlbnRpZmllciBzZWNyZXQK"
+	req, _ := http.NewRequest("COPY", "https://se.example.com/file", nil)
+	req.Header.Set("Authorization", "BEARER "+token)
+	req.Header.Set("TransferHeaderAuthorization", "BEARER "+token)
+	req.Header.Set("Cookie", "session="+token)
+	req.Header.Set("Destination", "https://other.example.com/file")
+
+	dump, err := httputil.DumpRequest(redactedRequest(req), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(dump), token[8:]) {
+		t.Error("The dump contains the token: ", string(dump))
+	}
+	if !strings.Contains(string(dump), "Authorization: BEARER MDAxY2xv...") {
+		t.Error("Expecting the scheme and the beginning of the token, got ", string(dump))
+	}
+	if !strings.Contains(string(dump), "Destination: https://other.example.com/file") {
+		t.Error("The other headers must be kept: ", string(dump))
+	}
+	if req.Header.Get("Authorization") != "BEARER "+token {
+		t.Error("The original request has been modified")
+	}
+}
+
+// captureDebug returns the debug logs written while running f
+func captureDebug(f func()) string {
+	buffer := &bytes.Buffer{}
+	out, level := logrus.StandardLogger().Out, logrus.GetLevel()
+	logrus.SetOutput(buffer)
+	logrus.SetLevel(logrus.DebugLevel)
+	defer func() {
+		logrus.SetOutput(out)
+		logrus.SetLevel(level)
+	}()
+	f()
+	return buffer.String()
+}
+
+func TestTokensNotLogged(t *testing.T) {
+	issuer := newTestIssuer(t, "litmus", "s3cr3t")
+	provider := &OAuth2Provider{TokenEndpoint: issuer.URL + "/token", ClientID: "litmus", ClientSecret: "s3cr3t"}
+	var token string
+	var err error
+	logs := captureDebug(func() {
+		token, err = provider.Token(context.Background(), "https://se.example.com/dteam/file", []string{Download}, time.Minute)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(logs, token) {
+		t.Error("The access token has been logged: ", logs)
+	}
+
+	server := httptest.NewServer(&macaroonRequests{})
+	defer server.Close()
+	var response *MacaroonResponse
+	logs = captureDebug(func() {
+		response, err = GetMacaroon(server.Client(), &MacaroonRequest{Resource: server.URL, Activities: []string{List}})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(logs, response.Macaroon) {
+		t.Error("The macaroon has been logged: ", logs)
+	}
+}
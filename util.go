@@ -1,14 +1,11 @@
 package http3rd
 
 import (
+	"context"
 	"crypto/tls"
-	"errors"
 	"github.com/sirupsen/logrus"
 	"gitlab.cern.ch/flutter/go-proxy"
-	"io"
 	"net/http"
-	"net/url"
-	"io/ioutil"
 )
 
 func BuildHttpTransport(params *Params) (*http.Transport, error) {
@@ -18,15 +15,22 @@ func BuildHttpTransport(params *Params) (*http.Transport, error) {
 	certificates := []tls.Certificate{}
 
 	if params.UserCert != "" {
-		cert, e := tls.LoadX509KeyPair(params.UserCert, params.UserKey)
+		creds, e := LoadCredentials(params.UserCert, params.UserKey)
 		if e != nil {
 			return nil, e
 		}
-		certificates = append(certificates, cert)
+		if e = creds.Check(); e != nil {
+			return nil, e
+		}
+		logrus.Debug("Identity: ", creds.Identity)
+		for _, attr := range creds.VOMS {
+			logrus.Debug("VOMS: ", attr.FQAN)
+		}
+		certificates = append(certificates, creds.Certificate)
 	}
 
 	logrus.Debug("CA Path: ", params.CAPath)
-	rootCerts, e := proxy.LoadCAPath(params.CAPath, false)
+	rootCerts, e := proxy.LoadCAPath(params.CAPath, params.Revocation != RevocationNone)
 	if e != nil {
 		return nil, e
 	}
@@ -34,12 +38,19 @@ func BuildHttpTransport(params *Params) (*http.Transport, error) {
 		logrus.Debug("CA: ", proxy.NameRepr(&ca.Subject))
 	}
 
+	tlsConfig := &tls.Config{
+		Certificates:       certificates,
+		RootCAs:            rootCerts.CertPool,
+		InsecureSkipVerify: params.Insecure,
+	}
+
+	if params.Revocation != RevocationNone {
+		checker := newRevocationChecker(params.Revocation, params.OCSPStapling, rootCerts)
+		tlsConfig.VerifyConnection = checker.verifyConnection
+	}
+
 	return &http.Transport{
-		TLSClientConfig: &tls.Config{
-			Certificates:       certificates,
-			RootCAs:            rootCerts.CertPool,
-			InsecureSkipVerify: params.Insecure,
-		},
+		TLSClientConfig: tlsConfig,
 	}, nil
 }
 
@@ -50,45 +61,20 @@ func BuildHttpClient(params *Params) (*http.Client, error) {
 		return nil, e
 	}
 	return &http.Client{
-		Transport: transport,
+		Transport:     transport,
+		CheckRedirect: params.Redirect.CheckRedirect,
 	}, nil
 }
 
-// http.Do only follows redirects for GET, HEAD, POST and PUT
-// For COPY we have to do it ourselves (bummer)
+// DoWithRedirect sends the request, following the redirects with the default policy
+// http.Client turns a redirected COPY into a GET, so the redirects are followed here instead
 func DoWithRedirect(client *http.Client, r *http.Request) (resp *http.Response, err error) {
-	jumps := 10
-
-	// Wrap the body to avoid it being close on a redirect
-	originalBody := r.Body
-	if originalBody != nil {
-		defer originalBody.Close()
-		r.Body = ioutil.NopCloser(originalBody)
-	}
-
-	for {
-		resp, err = client.Do(r)
-		if err != nil || resp.StatusCode/100 != 3 {
-			return
-		}
-		if jumps--; jumps <= 0 {
-			err = errors.New("stopped after 10 redirects")
-			return
-		}
-		location := resp.Header.Get("Location")
-		r.URL, err = url.Parse(location)
-		if err != nil {
-			return
-		}
-		logrus.Debug("Following redirect: ", location)
-		if seeker, ok := originalBody.(io.Seeker); ok {
-			logrus.Debug("Rewind file")
-			_, err := seeker.Seek(0, io.SeekStart)
-			if err != nil {
-				return nil, err
-			}
-		}
-	}
+	return DoWithRedirectContext(context.Background(), client, r)
+}
 
-	return
+// DoWithRedirectContext is DoWithRedirect, but stops following redirects, and aborts
+// the connection, once the context is cancelled
+func DoWithRedirectContext(ctx context.Context, client *http.Client, r *http.Request) (resp *http.Response, err error) {
+	var policy *RedirectPolicy
+	return policy.Do(ctx, client, r)
 }